@@ -0,0 +1,190 @@
+// Package api holds the request and response schemas of the machine
+// interfaces of the game: the JSON API under /api/v1 and the game service,
+// the NATS micro service for clients that would rather talk NATS than
+// Datastar, like bots and chat bridges.
+//
+// Every request to the game service is a JSON document sent to one of the subjects below with a
+// NATS request. Successful requests are answered with the JSON response of
+// the operation; failed ones with a Nats-Service-Error-Code header holding an
+// HTTP status code and a Nats-Service-Error header with the reason.
+package api
+
+import (
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	// ServiceName and ServiceVersion identify the service for discovery,
+	// e.g. `nats micro info tictactoe`.
+	ServiceName    = "tictactoe"
+	ServiceVersion = "1.0.0"
+
+	// SubjectPrefix is the prefix of every subject of the service.
+	SubjectPrefix = "ttt.api"
+
+	// LoginSubject takes a LoginRequest and answers a LoginResponse.
+	LoginSubject = SubjectPrefix + ".login"
+	// CreateSubject takes a CreateRequest and answers a GameResponse.
+	CreateSubject = SubjectPrefix + ".create"
+	// JoinSubject takes a GameRequest and answers a GameResponse.
+	JoinSubject = SubjectPrefix + ".join"
+	// MoveSubject takes a MoveRequest and answers a GameResponse.
+	MoveSubject = SubjectPrefix + ".move"
+	// ResetSubject takes a GameRequest and answers a GameResponse. Only
+	// decided games can be reset; like moves, the reset reaches the board
+	// asynchronously.
+	ResetSubject = SubjectPrefix + ".reset"
+	// LeaveSubject takes a GameRequest and answers a LeaveResponse.
+	LeaveSubject = SubjectPrefix + ".leave"
+	// ListSubject takes a ListRequest and answers a ListResponse.
+	ListSubject = SubjectPrefix + ".list"
+)
+
+// LoginRequest signs in a player the same way the login page does, the first
+// login with a name registers it.
+type LoginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// LoginResponse holds the session every other request is made on behalf of.
+// Like those of the web app, sessions expire an hour after the login.
+type LoginResponse struct {
+	SessionId string `json:"session_id"`
+	Name      string `json:"name"`
+}
+
+// GameSettings configure a new game. Its fields are those of the create form
+// of the web app, named like every other field of the API.
+type GameSettings struct {
+	// Mode is "classic" or "ultimate".
+	Mode      string `json:"mode"`
+	BoardSize int    `json:"board_size"`
+	WinLength int    `json:"win_length"`
+	// Opponent is empty to wait for a player, or the difficulty of a bot:
+	// "easy", "medium" or "perfect".
+	Opponent string `json:"opponent"`
+	Private  bool   `json:"private"`
+	// MoveSeconds and GameMinutes are the time controls of the game, 0
+	// disables them.
+	MoveSeconds int `json:"move_seconds"`
+	GameMinutes int `json:"game_minutes"`
+	// BestOf is the length of the series, 1 plays single games.
+	BestOf int `json:"best_of"`
+	// InviteTTL is how many minutes the invite of a private game stays
+	// valid, 0 keeps it valid for as long as the game exists.
+	InviteTTL int `json:"invite_ttl"`
+}
+
+// CreateRequest creates a game hosted by the session. Settings left out take
+// the defaults of the create form.
+type CreateRequest struct {
+	SessionId string        `json:"session_id"`
+	Settings  *GameSettings `json:"settings,omitempty"`
+}
+
+// GameRequest names a game to act on.
+type GameRequest struct {
+	SessionId string `json:"session_id"`
+	GameId    string `json:"game_id"`
+}
+
+// Move plays Cell of Board. Classic games have a single board, so Board is
+// left out.
+type Move struct {
+	Board int `json:"board,omitempty"`
+	Cell  int `json:"cell"`
+}
+
+// MoveRequest plays a move in a game.
+type MoveRequest struct {
+	SessionId string `json:"session_id"`
+	GameId    string `json:"game_id"`
+	Move
+}
+
+// Lobby is a game lobby as clients see it. Session ids authenticate every
+// request, so seats are named by their players instead.
+type Lobby struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Host and Challenger are the names of the seated players. Challenger is
+	// empty while the seat is free.
+	Host       string `json:"host"`
+	Challenger string `json:"challenger,omitempty"`
+	// Seat is the seat of the session asking, "host" or "challenger", and
+	// empty for spectators.
+	Seat      string `json:"seat,omitempty"`
+	Mode      string `json:"mode"`
+	Size      int    `json:"size"`
+	WinLength int    `json:"win_length"`
+	Private   bool   `json:"private"`
+	// InviteCode is only shown to the host of a private game, who hands out
+	// the invite link /join/{code}.
+	InviteCode string `json:"invite_code,omitempty"`
+	BestOf     int    `json:"best_of"`
+}
+
+// GameResponse is a game as it is after the request. Moves are applied to
+// the board asynchronously, so the state answering a MoveRequest may not
+// include the move yet.
+type GameResponse struct {
+	Lobby Lobby                `json:"lobby"`
+	State components.GameState `json:"state"`
+}
+
+// LeaveResponse reports whether the session gave up the challenger's seat.
+// Hosts and spectators leave without changing the game.
+type LeaveResponse struct {
+	Left bool `json:"left"`
+}
+
+// ListRequest lists the games visible to the session.
+type ListRequest struct {
+	SessionId string `json:"session_id"`
+}
+
+// ListResponse holds the lobbies of the listed games.
+type ListResponse struct {
+	Lobbies []Lobby `json:"lobbies"`
+}
+
+// UserResponse is the user behind a session.
+type UserResponse struct {
+	SessionId string `json:"session_id"`
+	Name      string `json:"name"`
+	// PlayerId is empty for users without a registered player.
+	PlayerId string `json:"player_id,omitempty"`
+	Rating   int    `json:"rating"`
+}
+
+// MoveRecord is a move played in a game. Round counts the games of the lobby
+// and Sequence the moves of the round.
+//
+// Event is empty for moves. It is "forfeit" when Player ran out of time and
+// "reset" when Player started the next game of the lobby; Sequence is then
+// the number of moves played before.
+type MoveRecord struct {
+	Round     int       `json:"round"`
+	Sequence  int       `json:"sequence"`
+	Player    string    `json:"player"`
+	Board     int       `json:"board"`
+	Cell      int       `json:"cell"`
+	Event     string    `json:"event,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MovesResponse holds the moves played in a game and the events that ended
+// or reset its boards, oldest first.
+type MovesResponse struct {
+	Moves []MoveRecord `json:"moves"`
+}
+
+// Error is the body of every failed request to the JSON API.
+type Error struct {
+	// Status repeats the HTTP status code of the response.
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
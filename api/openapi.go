@@ -0,0 +1,240 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SessionCookie is the cookie that authenticates requests to the JSON API,
+// the same one the web app uses.
+const SessionCookie = "connections"
+
+// Operation describes an endpoint of the JSON API for its OpenAPI document.
+type Operation struct {
+	Method string
+	// Path is the route of the operation, path parameters are written as
+	// {name}.
+	Path    string
+	Id      string
+	Summary string
+	Tag     string
+	// Request is a value of the body the operation takes, nil for none.
+	Request any
+	// Response is a value of the body of a successful response, nil for none.
+	Response any
+	// Status is the status of a successful response.
+	Status int
+	// Public operations can be called without a session.
+	Public bool
+	// Stream operations answer with server sent events whose data are
+	// Response values.
+	Stream bool
+}
+
+var pathParameter = regexp.MustCompile(`\{(\w+)\}`)
+
+// OpenAPI generates the OpenAPI 3.1 document of operations. The schemas are
+// derived from the request and response values, so the document follows the
+// types as they change.
+func OpenAPI(title, version string, operations []Operation) map[string]any {
+	g := &generator{
+		names:   map[reflect.Type]string{},
+		schemas: map[string]any{},
+	}
+	errorSchema := g.schema(reflect.TypeOf(Error{}))
+
+	paths := map[string]map[string]any{}
+	for _, op := range operations {
+		responses := map[string]any{
+			"default": map[string]any{
+				"description": "Error",
+				"content":     jsonContent(errorSchema),
+			},
+		}
+		success := map[string]any{"description": http.StatusText(op.Status)}
+		switch {
+		case op.Stream:
+			success["content"] = map[string]any{
+				"text/event-stream": map[string]any{
+					"schema":       map[string]any{"type": "string"},
+					"x-event-data": g.schema(reflect.TypeOf(op.Response)),
+				},
+			}
+		case op.Response != nil:
+			success["content"] = jsonContent(g.schema(reflect.TypeOf(op.Response)))
+		}
+		responses[strconv.Itoa(op.Status)] = success
+
+		operation := map[string]any{
+			"operationId": op.Id,
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"responses":   responses,
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(g.schema(reflect.TypeOf(op.Request))),
+			}
+		}
+		if op.Public {
+			operation["security"] = []any{}
+		}
+
+		var parameters []any
+		for _, match := range pathParameter.FindAllStringSubmatch(op.Path, -1) {
+			parameters = append(parameters, map[string]any{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]any{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   title,
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"session": map[string]any{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": SessionCookie,
+				},
+			},
+		},
+		"security": []any{
+			map[string]any{"session": []string{}},
+		},
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{
+		"application/json": map[string]any{"schema": schema},
+	}
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// generator collects the schemas of named structs under components, so every
+// type is described once and referenced everywhere else.
+type generator struct {
+	names   map[reflect.Type]string
+	schemas map[string]any
+}
+
+func (g *generator) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]any{"type": "integer", "description": "Duration in nanoseconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.ref(t)
+	default:
+		return map[string]any{}
+	}
+}
+
+// ref returns a reference to the schema of a struct, describing the struct
+// the first time it is seen.
+func (g *generator) ref(t reflect.Type) map[string]any {
+	if t.Name() == "" {
+		return g.object(t)
+	}
+
+	name, ok := g.names[t]
+	if !ok {
+		name = t.Name()
+		if _, taken := g.schemas[name]; taken {
+			// Types of different packages may share a name.
+			pkg := path.Base(t.PkgPath())
+			name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+		}
+		g.names[t] = name
+		// Reserve the name first, structs may refer to themselves.
+		g.schemas[name] = nil
+		g.schemas[name] = g.object(t)
+	}
+
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func (g *generator) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	g.properties(t, properties)
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+// properties adds the fields of t as encoding/json marshals them, embedded
+// structs without a name of their own are inlined.
+func (g *generator) properties(t reflect.Type, properties map[string]any) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.properties(field.Type, properties)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+	}
+}
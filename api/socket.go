@@ -0,0 +1,61 @@
+package api
+
+import "github.com/rphumulock/datastar_nats_tictactoe/web/components"
+
+// The game WebSocket at /ws/game/{id} carries the updates of a game and the
+// commands of a player over one connection, for clients behind proxies that
+// buffer server sent events. Every message is a JSON text message.
+//
+// The server sends the board and the lobby as soon as the connection is
+// open, then every change as it happens, like the game page does.
+
+// Commands sent by clients.
+const (
+	CommandMove  = "move"
+	CommandReset = "reset"
+	CommandJoin  = "join"
+	CommandLeave = "leave"
+	CommandChat  = "chat"
+)
+
+// Events sent by the server.
+const (
+	EventBoard      = "board"
+	EventLobby      = "lobby"
+	EventSpectators = "spectators"
+	// EventPresence tells whether the seated players have the game open.
+	EventPresence = "presence"
+	EventClock    = "clock"
+	EventDeleted  = "deleted"
+	// EventChat carries a chat message. The recent history of the game is
+	// sent first, one message per event.
+	EventChat = "chat"
+	// EventResult answers a command, with Error set if it failed.
+	EventResult = "result"
+)
+
+// SocketCommand is a message from a client. Move is only read by moves and
+// Text by chat messages.
+type SocketCommand struct {
+	Type string `json:"type"`
+	// Id is repeated in the result of the command, so clients can match
+	// the results to their commands.
+	Id string `json:"id,omitempty"`
+	Move
+	Text string `json:"text,omitempty"`
+}
+
+// SocketEvent is a message from the server. Type decides which of the other
+// fields is set.
+type SocketEvent struct {
+	Type       string                   `json:"type"`
+	Board      *components.GameState    `json:"board,omitempty"`
+	Lobby      *Lobby                   `json:"lobby,omitempty"`
+	Spectators *int                     `json:"spectators,omitempty"`
+	Presence   *components.GamePresence `json:"presence,omitempty"`
+	Clock      *components.ClockView    `json:"clock,omitempty"`
+	Chat       *components.ChatMessage  `json:"chat,omitempty"`
+	// Id is the id of the command a result answers.
+	Id    string `json:"id,omitempty"`
+	Error *Error `json:"error,omitempty"`
+}
@@ -0,0 +1,238 @@
+// Package archive keeps finished games in a local SQLite database. Unlike
+// the key value buckets, which expire, the archive is the durable record of
+// who played whom, how the game went and how it ended.
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const poolSize = 4
+
+// Results of a game from the point of view of the seats.
+const (
+	ResultHost       = "host"
+	ResultChallenger = "challenger"
+	ResultDraw       = "draw"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS games (
+	id                    TEXT    NOT NULL,
+	round                 INTEGER NOT NULL,
+	name                  TEXT    NOT NULL,
+	mode                  TEXT    NOT NULL,
+	size                  INTEGER NOT NULL,
+	win_length            INTEGER NOT NULL,
+	host_session_id       TEXT    NOT NULL,
+	host_name             TEXT    NOT NULL,
+	host_player_id        TEXT    NOT NULL,
+	host_mark             TEXT    NOT NULL,
+	challenger_session_id TEXT    NOT NULL,
+	challenger_name       TEXT    NOT NULL,
+	challenger_player_id  TEXT    NOT NULL,
+	challenger_mark       TEXT    NOT NULL,
+	winner                TEXT    NOT NULL,
+	result                TEXT    NOT NULL,
+	forfeit               TEXT    NOT NULL,
+	moves                 INTEGER NOT NULL,
+	started_at            INTEGER NOT NULL,
+	ended_at              INTEGER NOT NULL,
+	duration_ms           INTEGER NOT NULL,
+	PRIMARY KEY (id, round)
+);
+
+CREATE INDEX IF NOT EXISTS games_host_player ON games (host_player_id);
+CREATE INDEX IF NOT EXISTS games_challenger_player ON games (challenger_player_id);
+CREATE INDEX IF NOT EXISTS games_ended_at ON games (ended_at);
+
+CREATE TABLE IF NOT EXISTS moves (
+	game_id    TEXT    NOT NULL,
+	round      INTEGER NOT NULL,
+	sequence   INTEGER NOT NULL,
+	session_id TEXT    NOT NULL,
+	player     TEXT    NOT NULL,
+	board      INTEGER NOT NULL,
+	cell       INTEGER NOT NULL,
+	played_at  INTEGER NOT NULL,
+	PRIMARY KEY (game_id, round, sequence),
+	FOREIGN KEY (game_id, round) REFERENCES games (id, round) ON DELETE CASCADE
+);
+`
+
+// Seat is a player of an archived game.
+type Seat struct {
+	SessionId string
+	Name      string
+	// PlayerId is the registered player behind the session, "" for guests
+	// and bots.
+	PlayerId string
+	Mark     string
+}
+
+// Move is a move of an archived game.
+type Move struct {
+	Sequence  int
+	SessionId string
+	Player    string
+	Board     int
+	Cell      int
+	PlayedAt  time.Time
+}
+
+// Game is a finished game. Every round of a lobby is archived as a game of
+// its own.
+type Game struct {
+	Id         string
+	Round      int
+	Name       string
+	Mode       string
+	Size       int
+	WinLength  int
+	Host       Seat
+	Challenger Seat
+	// Winner is the winning mark, or game.Tie for a draw.
+	Winner string
+	// Result is one of ResultHost, ResultChallenger or ResultDraw.
+	Result string
+	// Forfeit is the mark that lost on time, if any.
+	Forfeit   string
+	Moves     []Move
+	StartedAt time.Time
+	EndedAt   time.Time
+}
+
+// Duration is how long the game took from the first move to its end.
+func (g Game) Duration() time.Duration {
+	return g.EndedAt.Sub(g.StartedAt)
+}
+
+// Archive is a SQLite database of finished games.
+type Archive struct {
+	pool *sqlitex.Pool
+}
+
+// Open opens the archive at path, creating the database and its schema if
+// needed.
+func Open(ctx context.Context, path string) (*Archive, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	pool, err := sqlitex.NewPool(path, sqlitex.PoolOptions{
+		PoolSize: poolSize,
+		PrepareConn: func(conn *sqlite.Conn) error {
+			return sqlitex.ExecuteScript(conn, `
+				PRAGMA foreign_keys = ON;
+				PRAGMA busy_timeout = 5000;
+			`, nil)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %w", path, err)
+	}
+
+	conn, err := pool.Take(ctx)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to get archive connection: %w", err)
+	}
+	defer pool.Put(conn)
+
+	if err := sqlitex.ExecuteScript(conn, "PRAGMA journal_mode = WAL;"+schema, nil); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to create archive schema: %w", err)
+	}
+
+	return &Archive{pool: pool}, nil
+}
+
+// Close closes the database.
+func (a *Archive) Close() error {
+	return a.pool.Close()
+}
+
+// Has reports whether the given round of a game is archived.
+func (a *Archive) Has(ctx context.Context, id string, round int) (bool, error) {
+	conn, err := a.pool.Take(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get archive connection: %w", err)
+	}
+	defer a.pool.Put(conn)
+
+	found := false
+	err = sqlitex.Execute(conn, "SELECT 1 FROM games WHERE id = ? AND round = ?", &sqlitex.ExecOptions{
+		Args: []any{id, round},
+		ResultFunc: func(*sqlite.Stmt) error {
+			found = true
+			return nil
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to look up game %s: %w", id, err)
+	}
+	return found, nil
+}
+
+// Record archives game with its moves. Recording a game that is already
+// archived does nothing, so callers may record the same game again after a
+// restart.
+func (a *Archive) Record(ctx context.Context, game Game) (err error) {
+	conn, err := a.pool.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get archive connection: %w", err)
+	}
+	defer a.pool.Put(conn)
+
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return fmt.Errorf("failed to begin archive transaction: %w", err)
+	}
+	defer endFn(&err)
+
+	err = sqlitex.Execute(conn, `
+		INSERT INTO games (
+			id, round, name, mode, size, win_length,
+			host_session_id, host_name, host_player_id, host_mark,
+			challenger_session_id, challenger_name, challenger_player_id, challenger_mark,
+			winner, result, forfeit, moves, started_at, ended_at, duration_ms
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id, round) DO NOTHING`, &sqlitex.ExecOptions{
+		Args: []any{
+			game.Id, game.Round, game.Name, game.Mode, game.Size, game.WinLength,
+			game.Host.SessionId, game.Host.Name, game.Host.PlayerId, game.Host.Mark,
+			game.Challenger.SessionId, game.Challenger.Name, game.Challenger.PlayerId, game.Challenger.Mark,
+			game.Winner, game.Result, game.Forfeit, len(game.Moves),
+			game.StartedAt.UnixMilli(), game.EndedAt.UnixMilli(), game.Duration().Milliseconds(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive game %s: %w", game.Id, err)
+	}
+	if conn.Changes() == 0 {
+		return nil
+	}
+
+	for _, move := range game.Moves {
+		err = sqlitex.Execute(conn, `
+			INSERT INTO moves (game_id, round, sequence, session_id, player, board, cell, played_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, &sqlitex.ExecOptions{
+			Args: []any{
+				game.Id, game.Round, move.Sequence, move.SessionId, move.Player,
+				move.Board, move.Cell, move.PlayedAt.UnixMilli(),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to archive move %d of game %s: %w", move.Sequence, game.Id, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+type Difficulty string
+
+const (
+	// Easy plays a random legal move.
+	Easy Difficulty = "easy"
+	// Medium searches a couple of plies ahead.
+	Medium Difficulty = "medium"
+	// Perfect runs a full alpha-beta search, bounded only by the context.
+	Perfect Difficulty = "perfect"
+)
+
+const idPrefix = "bot-"
+
+var (
+	ErrUnknownDifficulty = errors.New("unknown bot difficulty")
+	ErrNoMoves           = errors.New("no legal moves")
+)
+
+func ParseDifficulty(s string) (Difficulty, error) {
+	switch d := Difficulty(s); d {
+	case Easy, Medium, Perfect:
+		return d, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownDifficulty, s)
+	}
+}
+
+// Id returns the session id used by a bot in GameLobby.ChallengerId.
+func Id(d Difficulty) string {
+	return idPrefix + string(d)
+}
+
+// FromId reports whether id belongs to a bot and, if so, its difficulty.
+func FromId(id string) (Difficulty, bool) {
+	if !strings.HasPrefix(id, idPrefix) {
+		return "", false
+	}
+	d, err := ParseDifficulty(strings.TrimPrefix(id, idPrefix))
+	return d, err == nil
+}
+
+// User returns the users bucket record for a bot.
+func User(d Difficulty) components.User {
+	return components.User{
+		Name:      fmt.Sprintf("🤖 Bot (%s)", strings.ToUpper(string(d[:1]))+string(d[1:])),
+		SessionId: Id(d),
+	}
+}
+
+// ChooseMove picks a move for the player whose turn it is. Searches stop when
+// ctx is done, returning the best move found so far.
+func ChooseMove(ctx context.Context, state components.GameState, d Difficulty) (game.Move, error) {
+	var engine game.Engine
+
+	moves := engine.LegalMoves(state)
+	if len(moves) == 0 {
+		return game.Move{}, ErrNoMoves
+	}
+
+	switch d {
+	case Easy:
+		return moves[rand.IntN(len(moves))], nil
+	case Medium:
+		return newSearch(ctx).bestMove(state, 2), nil
+	case Perfect:
+		return newSearch(ctx).bestMove(state, len(moves)), nil
+	default:
+		return game.Move{}, fmt.Errorf("%w: %q", ErrUnknownDifficulty, d)
+	}
+}
@@ -0,0 +1,211 @@
+package bot
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"slices"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	winScore = 1_000_000
+	// checkEvery is how many nodes are searched between context checks.
+	checkEvery = 1024
+	// neighbourhood limits large classic boards to cells near existing marks,
+	// otherwise a 15×15 board is far too wide to search.
+	neighbourhood = 2
+	wideBoardSize = 5
+)
+
+type search struct {
+	ctx     context.Context
+	engine  game.Engine
+	nodes   int
+	aborted bool
+}
+
+func newSearch(ctx context.Context) *search {
+	return &search{ctx: ctx}
+}
+
+// bestMove runs an iterative deepening alpha-beta search up to maxDepth plies
+// and returns the best move of the deepest completed iteration.
+func (s *search) bestMove(state components.GameState, maxDepth int) game.Move {
+	moves := s.candidates(state)
+	best := moves[0]
+
+	for depth := 1; depth <= maxDepth; depth++ {
+		move, score, ok := s.root(state, moves, depth)
+		if !ok {
+			break
+		}
+		best = move
+
+		// Search the best move first on the next iteration.
+		i := slices.Index(moves, move)
+		moves[0], moves[i] = moves[i], moves[0]
+
+		if score >= winScore || score <= -winScore {
+			break
+		}
+	}
+
+	return best
+}
+
+func (s *search) root(state components.GameState, moves []game.Move, depth int) (game.Move, int, bool) {
+	alpha, beta := math.MinInt+1, math.MaxInt
+	best := moves[0]
+
+	for _, move := range moves {
+		next, err := s.engine.Apply(state, move)
+		if err != nil {
+			continue
+		}
+		score := -s.negamax(next, depth-1, -beta, -alpha)
+		if s.aborted {
+			return game.Move{}, 0, false
+		}
+		if score > alpha {
+			alpha, best = score, move
+		}
+	}
+
+	return best, alpha, true
+}
+
+// negamax scores state from the point of view of the player to move.
+func (s *search) negamax(state components.GameState, depth, alpha, beta int) int {
+	s.nodes++
+	if s.nodes%checkEvery == 0 && s.ctx.Err() != nil {
+		s.aborted = true
+	}
+	if s.aborted {
+		return 0
+	}
+
+	switch state.Winner {
+	case "":
+	case game.Tie:
+		return 0
+	default:
+		// The previous player just won; prefer losing as late as possible.
+		return -(winScore + depth)
+	}
+
+	if depth == 0 {
+		return evaluate(state, s.engine.Next(state))
+	}
+
+	for _, move := range s.candidates(state) {
+		next, err := s.engine.Apply(state, move)
+		if err != nil {
+			continue
+		}
+		score := -s.negamax(next, depth-1, -beta, -alpha)
+		if score > alpha {
+			alpha = score
+		}
+		if alpha >= beta {
+			break
+		}
+	}
+
+	return alpha
+}
+
+// candidates returns the legal moves worth searching, centre cells first.
+func (s *search) candidates(state components.GameState) []game.Move {
+	moves := s.engine.LegalMoves(state)
+	rand.Shuffle(len(moves), func(i, j int) {
+		moves[i], moves[j] = moves[j], moves[i]
+	})
+
+	if state.Mode != components.ModeUltimate && state.Size > wideBoardSize {
+		if near := nearMarks(state, moves); len(near) > 0 {
+			moves = near
+		}
+	}
+
+	centre := float64(state.Size-1) / 2
+	distance := func(cell int) float64 {
+		return math.Abs(float64(cell/state.Size)-centre) + math.Abs(float64(cell%state.Size)-centre)
+	}
+	slices.SortStableFunc(moves, func(a, b game.Move) int {
+		if d := distance(a.Cell) - distance(b.Cell); d != 0 {
+			if d < 0 {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
+
+	return moves
+}
+
+func nearMarks(state components.GameState, moves []game.Move) []game.Move {
+	var near []game.Move
+	for _, move := range moves {
+		row, col := move.Cell/state.Size, move.Cell%state.Size
+	search:
+		for r := max(row-neighbourhood, 0); r <= min(row+neighbourhood, state.Size-1); r++ {
+			for c := max(col-neighbourhood, 0); c <= min(col+neighbourhood, state.Size-1); c++ {
+				if state.Board[r*state.Size+c] != "" {
+					near = append(near, move)
+					break search
+				}
+			}
+		}
+	}
+	return near
+}
+
+// evaluate scores an unfinished position for player by counting the lines
+// each side can still complete, weighted by how full they already are.
+func evaluate(state components.GameState, player string) int {
+	if state.Mode == components.ModeUltimate {
+		score := 100 * evaluateBoard(state.Board, state.Size, state.WinLength, player)
+		for b, subBoard := range state.Ultimate.Boards {
+			if state.Board[b] == "" {
+				score += evaluateBoard(subBoard, game.DefaultSize, game.DefaultSize, player)
+			}
+		}
+		return score
+	}
+	return evaluateBoard(state.Board, state.Size, state.WinLength, player)
+}
+
+func evaluateBoard(board []string, size, winLength int, player string) int {
+	opponent := game.Opponent(player)
+	score := 0
+	for _, line := range game.Lines(size, winLength) {
+		mine, theirs := 0, 0
+		for _, i := range line {
+			switch board[i] {
+			case player:
+				mine++
+			case opponent:
+				theirs++
+			}
+		}
+		switch {
+		case theirs == 0 && mine > 0:
+			score += weight(mine)
+		case mine == 0 && theirs > 0:
+			score -= weight(theirs)
+		}
+	}
+	return score
+}
+
+func weight(marks int) int {
+	w := 1
+	for range marks - 1 {
+		w *= 10
+	}
+	return w
+}
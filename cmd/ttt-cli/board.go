@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// markOf returns the mark the client plays, empty for spectators.
+func markOf(g api.GameResponse) string {
+	if g.Lobby.Seat == "" {
+		return ""
+	}
+	return game.MarkOf(g.State, g.Lobby.Seat)
+}
+
+// cellLabel shows a mark, or the index to type for an empty cell.
+func cellLabel(mark string, index, width int) string {
+	if mark == "" {
+		mark = strconv.Itoa(index)
+	}
+	return fmt.Sprintf("%*s", width, mark)
+}
+
+// renderBoard draws a classic board with the index of every empty cell.
+func renderBoard(w io.Writer, state components.GameState) {
+	width := len(strconv.Itoa(len(state.Board) - 1))
+	separator := strings.Repeat("-", (width+3)*state.Size-1)
+
+	for row := range state.Size {
+		if row > 0 {
+			fmt.Fprintln(w, separator)
+		}
+		cells := make([]string, state.Size)
+		for col := range state.Size {
+			index := row*state.Size + col
+			cells[col] = " " + cellLabel(state.Board[index], index, width) + " "
+		}
+		fmt.Fprintln(w, strings.Join(cells, "|"))
+	}
+}
+
+// renderUltimate draws the nine sub-boards of an ultimate game in their
+// places. Moves are typed as "board cell", both counted 0-8 row by row.
+func renderUltimate(w io.Writer, state components.GameState) {
+	ultimate := state.Ultimate
+	size := state.Size
+	// Every sub-board row is " x x x ", joined by "||".
+	separator := strings.Repeat("=", size*(2*size+1)+2*(size-1))
+
+	for outerRow := range size {
+		if outerRow > 0 {
+			fmt.Fprintln(w, separator)
+		}
+		for row := range size {
+			var line []string
+			for outerCol := range size {
+				board := outerRow*size + outerCol
+				cells := make([]string, size)
+				for col := range size {
+					index := row*size + col
+					mark := ultimate.Boards[board][index]
+					if mark == "" {
+						mark = "."
+					}
+					cells[col] = mark
+				}
+				line = append(line, " "+strings.Join(cells, " ")+" ")
+			}
+			fmt.Fprintln(w, strings.Join(line, "||"))
+		}
+	}
+
+	var decided []string
+	for board, mark := range state.Board {
+		if mark != "" {
+			decided = append(decided, fmt.Sprintf("%d: %s", board, mark))
+		}
+	}
+	if len(decided) > 0 {
+		fmt.Fprintf(w, "Decided boards  %s\n", strings.Join(decided, ", "))
+	}
+	if ultimate.ActiveBoard == game.AnyBoard {
+		fmt.Fprintln(w, "Play on any open board")
+	} else {
+		fmt.Fprintf(w, "Play on board %d\n", ultimate.ActiveBoard)
+	}
+}
+
+// renderGame draws a game as seen by the client.
+func renderGame(w io.Writer, g api.GameResponse) {
+	state := g.State
+	fmt.Fprintf(w, "%s  %s %dx%d, %d in a row\n\n", g.Lobby.Name, state.Mode, state.Size, state.Size, state.WinLength)
+
+	if state.Mode == components.ModeUltimate {
+		renderUltimate(w, state)
+	} else {
+		renderBoard(w, state)
+	}
+	fmt.Fprintln(w)
+
+	if series := state.Series; series != nil && series.BestOf > 1 {
+		fmt.Fprintf(w, "Best of %d  host %d, challenger %d, draws %d\n", series.BestOf, series.HostWins, series.ChallengerWins, series.Draws)
+	}
+
+	mark := markOf(g)
+	next := (game.Engine{}).Next(state)
+	switch {
+	case state.Winner == game.Tie:
+		fmt.Fprintln(w, "Draw.")
+	case state.Winner != "" && state.Forfeit != "":
+		fmt.Fprintf(w, "%s wins, %s ran out of time.\n", state.Winner, state.Forfeit)
+	case state.Winner != "":
+		fmt.Fprintf(w, "%s wins.\n", state.Winner)
+	case g.Lobby.Challenger == "":
+		fmt.Fprintln(w, "Waiting for a challenger...")
+	case mark == "":
+		fmt.Fprintf(w, "Spectating, %s to move.\n", next)
+	case mark == next:
+		fmt.Fprintf(w, "You are %s, your move.\n", mark)
+	default:
+		fmt.Fprintf(w, "You are %s, waiting for %s.\n", mark, next)
+	}
+}
+
+// renderLobby describes a lobby on one line.
+func renderLobby(gameLobby api.Lobby) string {
+	status := "open"
+	switch {
+	case gameLobby.Challenger != "":
+		status = "full"
+	case gameLobby.Private:
+		status = "private"
+	}
+	return fmt.Sprintf("%s\t%s\t%s %dx%d\t%s", gameLobby.Id, gameLobby.Name, gameLobby.Mode, gameLobby.Size, gameLobby.Size, status)
+}
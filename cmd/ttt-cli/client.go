@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+)
+
+// client talks to the JSON API of a server. The session cookie set by login
+// authenticates every later request.
+type client struct {
+	server string
+	http   *http.Client
+	user   api.UserResponse
+}
+
+func newClient(server string) (*client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cookie jar: %w", err)
+	}
+	return &client{
+		server: strings.TrimRight(server, "/"),
+		http:   &http.Client{Jar: jar},
+	}, nil
+}
+
+// apiError is an error answered by the server.
+type apiError struct {
+	body api.Error
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.body.Message, e.body.Status)
+}
+
+func (c *client) do(ctx context.Context, method, path string, body, response any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.server+"/api/v1"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		var e apiError
+		if err := json.NewDecoder(res.Body).Decode(&e.body); err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, res.Status)
+		}
+		return &e
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+func (c *client) login(ctx context.Context, name, password string) error {
+	return c.do(ctx, http.MethodPost, "/users", api.LoginRequest{Name: name, Password: password}, &c.user)
+}
+
+// logout ends the session, which removes the games it hosts.
+func (c *client) logout(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/users/me", nil, nil)
+}
+
+func (c *client) lobbies(ctx context.Context) ([]api.Lobby, error) {
+	var list api.ListResponse
+	if err := c.do(ctx, http.MethodGet, "/lobbies", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Lobbies, nil
+}
+
+func (c *client) create(ctx context.Context, settings api.GameSettings) (*api.GameResponse, error) {
+	var game api.GameResponse
+	if err := c.do(ctx, http.MethodPost, "/lobbies", settings, &game); err != nil {
+		return nil, err
+	}
+	return &game, nil
+}
+
+func (c *client) join(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/lobbies/"+id+"/join", nil, nil)
+}
+
+func (c *client) leave(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/lobbies/"+id+"/leave", nil, nil)
+}
+
+func (c *client) remove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/lobbies/"+id, nil, nil)
+}
+
+func (c *client) move(ctx context.Context, id string, board, cell int) error {
+	return c.do(ctx, http.MethodPost, "/games/"+id+"/moves", api.Move{Board: board, Cell: cell}, nil)
+}
+
+func (c *client) reset(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/games/"+id+"/reset", nil, nil)
+}
+
+func (c *client) spec(ctx context.Context) error {
+	var spec map[string]any
+	if err := c.do(ctx, http.MethodGet, "/openapi.json", nil, &spec); err != nil {
+		return err
+	}
+	if spec["openapi"] == nil {
+		return errors.New("openapi document has no version")
+	}
+	return nil
+}
+
+// events reads the event stream at path, calling handle with the name and
+// data of every event until handle fails, the stream ends or ctx is done.
+func (c *client) events(ctx context.Context, path string, handle func(event string, data []byte) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+"/api/v1"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var e apiError
+		if err := json.NewDecoder(res.Body).Decode(&e.body); err != nil {
+			return fmt.Errorf("GET %s: %s", path, res.Status)
+		}
+		return &e
+	}
+
+	var event string
+	var data []byte
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event != "" {
+				if err := handle(event, data); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: ")...)
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// watchGame sends every update of a game to updates until the game is
+// deleted or ctx is done, then closes updates.
+func (c *client) watchGame(ctx context.Context, id string, updates chan<- api.GameResponse) error {
+	defer close(updates)
+	return c.events(ctx, "/games/"+id+"/events", func(event string, data []byte) error {
+		switch event {
+		case "deleted":
+			return errGameDeleted
+		case "game":
+			var game api.GameResponse
+			if err := json.Unmarshal(data, &game); err != nil {
+				return err
+			}
+			select {
+			case updates <- game:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+}
+
+var errGameDeleted = errors.New("game was deleted")
@@ -0,0 +1,183 @@
+// Command ttt-cli plays tic-tac-toe in the terminal against a server, using
+// its JSON API. Games update live through the API's event streams.
+//
+// Usage:
+//
+//	ttt-cli [-server url] [-name name] [-password password] <command> [arguments]
+//
+// The commands are:
+//
+//	lobbies [-watch]   list the open lobbies, or keep listing them as they change
+//	create [flags]     create a game and play it
+//	join <id>          take the challenger's seat of a game and play it
+//	watch <id>         spectate a game
+//	smoke              play a whole game between two players and report every step
+//
+// The server, name and password default to $TTT_SERVER, $TTT_NAME (or $USER)
+// and $TTT_PASSWORD. Every run logs in with a new session and logs out when
+// it is done, which removes the games it created.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "ttt-cli: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func env(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("ttt-cli", flag.ContinueOnError)
+	server := flags.String("server", env("TTT_SERVER", "http://localhost:8080"), "server URL")
+	name := flags.String("name", env("TTT_NAME", os.Getenv("USER")), "player name")
+	password := flags.String("password", os.Getenv("TTT_PASSWORD"), "player password, the first login with a name registers it")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: ttt-cli [flags] lobbies [-watch] | create [flags] | join <id> | watch <id> | smoke")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("missing command")
+	}
+	if *password == "" {
+		return errors.New("missing password, set -password or TTT_PASSWORD")
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	if command == "smoke" {
+		return smoke(ctx, *server, *password, os.Stdout)
+	}
+
+	c, err := newClient(*server)
+	if err != nil {
+		return err
+	}
+	if err := c.login(ctx, *name, *password); err != nil {
+		return fmt.Errorf("failed to log in: %w", err)
+	}
+	defer c.logout(context.Background())
+
+	switch command {
+	case "lobbies":
+		return runLobbies(ctx, c, args)
+	case "create":
+		return runCreate(ctx, c, args)
+	case "join":
+		id, err := gameArg(command, args)
+		if err != nil {
+			return err
+		}
+		if err := c.join(ctx, id); err != nil {
+			return fmt.Errorf("failed to join game: %w", err)
+		}
+		return play(ctx, c, id, os.Stdin, os.Stdout)
+	case "watch":
+		id, err := gameArg(command, args)
+		if err != nil {
+			return err
+		}
+		return play(ctx, c, id, os.Stdin, os.Stdout)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func gameArg(command string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: ttt-cli %s <id>", command)
+	}
+	return args[0], nil
+}
+
+func runLobbies(ctx context.Context, c *client, args []string) error {
+	flags := flag.NewFlagSet("lobbies", flag.ContinueOnError)
+	watch := flags.Bool("watch", false, "keep listing the lobbies as they change")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if !*watch {
+		lobbies, err := c.lobbies(ctx)
+		if err != nil {
+			return err
+		}
+		for _, gameLobby := range lobbies {
+			fmt.Println(renderLobby(gameLobby))
+		}
+		return nil
+	}
+
+	err := c.events(ctx, "/lobbies/events", func(event string, data []byte) error {
+		var list api.ListResponse
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		if isTerminal(os.Stdout) {
+			fmt.Print("\033[H\033[2J")
+		} else {
+			fmt.Println()
+		}
+		fmt.Printf("%d lobbies\n", len(list.Lobbies))
+		for _, gameLobby := range list.Lobbies {
+			fmt.Println(renderLobby(gameLobby))
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func runCreate(ctx context.Context, c *client, args []string) error {
+	settings := api.GameSettings{}
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	flags.StringVar(&settings.Mode, "mode", components.ModeClassic, "classic or ultimate")
+	flags.IntVar(&settings.BoardSize, "size", game.DefaultSize, "board size of classic games")
+	flags.IntVar(&settings.WinLength, "win", game.DefaultSize, "marks in a row that win a classic game")
+	flags.StringVar(&settings.Opponent, "bot", "", "play against a bot: easy, medium or perfect")
+	flags.BoolVar(&settings.Private, "private", false, "only players with the invite link can join")
+	flags.IntVar(&settings.BestOf, "best-of", 0, "length of the series")
+	flags.IntVar(&settings.MoveSeconds, "move-seconds", 0, "seconds per move, 0 for none")
+	flags.IntVar(&settings.GameMinutes, "game-minutes", 0, "minutes per player, 0 for none")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	created, err := c.create(ctx, settings)
+	if err != nil {
+		return fmt.Errorf("failed to create game: %w", err)
+	}
+	if created.Lobby.InviteCode != "" {
+		fmt.Printf("Invite link: %s/join/%s\n", c.server, created.Lobby.InviteCode)
+	}
+	return play(ctx, c, created.Lobby.Id, os.Stdin, os.Stdout)
+}
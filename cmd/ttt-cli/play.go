@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const playHelp = "Type a cell (ultimate: board and cell) to move, r to start the next game once this one is over, q to quit."
+
+// play shows a game as it changes and plays the moves typed on in. The board
+// is redrawn whenever the server pushes an update.
+func play(ctx context.Context, c *client, id string, in io.Reader, out io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	updates := make(chan api.GameResponse)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- c.watchGame(ctx, id, updates)
+	}()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			select {
+			case lines <- strings.TrimSpace(scanner.Text()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var current *api.GameResponse
+	var status string
+	draw := func() {
+		if isTerminal(out) {
+			fmt.Fprint(out, "\033[H\033[2J")
+		}
+		if current != nil {
+			renderGame(out, *current)
+		}
+		if status != "" {
+			fmt.Fprintln(out, status)
+		}
+		fmt.Fprintf(out, "%s\n> ", playHelp)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case game, ok := <-updates:
+			if !ok {
+				err := <-watchErr
+				if errors.Is(err, errGameDeleted) {
+					fmt.Fprintln(out, "\nThe game was deleted.")
+					return nil
+				}
+				if err != nil && !errors.Is(err, context.Canceled) {
+					return err
+				}
+				return nil
+			}
+			current, status = &game, ""
+			draw()
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			if line == "" || current == nil {
+				continue
+			}
+
+			var err error
+			switch line {
+			case "q", "quit":
+				if current.Lobby.Seat == components.SeatChallenger {
+					err = c.leave(ctx, id)
+				}
+				return err
+			case "r", "reset":
+				err = c.reset(ctx, id)
+			default:
+				var board, cell int
+				if board, cell, err = parseMove(line, current.State.Mode); err == nil {
+					err = c.move(ctx, id, board, cell)
+				}
+			}
+			// Accepted requests show up as an update of the game.
+			if err != nil {
+				status = err.Error()
+				draw()
+			}
+		}
+	}
+}
+
+// parseMove reads "cell" for classic games and "board cell" for ultimate
+// games.
+func parseMove(line, mode string) (board, cell int, err error) {
+	fields := strings.Fields(line)
+	want := 1
+	if mode == components.ModeUltimate {
+		want = 2
+	}
+	if len(fields) != want {
+		return 0, 0, fmt.Errorf("unknown command %q", line)
+	}
+
+	numbers := make([]int, len(fields))
+	for i, field := range fields {
+		if numbers[i], err = strconv.Atoi(field); err != nil {
+			return 0, 0, fmt.Errorf("unknown command %q", line)
+		}
+	}
+	if want == 2 {
+		return numbers[0], numbers[1], nil
+	}
+	return 0, numbers[0], nil
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const smokeTimeout = 30 * time.Second
+
+// smoke plays a whole game between two players against a deployment and
+// reports every step on out. Both players are logged out again, which also
+// removes the game.
+func smoke(ctx context.Context, server, password string, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, smokeTimeout)
+	defer cancel()
+
+	started := time.Now()
+	step := func(name string, err error) error {
+		if err != nil {
+			fmt.Fprintf(out, "FAIL %-24s %v\n", name, err)
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Fprintf(out, "ok   %-24s %v\n", name, time.Since(started).Round(time.Millisecond))
+		return nil
+	}
+
+	host, err := newClient(server)
+	if err != nil {
+		return err
+	}
+	challenger, err := newClient(server)
+	if err != nil {
+		return err
+	}
+
+	if err := step("openapi", host.spec(ctx)); err != nil {
+		return err
+	}
+	if err := step("login host", host.login(ctx, "smoke-host", password)); err != nil {
+		return err
+	}
+	defer host.logout(context.Background())
+	if err := step("login challenger", challenger.login(ctx, "smoke-challenger", password)); err != nil {
+		return err
+	}
+	defer challenger.logout(context.Background())
+
+	created, err := host.create(ctx, api.GameSettings{
+		Mode:      components.ModeClassic,
+		BoardSize: game.DefaultSize,
+		WinLength: game.DefaultSize,
+	})
+	if err := step("create game", err); err != nil {
+		return err
+	}
+	id := created.Lobby.Id
+
+	updates := make(chan api.GameResponse)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- host.watchGame(ctx, id, updates)
+	}()
+
+	// await waits for the stream to push a game that passes check; last
+	// holds the latest game pushed.
+	var last api.GameResponse
+	await := func(check func(api.GameResponse) bool) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case g, ok := <-updates:
+				if !ok {
+					return fmt.Errorf("game stream ended: %v", <-watchErr)
+				}
+				last = g
+				if check(g) {
+					return nil
+				}
+			}
+		}
+	}
+
+	if err := step("stream game", await(func(api.GameResponse) bool { return true })); err != nil {
+		return err
+	}
+
+	if err := step("join game", challenger.join(ctx, id)); err != nil {
+		return err
+	}
+	if err := step("stream join", await(func(g api.GameResponse) bool {
+		return g.Lobby.Challenger == challenger.user.Name
+	})); err != nil {
+		return err
+	}
+
+	// X takes the top row while O plays the middle one.
+	players := map[string]*client{
+		game.MarkOf(created.State, components.SeatHost):       host,
+		game.MarkOf(created.State, components.SeatChallenger): challenger,
+	}
+	moves := []struct {
+		mark string
+		cell int
+	}{
+		{game.PlayerX, 0}, {game.PlayerO, 3}, {game.PlayerX, 1}, {game.PlayerO, 4}, {game.PlayerX, 2},
+	}
+	for i, move := range moves {
+		name := fmt.Sprintf("move %d (%s %d)", i+1, move.mark, move.cell)
+		if err := step(name, players[move.mark].move(ctx, id, 0, move.cell)); err != nil {
+			return err
+		}
+		if err := step("stream "+name, await(func(g api.GameResponse) bool {
+			return g.State.Moves == i+1
+		})); err != nil {
+			return err
+		}
+	}
+
+	err = nil
+	if winner := last.State.Winner; winner != game.PlayerX {
+		err = fmt.Errorf("winner is %q, want %q", winner, game.PlayerX)
+	}
+	if err := step("winner", err); err != nil {
+		return err
+	}
+
+	return step("delete game", host.remove(ctx, id))
+}
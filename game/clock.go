@@ -0,0 +1,156 @@
+package game
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	// MinMoveTime leaves bots and slow connections enough time to move.
+	MinMoveTime = 5 * time.Second
+	MaxGameTime = time.Hour
+)
+
+var (
+	ErrInvalidClock = errors.New("invalid time control")
+	ErrOutOfTime    = errors.New("out of time")
+	ErrClockRunning = errors.New("player still has time")
+)
+
+// newClock returns the clock for the time controls in settings, or nil if
+// the game is untimed.
+func newClock(settings components.GameSettings) (*components.Clock, error) {
+	moveTime := time.Duration(settings.MoveSeconds) * time.Second
+	gameTime := time.Duration(settings.GameMinutes) * time.Minute
+	if moveTime < 0 || (moveTime > 0 && moveTime < MinMoveTime) || gameTime < 0 || gameTime > MaxGameTime {
+		return nil, ErrInvalidClock
+	}
+	if moveTime == 0 && gameTime == 0 {
+		return nil, nil
+	}
+
+	return &components.Clock{
+		MoveTime:   moveTime,
+		GameTime:   gameTime,
+		RemainingX: gameTime,
+		RemainingO: gameTime,
+	}, nil
+}
+
+func resetClock(clock *components.Clock) *components.Clock {
+	if clock == nil {
+		return nil
+	}
+	return &components.Clock{
+		MoveTime:   clock.MoveTime,
+		GameTime:   clock.GameTime,
+		RemainingX: clock.GameTime,
+		RemainingO: clock.GameTime,
+	}
+}
+
+func remaining(clock *components.Clock, player string) time.Duration {
+	if player == PlayerX {
+		return clock.RemainingX
+	}
+	return clock.RemainingO
+}
+
+// TimeLeft returns how long player has left to move at now. It reports false
+// if the game is untimed.
+func TimeLeft(state components.GameState, player string, now time.Time) (time.Duration, bool) {
+	clock := state.Clock
+	if clock == nil {
+		return 0, false
+	}
+
+	var elapsed time.Duration
+	running := !clock.TurnStartedAt.IsZero() && state.Winner == "" && player == (Engine{}).Next(state)
+	if running {
+		elapsed = now.Sub(clock.TurnStartedAt)
+	}
+
+	left := time.Duration(-1)
+	if clock.GameTime > 0 {
+		left = remaining(clock, player) - elapsed
+	}
+	if clock.MoveTime > 0 && (running || left < 0) {
+		if moveLeft := clock.MoveTime - elapsed; left < 0 || moveLeft < left {
+			left = moveLeft
+		}
+	}
+	return max(left, 0), true
+}
+
+// Deadline returns when the player to move runs out of time. It reports
+// false while no clock is running.
+func Deadline(state components.GameState) (time.Time, bool) {
+	clock := state.Clock
+	if clock == nil || clock.TurnStartedAt.IsZero() || state.Winner != "" {
+		return time.Time{}, false
+	}
+	left, _ := TimeLeft(state, (Engine{}).Next(state), clock.TurnStartedAt)
+	return clock.TurnStartedAt.Add(left), true
+}
+
+// StartClock starts the clock of the player to move at now, if it is not
+// running yet. Games start their clock once both seats are taken, so the
+// first player is not timed while waiting for an opponent, but cannot stall
+// the game once there is one.
+func (Engine) StartClock(state components.GameState, now time.Time) components.GameState {
+	if state.Clock == nil || !state.Clock.TurnStartedAt.IsZero() || state.Winner != "" {
+		return state
+	}
+
+	clock := *state.Clock
+	clock.TurnStartedAt = now
+	state.Clock = &clock
+	return state
+}
+
+// Stamp charges the time spent on the move just played by player and starts
+// the opponent's clock at now. A clock that was not started yet charges
+// nothing for the move.
+func (Engine) Stamp(state components.GameState, player string, now time.Time) components.GameState {
+	if state.Clock == nil {
+		return state
+	}
+
+	clock := *state.Clock
+	if !clock.TurnStartedAt.IsZero() && clock.GameTime > 0 {
+		spent := now.Sub(clock.TurnStartedAt)
+		if player == PlayerX {
+			clock.RemainingX = max(clock.RemainingX-spent, 0)
+		} else {
+			clock.RemainingO = max(clock.RemainingO-spent, 0)
+		}
+	}
+	clock.TurnStartedAt = now
+	if state.Winner != "" {
+		clock.TurnStartedAt = time.Time{}
+	}
+
+	state.Clock = &clock
+	return state
+}
+
+// Forfeit ends the game in favour of the opponent of the player to move if
+// that player ran out of time at now.
+func (e Engine) Forfeit(state components.GameState, now time.Time) (components.GameState, error) {
+	if state.Winner != "" {
+		return state, ErrGameOver
+	}
+	deadline, ok := Deadline(state)
+	if !ok || now.Before(deadline) {
+		return state, ErrClockRunning
+	}
+
+	loser := e.Next(state)
+	state = e.Stamp(state, loser, now)
+	state.Winner = Opponent(loser)
+	state.Forfeit = loser
+	state.Clock.TurnStartedAt = time.Time{}
+	return score(state), nil
+}
@@ -0,0 +1,52 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+func TestStartClock(t *testing.T) {
+	var engine Engine
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	timed, err := engine.NewGame("g1", components.GameSettings{
+		Mode:        components.ModeClassic,
+		BoardSize:   DefaultSize,
+		WinLength:   DefaultSize,
+		MoveSeconds: 30,
+		GameMinutes: 5,
+	})
+	if err != nil {
+		t.Fatalf("NewGame() error = %v", err)
+	}
+	if _, ok := Deadline(timed); ok {
+		t.Fatal("clock of a new game is running")
+	}
+
+	started := engine.StartClock(timed, now)
+	if deadline, ok := Deadline(started); !ok || !deadline.Equal(now.Add(30*time.Second)) {
+		t.Fatalf("Deadline() after StartClock = %v, %v, want %v", deadline, ok, now.Add(30*time.Second))
+	}
+	if !timed.Clock.TurnStartedAt.IsZero() {
+		t.Fatal("StartClock modified the clock it was given")
+	}
+
+	// A running clock keeps its start.
+	again := engine.StartClock(started, now.Add(time.Minute))
+	if !again.Clock.TurnStartedAt.Equal(now) {
+		t.Fatalf("TurnStartedAt = %v after a second start, want %v", again.Clock.TurnStartedAt, now)
+	}
+
+	// The first move is charged from the start of the clock.
+	moved := engine.Stamp(started, PlayerX, now.Add(10*time.Second))
+	if want := 5*time.Minute - 10*time.Second; moved.Clock.RemainingX != want {
+		t.Fatalf("RemainingX = %v after the first move, want %v", moved.Clock.RemainingX, want)
+	}
+
+	untimed := classic(board("...", "...", "..."), true)
+	if got := engine.StartClock(untimed, now); got.Clock != nil {
+		t.Fatalf("StartClock gave an untimed game a clock: %+v", got.Clock)
+	}
+}
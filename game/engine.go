@@ -0,0 +1,231 @@
+package game
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	PlayerX = "X"
+	PlayerO = "O"
+	Tie     = "TIE"
+)
+
+const (
+	MinSize      = 3
+	MaxSize      = 15
+	DefaultSize  = 3
+	MinWinLength = 3
+)
+
+var (
+	ErrInvalidMode      = errors.New("invalid game mode")
+	ErrInvalidSize      = errors.New("invalid board size")
+	ErrInvalidWinLength = errors.New("invalid win length")
+	ErrInvalidBoard     = errors.New("invalid board index")
+	ErrInvalidCell      = errors.New("invalid cell index")
+	ErrCellOccupied     = errors.New("cell already occupied")
+	ErrWrongBoard       = errors.New("move must be played on the active board")
+	ErrNotYourTurn      = errors.New("not your turn")
+	ErrGameOver         = errors.New("game is over")
+)
+
+// Move is a single mark placed on the board by Player ("X" or "O"). Board
+// selects the sub-board in ultimate games and is ignored otherwise.
+type Move struct {
+	Board  int    `json:"board"`
+	Cell   int    `json:"cell"`
+	Player string `json:"player"`
+}
+
+// Engine applies the tic-tac-toe rules to a GameState. It holds no state of
+// its own, so the zero value is ready to use and safe for concurrent use.
+type Engine struct{}
+
+// NewGame returns an empty game for settings. Classic games are played on a
+// BoardSize×BoardSize board won by WinLength marks in a row. MoveSeconds and
+// GameMinutes set the optional time controls and BestOf the series length.
+func (Engine) NewGame(id string, settings components.GameSettings) (components.GameState, error) {
+	var state components.GameState
+	var err error
+	switch settings.Mode {
+	case components.ModeClassic, "":
+		state, err = newClassicGame(id, settings.BoardSize, settings.WinLength)
+	case components.ModeUltimate:
+		state = newUltimateGame(id)
+	default:
+		err = ErrInvalidMode
+	}
+	if err != nil {
+		return components.GameState{}, err
+	}
+
+	if state.Clock, err = newClock(settings); err != nil {
+		return components.GameState{}, err
+	}
+	if state.Series, err = newSeries(settings.BestOf); err != nil {
+		return components.GameState{}, err
+	}
+	return state, nil
+}
+
+func newClassicGame(id string, size, winLength int) (components.GameState, error) {
+	if size < MinSize || size > MaxSize {
+		return components.GameState{}, ErrInvalidSize
+	}
+	if winLength < MinWinLength || winLength > size {
+		return components.GameState{}, ErrInvalidWinLength
+	}
+
+	return components.GameState{
+		Id:        id,
+		Mode:      components.ModeClassic,
+		Board:     make([]string, size*size),
+		Size:      size,
+		WinLength: winLength,
+		XIsNext:   true,
+		Winner:    "",
+	}, nil
+}
+
+// Reset clears the board of an existing game for another round, keeping its
+// id, mode, dimensions and time controls. The seats swap sides, and a decided
+// series starts over.
+func (Engine) Reset(state components.GameState) components.GameState {
+	round, clock := state.Round+1, resetClock(state.Clock)
+	hostIsO, series := !state.HostIsO, nextSeries(state.Series)
+	if state.Mode == components.ModeUltimate {
+		state = newUltimateGame(state.Id)
+	} else {
+		state.Board = make([]string, state.Size*state.Size)
+		state.XIsNext = true
+		state.Winner = ""
+		state.Moves = 0
+		state.Forfeit = ""
+	}
+	state.Round = round
+	state.Clock = clock
+	state.HostIsO = hostIsO
+	state.Series = series
+	return state
+}
+
+// Next returns the player whose turn it is.
+func (Engine) Next(state components.GameState) string {
+	if state.XIsNext {
+		return PlayerX
+	}
+	return PlayerO
+}
+
+// Apply validates move against state and returns the resulting state.
+// The given state is never modified.
+func (e Engine) Apply(state components.GameState, move Move) (components.GameState, error) {
+	if state.Winner != "" {
+		return state, ErrGameOver
+	}
+
+	apply := e.applyClassic
+	if state.Mode == components.ModeUltimate {
+		apply = e.applyUltimate
+	}
+	next, err := apply(state, move)
+	if err != nil {
+		return state, err
+	}
+	return score(next), nil
+}
+
+func (e Engine) applyClassic(state components.GameState, move Move) (components.GameState, error) {
+	if move.Cell < 0 || move.Cell >= len(state.Board) {
+		return state, ErrInvalidCell
+	}
+	if state.Board[move.Cell] != "" {
+		return state, ErrCellOccupied
+	}
+	if move.Player != e.Next(state) {
+		return state, ErrNotYourTurn
+	}
+
+	next := state
+	next.Board = slices.Clone(state.Board)
+	next.Board[move.Cell] = move.Player
+	next.XIsNext = !state.XIsNext
+	next.Winner = Winner(next.Board, next.Size, next.WinLength)
+	next.Moves++
+
+	return next, nil
+}
+
+// Winner returns "X" or "O" if that player has winLength marks in a row,
+// "TIE" if the board is full without a winner and "" while moves are still
+// possible.
+func Winner(board []string, size, winLength int) string {
+	for _, line := range Lines(size, winLength) {
+		first := board[line[0]]
+		if first != PlayerX && first != PlayerO {
+			continue
+		}
+		won := true
+		for _, i := range line[1:] {
+			if board[i] != first {
+				won = false
+				break
+			}
+		}
+		if won {
+			return first
+		}
+	}
+
+	for _, cell := range board {
+		if cell == "" {
+			return ""
+		}
+	}
+
+	return Tie
+}
+
+// LegalMoves returns every move available to the player whose turn it is.
+func (e Engine) LegalMoves(state components.GameState) []Move {
+	if state.Winner != "" {
+		return nil
+	}
+
+	player := e.Next(state)
+	var moves []Move
+	if state.Mode == components.ModeUltimate {
+		for b, subBoard := range state.Ultimate.Boards {
+			if state.Board[b] != "" {
+				continue
+			}
+			if state.Ultimate.ActiveBoard != AnyBoard && state.Ultimate.ActiveBoard != b {
+				continue
+			}
+			for i, cell := range subBoard {
+				if cell == "" {
+					moves = append(moves, Move{Board: b, Cell: i, Player: player})
+				}
+			}
+		}
+		return moves
+	}
+
+	for i, cell := range state.Board {
+		if cell == "" {
+			moves = append(moves, Move{Cell: i, Player: player})
+		}
+	}
+	return moves
+}
+
+// Opponent returns the other player.
+func Opponent(player string) string {
+	if player == PlayerX {
+		return PlayerO
+	}
+	return PlayerX
+}
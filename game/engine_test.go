@@ -0,0 +1,172 @@
+package game
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// board reads a board from rows of "X", "O" and "." for empty cells.
+func board(rows ...string) []string {
+	var cells []string
+	for _, row := range rows {
+		for _, cell := range strings.Split(row, "") {
+			if cell == "." {
+				cell = ""
+			}
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
+
+// classic returns a classic 3×3 game in progress on cells.
+func classic(cells []string, xIsNext bool) components.GameState {
+	moves := 0
+	for _, cell := range cells {
+		if cell != "" {
+			moves++
+		}
+	}
+	return components.GameState{
+		Mode:      components.ModeClassic,
+		Board:     cells,
+		Size:      3,
+		WinLength: 3,
+		XIsNext:   xIsNext,
+		Moves:     moves,
+	}
+}
+
+func TestApply(t *testing.T) {
+	var engine Engine
+
+	won := classic(board("XXX", "OO.", "..."), false)
+	won.Winner = PlayerX
+
+	tests := []struct {
+		name   string
+		state  components.GameState
+		move   Move
+		err    error
+		winner string
+	}{
+		{
+			name:  "first move",
+			state: classic(board("...", "...", "..."), true),
+			move:  Move{Cell: 4, Player: PlayerX},
+		},
+		{
+			name:  "cell occupied",
+			state: classic(board("X..", "...", "..."), false),
+			move:  Move{Cell: 0, Player: PlayerO},
+			err:   ErrCellOccupied,
+		},
+		{
+			name:  "not your turn",
+			state: classic(board("X..", "...", "..."), false),
+			move:  Move{Cell: 1, Player: PlayerX},
+			err:   ErrNotYourTurn,
+		},
+		{
+			name:  "cell below the board",
+			state: classic(board("...", "...", "..."), true),
+			move:  Move{Cell: -1, Player: PlayerX},
+			err:   ErrInvalidCell,
+		},
+		{
+			name:  "cell beyond the board",
+			state: classic(board("...", "...", "..."), true),
+			move:  Move{Cell: 9, Player: PlayerX},
+			err:   ErrInvalidCell,
+		},
+		{
+			name:  "game over",
+			state: won,
+			move:  Move{Cell: 5, Player: PlayerO},
+			err:   ErrGameOver,
+		},
+		{
+			name:   "win",
+			state:  classic(board("XX.", "OO.", "..."), true),
+			move:   Move{Cell: 2, Player: PlayerX},
+			winner: PlayerX,
+		},
+		{
+			name:   "tie",
+			state:  classic(board("XOX", "XOO", "OX."), true),
+			move:   Move{Cell: 8, Player: PlayerX},
+			winner: Tie,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := slices.Clone(tt.state.Board)
+
+			next, err := engine.Apply(tt.state, tt.move)
+			if !slices.Equal(tt.state.Board, before) {
+				t.Fatalf("Apply modified the board it was given: %q", tt.state.Board)
+			}
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Apply() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+
+			if got := next.Board[tt.move.Cell]; got != tt.move.Player {
+				t.Errorf("cell %d = %q, want %q", tt.move.Cell, got, tt.move.Player)
+			}
+			if next.Moves != tt.state.Moves+1 {
+				t.Errorf("Moves = %d, want %d", next.Moves, tt.state.Moves+1)
+			}
+			if next.XIsNext == tt.state.XIsNext {
+				t.Errorf("XIsNext = %v after the move, want it to change", next.XIsNext)
+			}
+			if next.Winner != tt.winner {
+				t.Errorf("Winner = %q, want %q", next.Winner, tt.winner)
+			}
+		})
+	}
+}
+
+func TestWinner(t *testing.T) {
+	tests := []struct {
+		name      string
+		board     []string
+		size      int
+		winLength int
+		want      string
+	}{
+		{"empty", board("...", "...", "..."), 3, 3, ""},
+		{"in progress", board("XO.", ".X.", "..O"), 3, 3, ""},
+		{"top row", board("XXX", "OO.", "..."), 3, 3, PlayerX},
+		{"middle row", board("X.X", "OOO", "X.."), 3, 3, PlayerO},
+		{"bottom row", board("OO.", "...", "XXX"), 3, 3, PlayerX},
+		{"left column", board("OX.", "OX.", "O.X"), 3, 3, PlayerO},
+		{"middle column", board("OX.", ".X.", "OX."), 3, 3, PlayerX},
+		{"right column", board("X.O", "X.O", ".XO"), 3, 3, PlayerO},
+		{"diagonal", board("XO.", "OX.", "..X"), 3, 3, PlayerX},
+		{"anti-diagonal", board("XXO", "XO.", "O.."), 3, 3, PlayerO},
+		{"tie", board("XOX", "XOO", "OXX"), 3, 3, Tie},
+		{"row inside a larger board", board(".....", ".XXXX", "OOO..", ".....", "O...."), 5, 4, PlayerX},
+		{"diagonal off the corner", board("....", "O...", ".O.X", "X.OX"), 4, 3, PlayerO},
+		{"anti-diagonal off the corner", board("..X.", ".X..", "X.OO", "...O"), 4, 3, PlayerX},
+		{"run shorter than the win length", board("XXX.", "OOO.", "....", "...."), 4, 4, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Winner(tt.board, tt.size, tt.winLength); got != tt.want {
+				t.Errorf("Winner() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package game
+
+import "sync"
+
+type linesKey struct {
+	size, winLength int
+}
+
+var linesCache sync.Map // linesKey -> [][]int
+
+// Lines returns every run of winLength cell indexes on a size×size board:
+// rows, columns and both diagonals. The result is cached and must not be
+// modified.
+func Lines(size, winLength int) [][]int {
+	key := linesKey{size, winLength}
+	if lines, ok := linesCache.Load(key); ok {
+		return lines.([][]int)
+	}
+
+	directions := [][2]int{
+		{0, 1},  // Row
+		{1, 0},  // Column
+		{1, 1},  // Top-left to bottom-right diagonal
+		{1, -1}, // Top-right to bottom-left diagonal
+	}
+
+	var lines [][]int
+	for row := 0; row < size; row++ {
+		for col := 0; col < size; col++ {
+			for _, d := range directions {
+				endRow := row + d[0]*(winLength-1)
+				endCol := col + d[1]*(winLength-1)
+				if endRow < 0 || endRow >= size || endCol < 0 || endCol >= size {
+					continue
+				}
+				line := make([]int, winLength)
+				for i := range line {
+					line[i] = (row+d[0]*i)*size + col + d[1]*i
+				}
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	actual, _ := linesCache.LoadOrStore(key, lines)
+	return actual.([][]int)
+}
@@ -0,0 +1,79 @@
+package game
+
+import (
+	"errors"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const MaxBestOf = 9
+
+var ErrInvalidSeries = errors.New("invalid series length")
+
+func newSeries(bestOf int) (*components.Series, error) {
+	if bestOf == 0 {
+		bestOf = 1
+	}
+	if bestOf < 1 || bestOf > MaxBestOf || bestOf%2 == 0 {
+		return nil, ErrInvalidSeries
+	}
+	return &components.Series{BestOf: bestOf}, nil
+}
+
+// MarkOf returns the mark played by the host or the challenger in state.
+func MarkOf(state components.GameState, seat string) string {
+	hostMark := PlayerX
+	if state.HostIsO {
+		hostMark = PlayerO
+	}
+	if seat == components.SeatHost {
+		return hostMark
+	}
+	return Opponent(hostMark)
+}
+
+// SeatOf returns the seat playing player in state.
+func SeatOf(state components.GameState, player string) string {
+	if MarkOf(state, components.SeatHost) == player {
+		return components.SeatHost
+	}
+	return components.SeatChallenger
+}
+
+// score adds the result of a finished game to its series. The series is won
+// by the first seat to win more than half of its games.
+func score(state components.GameState) components.GameState {
+	if state.Series == nil || state.Winner == "" {
+		return state
+	}
+
+	series := *state.Series
+	switch {
+	case state.Winner == Tie:
+		series.Draws++
+	case SeatOf(state, state.Winner) == components.SeatHost:
+		series.HostWins++
+	default:
+		series.ChallengerWins++
+	}
+
+	needed := series.BestOf/2 + 1
+	switch {
+	case series.HostWins >= needed:
+		series.Winner = components.SeatHost
+	case series.ChallengerWins >= needed:
+		series.Winner = components.SeatChallenger
+	}
+
+	state.Series = &series
+	return state
+}
+
+// nextSeries returns the series for the game after state: the same series,
+// or a new one once it has been decided.
+func nextSeries(series *components.Series) *components.Series {
+	if series == nil || series.Winner == "" {
+		return series
+	}
+	return &components.Series{BestOf: series.BestOf}
+}
@@ -0,0 +1,80 @@
+package game
+
+import (
+	"slices"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// AnyBoard is the UltimateState.ActiveBoard value that lets the next player
+// choose any undecided sub-board.
+const AnyBoard = -1
+
+func newUltimateGame(id string) components.GameState {
+	boards := make([][]string, DefaultSize*DefaultSize)
+	for i := range boards {
+		boards[i] = make([]string, DefaultSize*DefaultSize)
+	}
+
+	return components.GameState{
+		Id:        id,
+		Mode:      components.ModeUltimate,
+		Board:     make([]string, DefaultSize*DefaultSize),
+		Size:      DefaultSize,
+		WinLength: DefaultSize,
+		XIsNext:   true,
+		Winner:    "",
+		Ultimate: &components.UltimateState{
+			Boards:      boards,
+			ActiveBoard: AnyBoard,
+		},
+	}
+}
+
+// applyUltimate plays move on one of the nine sub-boards. Winning a sub-board
+// claims the matching cell of the outer board, and the cell played decides
+// which sub-board the opponent must play next.
+func (e Engine) applyUltimate(state components.GameState, move Move) (components.GameState, error) {
+	ultimate := state.Ultimate
+	if move.Board < 0 || move.Board >= len(ultimate.Boards) {
+		return state, ErrInvalidBoard
+	}
+	if state.Board[move.Board] != "" {
+		return state, ErrWrongBoard
+	}
+	if ultimate.ActiveBoard != AnyBoard && ultimate.ActiveBoard != move.Board {
+		return state, ErrWrongBoard
+	}
+	subBoard := ultimate.Boards[move.Board]
+	if move.Cell < 0 || move.Cell >= len(subBoard) {
+		return state, ErrInvalidCell
+	}
+	if subBoard[move.Cell] != "" {
+		return state, ErrCellOccupied
+	}
+	if move.Player != e.Next(state) {
+		return state, ErrNotYourTurn
+	}
+
+	boards := slices.Clone(ultimate.Boards)
+	boards[move.Board] = slices.Clone(subBoard)
+	boards[move.Board][move.Cell] = move.Player
+
+	next := state
+	next.Board = slices.Clone(state.Board)
+	next.Board[move.Board] = Winner(boards[move.Board], DefaultSize, DefaultSize)
+	next.XIsNext = !state.XIsNext
+	next.Winner = Winner(next.Board, next.Size, next.WinLength)
+	next.Moves++
+
+	activeBoard := move.Cell
+	if next.Board[activeBoard] != "" {
+		activeBoard = AnyBoard
+	}
+	next.Ultimate = &components.UltimateState{
+		Boards:      boards,
+		ActiveBoard: activeBoard,
+	}
+
+	return next, nil
+}
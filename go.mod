@@ -7,12 +7,17 @@ require golang.org/x/sync v0.10.0
 require (
 	github.com/a-h/templ v0.3.819
 	github.com/benbjohnson/hashfs v0.2.2
+	github.com/coder/websocket v1.8.12
 	github.com/delaneyj/toolbelt v0.3.16
 	github.com/go-chi/chi/v5 v5.2.0
+	github.com/goombaio/namegenerator v0.0.0-20181006234301-989e774b106e
 	github.com/gorilla/sessions v1.4.0
 	github.com/nats-io/nats-server/v2 v2.10.24
 	github.com/nats-io/nats.go v1.38.0
 	github.com/starfederation/datastar v1.0.0-beta.7
+	golang.org/x/crypto v0.32.0
+	golang.org/x/time v0.9.0
+	zombiezen.com/go/sqlite v1.4.0
 )
 
 require (
@@ -26,7 +31,6 @@ require (
 	github.com/go-rod/rod v0.116.2 // indirect
 	github.com/goccy/go-json v0.10.4 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/goombaio/namegenerator v0.0.0-20181006234301-989e774b106e // indirect
 	github.com/gorilla/securecookie v1.1.2 // indirect
 	github.com/iancoleman/strcase v0.3.0 // indirect
 	github.com/igrmk/treemap/v2 v2.0.1 // indirect
@@ -49,15 +53,12 @@ require (
 	github.com/ysmood/gson v0.7.3 // indirect
 	github.com/ysmood/leakless v0.9.0 // indirect
 	github.com/zeebo/xxh3 v1.0.2 // indirect
-	golang.org/x/crypto v0.32.0 // indirect
 	golang.org/x/exp v0.0.0-20250106191152-7588d65b2ba8 // indirect
 	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
-	golang.org/x/time v0.9.0 // indirect
 	google.golang.org/protobuf v1.36.2 // indirect
 	modernc.org/libc v1.61.7 // indirect
 	modernc.org/mathutil v1.7.1 // indirect
 	modernc.org/memory v1.8.1 // indirect
 	modernc.org/sqlite v1.34.4 // indirect
-	zombiezen.com/go/sqlite v1.4.0 // indirect
 )
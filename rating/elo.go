@@ -0,0 +1,32 @@
+package rating
+
+import "math"
+
+const (
+	// Initial is the rating given to a new player.
+	Initial = 1200
+	// K is how far a single game can move a rating.
+	K = 32
+)
+
+// Score is the result of a game from one player's point of view.
+type Score float64
+
+const (
+	Loss Score = 0
+	Draw Score = 0.5
+	Win  Score = 1
+)
+
+// Expected returns the score a player rated a is expected to take from a
+// player rated b.
+func Expected(a, b int) float64 {
+	return 1 / (1 + math.Pow(10, float64(b-a)/400))
+}
+
+// Elo returns the new ratings of two players after a game in which the first
+// took score.
+func Elo(a, b int, score Score) (int, int) {
+	delta := int(math.Round(K * (float64(score) - Expected(a, b))))
+	return a + delta, b - delta
+}
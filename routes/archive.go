@@ -0,0 +1,197 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/archive"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const defaultArchivePath = "data/archive.db"
+
+// startArchiver writes every finished game to the archive. Finished boards
+// are picked up from the gameBoards bucket, so games that ended while the
+// server was down are archived from the watcher's initial values, as long as
+// they have not expired yet.
+func startArchiver(ctx context.Context, js jetstream.JetStream, repos *store.Repos, games *archive.Archive) error {
+	moves := newMoves(js, repos)
+
+	watcher, err := repos.Boards.WatchAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start archive watcher: %w", err)
+	}
+
+	var archiving sync.Map // game id and round -> struct{}
+
+	archiveGame := func(gameState components.GameState) {
+		key := fmt.Sprintf("%s.%d", gameState.Id, gameState.Round)
+		if _, busy := archiving.LoadOrStore(key, struct{}{}); busy {
+			return
+		}
+
+		go func() {
+			defer archiving.Delete(key)
+
+			if archived, err := games.Has(ctx, gameState.Id, gameState.Round); err != nil || archived {
+				if err != nil {
+					log.Printf("Failed to check archive for game %s: %v", gameState.Id, err)
+				}
+				return
+			}
+
+			record, err := archivedGame(ctx, repos, moves, gameState)
+			if err != nil {
+				log.Printf("Failed to prepare game %s for the archive: %v", gameState.Id, err)
+				return
+			}
+
+			if err := games.Record(ctx, *record); err != nil {
+				log.Printf("Failed to archive game %s: %v", gameState.Id, err)
+				return
+			}
+			log.Printf("Archived round %d of game %s", gameState.Round, gameState.Id)
+		}()
+	}
+
+	go func() {
+		defer watcher.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					log.Println("Archive watcher updates channel closed")
+					return
+				}
+				if entry == nil || entry.Op != store.OpPut || entry.Value.Winner == "" {
+					continue
+				}
+
+				archiveGame(entry.Value)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// archivedGame collects the players and moves of a finished game. The game is
+// archived from its board and move history, so a lobby that was removed as
+// the game ended only costs the archive the name of the game; the players
+// are known from the moves they made.
+func archivedGame(ctx context.Context, repos *store.Repos, moves *moves, gameState components.GameState) (*archive.Game, error) {
+	history, err := moves.history(ctx, gameState.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Boards are projected from the history, which holds the moves and
+	// events of every round that made it onto the board.
+	var records []components.MoveRecord
+	var forfeit *components.MoveRecord
+	sessions := map[string]string{} // mark -> session id
+	for i, record := range history {
+		if record.Round != gameState.Round || record.Sequence > gameState.Moves {
+			continue
+		}
+		switch record.Event {
+		case "":
+			records = append(records, record)
+		case components.EventForfeit:
+			forfeit = &history[i]
+		default:
+			continue
+		}
+		if record.SessionId != "" {
+			sessions[record.Player] = record.SessionId
+		}
+	}
+
+	// The lobby names the players who made no move, as long as they are
+	// still seated; the challenger may have left since.
+	hostMark := game.MarkOf(gameState, components.SeatHost)
+	challengerMark := game.MarkOf(gameState, components.SeatChallenger)
+	name := ""
+	if gameLobby, _, err := repos.Lobbies.Get(ctx, gameState.Id); err == nil {
+		name = gameLobby.Name
+		if sessions[hostMark] == "" {
+			sessions[hostMark] = gameLobby.HostId
+		}
+		if sessions[challengerMark] == "" {
+			sessions[challengerMark] = gameLobby.ChallengerId
+		}
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+
+	record := &archive.Game{
+		Id:         gameState.Id,
+		Round:      gameState.Round,
+		Name:       name,
+		Mode:       gameState.Mode,
+		Size:       gameState.Size,
+		WinLength:  gameState.WinLength,
+		Host:       archivedSeat(ctx, repos, sessions[hostMark], hostMark),
+		Challenger: archivedSeat(ctx, repos, sessions[challengerMark], challengerMark),
+		Winner:     gameState.Winner,
+		Forfeit:    gameState.Forfeit,
+	}
+
+	switch gameState.Winner {
+	case game.Tie:
+		record.Result = archive.ResultDraw
+	case record.Host.Mark:
+		record.Result = archive.ResultHost
+	default:
+		record.Result = archive.ResultChallenger
+	}
+
+	for _, move := range records {
+		record.Moves = append(record.Moves, archive.Move{
+			Sequence:  move.Sequence,
+			SessionId: move.SessionId,
+			Player:    move.Player,
+			Board:     move.Board,
+			Cell:      move.Cell,
+			PlayedAt:  move.Timestamp,
+		})
+	}
+
+	// Games end with their last move, except for forfeits, which end when
+	// the clock ran out.
+	switch {
+	case forfeit != nil:
+		record.EndedAt = forfeit.Timestamp
+	case len(records) > 0:
+		record.EndedAt = records[len(records)-1].Timestamp
+	default:
+		record.EndedAt = time.Now().UTC()
+	}
+	record.StartedAt = record.EndedAt
+	if len(records) > 0 {
+		record.StartedAt = records[0].Timestamp
+	}
+
+	return record, nil
+}
+
+// archivedSeat describes the player behind sessionId. Users expire with their
+// session, so a seat of a long gone user is archived without a name.
+func archivedSeat(ctx context.Context, repos *store.Repos, sessionId, mark string) archive.Seat {
+	seat := archive.Seat{SessionId: sessionId, Mark: mark}
+	if user, _, err := repos.Users.Get(ctx, sessionId); err == nil {
+		seat.Name = user.Name
+		seat.PlayerId = user.PlayerId
+	}
+	return seat
+}
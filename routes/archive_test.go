@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/archive"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+)
+
+// TestArchiveForfeitWithoutLobby archives a game lost on time whose lobby
+// was removed right as it ended.
+func TestArchiveForfeitWithoutLobby(t *testing.T) {
+	ctx := context.Background()
+
+	ns := startNATS(t)
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %v", err)
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("failed to create jetstream client: %v", err)
+	}
+	if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: moveStream, Subjects: []string{"ttt.game.>"}}); err != nil {
+		t.Fatalf("failed to create move stream: %v", err)
+	}
+
+	service := newGameService(js, store.NewMemory(), admins{})
+	host := mustLogin(t, service, "alice")
+	challenger := mustLogin(t, service, "bob")
+
+	settings := defaultGameSettings()
+	settings.MoveSeconds = 30
+	gameLobby, err := service.create(ctx, host, settings)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	id := gameLobby.Id
+	if err := service.join(ctx, challenger, id); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+
+	// projectAll folds the history into the board like the projector.
+	projectAll := func() {
+		t.Helper()
+		history, err := service.moves.history(ctx, id)
+		if err != nil {
+			t.Fatalf("history() error = %v", err)
+		}
+		for _, record := range history {
+			if err := service.moves.project(ctx, record); err != nil {
+				t.Fatalf("project() error = %v", err)
+			}
+		}
+	}
+
+	if err := service.move(ctx, host, id, 0, 4); err != nil {
+		t.Fatalf("move() error = %v", err)
+	}
+	projectAll()
+	late := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if err := service.moves.forfeit(ctx, id, late); err != nil {
+		t.Fatalf("forfeit() error = %v", err)
+	}
+	projectAll()
+
+	gameState, _, err := service.repos.Boards.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("failed to get board: %v", err)
+	}
+	if err := service.repos.Lobbies.Purge(ctx, id); err != nil {
+		t.Fatalf("failed to remove lobby: %v", err)
+	}
+
+	record, err := archivedGame(ctx, service.repos, service.moves, *gameState)
+	if err != nil {
+		t.Fatalf("archivedGame() error = %v", err)
+	}
+	if !record.EndedAt.Equal(late) {
+		t.Fatalf("EndedAt = %v, want the forfeit at %v", record.EndedAt, late)
+	}
+	if record.Host.SessionId != host || record.Host.Name != "alice" {
+		t.Fatalf("host = %+v, want alice", record.Host)
+	}
+	// The challenger never moved, the forfeit names them.
+	if record.Challenger.SessionId != challenger || record.Challenger.Name != "bob" {
+		t.Fatalf("challenger = %+v, want bob", record.Challenger)
+	}
+	if record.Result != archive.ResultHost || record.Forfeit != game.PlayerO || len(record.Moves) != 1 {
+		t.Fatalf("archived game = %+v, want the host winning on time after 1 move", record)
+	}
+}
@@ -0,0 +1,99 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/bot"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	botThinkingDelay = 500 * time.Millisecond
+	botSearchTimeout = 2 * time.Second
+)
+
+// startBots watches every game board and plays for any bot seated in the
+// game whenever it is the bot's turn. Moves go through moves.play, exactly
+// like a human clicking a cell.
+func startBots(ctx context.Context, js jetstream.JetStream, repos *store.Repos) error {
+	moves := newMoves(js, repos)
+
+	watcher, err := repos.Boards.WatchAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start bot watcher: %w", err)
+	}
+
+	var engine game.Engine
+	var thinking sync.Map // game id -> struct{}
+
+	takeTurn := func(gameState components.GameState) {
+		gameLobby, _, err := repos.Lobbies.Get(ctx, gameState.Id)
+		if err != nil {
+			return
+		}
+
+		difficulty, ok := bot.FromId(gameLobby.ChallengerId)
+		if !ok || playerFor(gameLobby, &gameState, gameLobby.ChallengerId) != engine.Next(gameState) {
+			return
+		}
+
+		if _, busy := thinking.LoadOrStore(gameState.Id, struct{}{}); busy {
+			return
+		}
+
+		go func() {
+			defer thinking.Delete(gameState.Id)
+
+			time.Sleep(botThinkingDelay)
+
+			searchCtx, cancel := context.WithTimeout(ctx, botSearchTimeout)
+			defer cancel()
+
+			move, err := bot.ChooseMove(searchCtx, gameState, difficulty)
+			if err != nil {
+				log.Printf("Bot failed to choose a move for game %s: %v", gameState.Id, err)
+				return
+			}
+
+			// Every replica runs the bots; the revision check lets only one
+			// of them move.
+			err = moves.play(ctx, gameState.Id, gameLobby.ChallengerId, move.Board, move.Cell)
+			if err != nil && !errors.Is(err, store.ErrConflict) {
+				log.Printf("Bot failed to play in game %s: %v", gameState.Id, err)
+			}
+		}()
+	}
+
+	go func() {
+		defer watcher.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					log.Println("Bot watcher updates channel closed")
+					return
+				}
+				if entry == nil || entry.Op != store.OpPut {
+					continue
+				}
+
+				if entry.Value.Winner == "" {
+					takeTurn(entry.Value)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
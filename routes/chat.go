@@ -0,0 +1,271 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	chatStream = "gameChat"
+	// chatHistory is the number of messages kept for every game, which are
+	// replayed to whoever opens it.
+	chatHistory   = 50
+	maxChatLength = 280
+)
+
+var (
+	errChatEmpty   = errors.New("chat message is empty")
+	errChatTooLong = errors.New("chat message is too long")
+	errNotInGame   = errors.New("only players and spectators can chat")
+)
+
+// defaultBlockedWords are masked by the default chat filter.
+var defaultBlockedWords = []string{
+	"ass", "asshole", "bastard", "bitch", "bollocks", "crap", "cunt", "damn",
+	"dick", "fuck", "fucker", "fucking", "motherfucker", "piss", "prick",
+	"shit", "slut", "twat", "wanker", "whore",
+}
+
+// chatSubject is the subject the chat messages of a game are published on.
+func chatSubject(gameId string) string {
+	return fmt.Sprintf("ttt.game.%s.chat", gameId)
+}
+
+// chatFilter checks a message before it is published. It returns the text
+// to publish, or an error to reject the message.
+type chatFilter func(ctx context.Context, message components.ChatMessage) (string, error)
+
+// maskWords returns a chat filter that replaces the blocked words with
+// asterisks, ignoring case.
+func maskWords(blocked ...string) chatFilter {
+	quoted := make([]string, len(blocked))
+	for i, word := range blocked {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	pattern := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+
+	return func(ctx context.Context, message components.ChatMessage) (string, error) {
+		return pattern.ReplaceAllStringFunc(message.Text, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		}), nil
+	}
+}
+
+// chat publishes the chat messages of games to the gameChat stream, which
+// keeps the recent ones of every game.
+type chat struct {
+	js     jetstream.JetStream
+	repos  *store.Repos
+	filter chatFilter
+}
+
+func newChat(js jetstream.JetStream, repos *store.Repos, filter chatFilter) *chat {
+	return &chat{
+		js:     js,
+		repos:  repos,
+		filter: filter,
+	}
+}
+
+// send publishes text to the chat of gameId on behalf of sessionId, who must
+// play in the game or be watching it.
+func (c *chat) send(ctx context.Context, gameId, sessionId, text string) error {
+	text, err := cleanChatText(text)
+	if err != nil {
+		return err
+	}
+
+	gameLobby, _, err := c.repos.Lobbies.Get(ctx, gameId)
+	if err != nil {
+		return err
+	}
+
+	seat := seatOf(gameLobby, sessionId)
+	if seat == "" {
+		// Spectators are registered while they watch the game.
+		if _, _, err := c.repos.Spectators.Get(ctx, gameId+"."+sessionId); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				return errNotInGame
+			}
+			return err
+		}
+	}
+
+	user, _, err := c.repos.Users.Get(ctx, sessionId)
+	if err != nil {
+		return err
+	}
+
+	message := components.ChatMessage{
+		GameId:    gameId,
+		Name:      user.Name,
+		Seat:      seat,
+		Text:      text,
+		Timestamp: time.Now().UTC(),
+	}
+	return publishChat(ctx, c.js, chatSubject(gameId), message, c.filter)
+}
+
+// cleanChatText trims text and checks that it makes a chat message.
+func cleanChatText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errChatEmpty
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		return "", errChatTooLong
+	}
+	return text, nil
+}
+
+// publishChat runs message through filter and publishes it on subject.
+func publishChat(ctx context.Context, js jetstream.JetStream, subject string, message components.ChatMessage, filter chatFilter) error {
+	if filter != nil {
+		text, err := filter(ctx, message)
+		if err != nil {
+			return err
+		}
+		message.Text = text
+	}
+
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	if _, err := js.Publish(ctx, subject, bytes); err != nil {
+		return fmt.Errorf("failed to publish chat message: %w", err)
+	}
+	return nil
+}
+
+// decodeChat reads a chat message from msg, numbered by its stream
+// sequence.
+func decodeChat(msg jetstream.Msg) (components.ChatMessage, error) {
+	var message components.ChatMessage
+	if err := json.Unmarshal(msg.Data(), &message); err != nil {
+		return message, fmt.Errorf("failed to unmarshal chat message: %w", err)
+	}
+	metadata, err := msg.Metadata()
+	if err != nil {
+		return message, fmt.Errorf("failed to get chat message metadata: %w", err)
+	}
+	message.Sequence = metadata.Sequence.Stream
+	return message, nil
+}
+
+// watch passes the recent chat history of gameId to history, then every new
+// message to message until ctx is done.
+func (c *chat) watch(ctx context.Context, gameId string, history func([]components.ChatMessage) error, message func(components.ChatMessage) error) error {
+	return followStream(ctx, c.js, chatStream, chatSubject(gameId),
+		func(msgs []jetstream.Msg) error {
+			messages := make([]components.ChatMessage, 0, len(msgs))
+			for _, msg := range msgs {
+				chatMessage, err := decodeChat(msg)
+				if err != nil {
+					return err
+				}
+				messages = append(messages, chatMessage)
+			}
+			return history(messages)
+		},
+		func(msg jetstream.Msg) error {
+			chatMessage, err := decodeChat(msg)
+			if err != nil {
+				return err
+			}
+			return message(chatMessage)
+		},
+	)
+}
+
+// followStream passes the messages stored on subject when it starts to
+// replay at once, then every later message to live until ctx is done.
+func followStream(ctx context.Context, js jetstream.JetStream, stream, subject string, replay func([]jetstream.Msg) error, live func(jetstream.Msg) error) error {
+	consumer, err := js.OrderedConsumer(ctx, stream, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{subject},
+		DeliverPolicy:  jetstream.DeliverAllPolicy,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create %s consumer: %w", stream, err)
+	}
+
+	info, err := consumer.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get %s consumer info: %w", stream, err)
+	}
+
+	messages, err := consumer.Messages()
+	if err != nil {
+		return fmt.Errorf("failed to start %s consumer: %w", stream, err)
+	}
+	defer messages.Stop()
+
+	go func() {
+		<-ctx.Done()
+		messages.Stop()
+	}()
+
+	var stored []jetstream.Msg
+	historicalMode := info.NumPending > 0
+	if !historicalMode {
+		if err := replay(nil); err != nil {
+			return err
+		}
+	}
+
+	for {
+		msg, err := messages.Next()
+		if err != nil {
+			if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to read %s: %w", stream, err)
+		}
+
+		if !historicalMode {
+			if err := live(msg); err != nil {
+				return err
+			}
+			continue
+		}
+
+		stored = append(stored, msg)
+		metadata, err := msg.Metadata()
+		if err != nil {
+			return fmt.Errorf("failed to get %s message metadata: %w", stream, err)
+		}
+		if metadata.NumPending == 0 {
+			historicalMode = false
+			if err := replay(stored); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// chatErrorMessage returns a user facing message for rejected chat
+// messages.
+func chatErrorMessage(err error) (string, bool) {
+	switch {
+	case errors.Is(err, errChatEmpty):
+		return "Type a message first", true
+	case errors.Is(err, errChatTooLong):
+		return fmt.Sprintf("Messages are limited to %d characters", maxChatLength), true
+	case errors.Is(err, errNotInGame):
+		return "Only players and spectators can chat", true
+	case errors.Is(err, errChatRateLimited):
+		return "You are sending messages too fast", true
+	default:
+		return "", false
+	}
+}
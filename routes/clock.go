@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	clockInterval = time.Second
+	// forfeitGrace is how long the clocks wait past a deadline before they
+	// publish a forfeit, so a move made just in time is published first.
+	forfeitGrace = time.Second
+)
+
+// clockView returns what the players see of the clock of gameState, or nil
+// if the game is untimed.
+func clockView(gameState *components.GameState, now time.Time) *components.ClockView {
+	var engine game.Engine
+
+	x, ok := game.TimeLeft(*gameState, game.PlayerX, now)
+	if !ok {
+		return nil
+	}
+	o, _ := game.TimeLeft(*gameState, game.PlayerO, now)
+	_, running := game.Deadline(*gameState)
+
+	return &components.ClockView{
+		X:       x,
+		O:       o,
+		Next:    engine.Next(*gameState),
+		Running: running,
+	}
+}
+
+// startClocks publishes forfeits for games whose player to move ran out of
+// time. Deadlines are derived from the game boards themselves, so after a
+// restart the watcher's initial values rebuild every pending deadline.
+func startClocks(ctx context.Context, js jetstream.JetStream, repos *store.Repos) error {
+	moves := newMoves(js, repos)
+
+	watcher, err := repos.Boards.WatchAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start clock watcher: %w", err)
+	}
+
+	deadlines := map[string]time.Time{}
+
+	expire := func(now time.Time) {
+		for gameId, deadline := range deadlines {
+			if now.Before(deadline.Add(forfeitGrace)) {
+				continue
+			}
+			delete(deadlines, gameId)
+
+			// The board may have moved on since the deadline was read, or
+			// another replica published the forfeit first; the engine
+			// re-checks the clock and the stream drops the duplicate.
+			err := moves.forfeit(ctx, gameId, now)
+			switch {
+			case err == nil:
+			case errors.Is(err, game.ErrClockRunning), errors.Is(err, game.ErrGameOver),
+				errors.Is(err, store.ErrNotFound), errors.Is(err, store.ErrConflict):
+			default:
+				log.Printf("Failed to forfeit game %s: %v", gameId, err)
+			}
+		}
+	}
+
+	go func() {
+		defer watcher.Stop()
+
+		ticker := time.NewTicker(clockInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				expire(now)
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					log.Println("Clock watcher updates channel closed")
+					return
+				}
+				if entry == nil {
+					continue
+				}
+
+				if entry.Op != store.OpPut {
+					delete(deadlines, entry.Key)
+					continue
+				}
+
+				if deadline, ok := game.Deadline(entry.Value); ok {
+					deadlines[entry.Key] = deadline
+				} else {
+					delete(deadlines, entry.Key)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -2,44 +2,131 @@ package routes
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/delaneyj/toolbelt"
 	"github.com/go-chi/chi/v5"
 	"github.com/goombaio/namegenerator"
 	"github.com/gorilla/sessions"
-	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
 	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
 	"github.com/rphumulock/datastar_nats_tictactoe/web/pages"
 
 	datastar "github.com/starfederation/datastar/sdk/go"
 )
 
-func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.JetStream) error {
-	ctx := context.Background()
+func generateGameDetails() (string, string) {
+	id := toolbelt.NextEncodedID()
+	seed := time.Now().UTC().UnixNano()
+	nameGenerator := namegenerator.NewNameGenerator(seed)
+	name := strings.ToUpper(nameGenerator.Generate())
+	return id, name
+}
+
+func createGameLobby(name, sessionId string, gameState components.GameState, private bool) components.GameLobby {
+	return components.GameLobby{
+		Id:           gameState.Id,
+		Name:         name,
+		HostId:       sessionId,
+		ChallengerId: "",
+		Mode:         gameState.Mode,
+		Size:         gameState.Size,
+		WinLength:    gameState.WinLength,
+		Private:      private,
+		BestOf:       gameState.Series.BestOf,
+	}
+}
+
+// storeGame writes a new game. The host's index is written first and the
+// lobby last, so every game can be found from its host and every listed lobby
+// has a board. Whatever was written is removed again if a later write fails.
+// Games that start with both seats taken start their clock right away.
+func storeGame(ctx context.Context, repos *store.Repos, gameLobby components.GameLobby, gameState components.GameState) error {
+	var engine game.Engine
+
+	if gameLobby.ChallengerId != "" {
+		gameState = engine.StartClock(gameState, time.Now().UTC())
+	}
+
+	if _, err := store.Modify(ctx, repos.Users, gameLobby.HostId, func(user *components.User) error {
+		user.HostedGames = append(user.HostedGames, gameLobby.Id)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to add game to host: %w", err)
+	}
+
+	if _, err := repos.Boards.Create(ctx, gameLobby.Id, gameState); err != nil {
+		unhostGame(ctx, repos, gameLobby.HostId, gameLobby.Id)
+		return fmt.Errorf("failed to store game state: %w", err)
+	}
+
+	if _, err := repos.Lobbies.Create(ctx, gameLobby.Id, gameLobby); err != nil {
+		repos.Boards.Purge(ctx, gameLobby.Id)
+		unhostGame(ctx, repos, gameLobby.HostId, gameLobby.Id)
+		return fmt.Errorf("failed to store game lobby: %w", err)
+	}
+
+	return nil
+}
 
-	gameLobbiesKV, err := js.KeyValue(ctx, "gameLobbies")
-	if err != nil {
-		return fmt.Errorf("failed to get game lobbies key value: %w", err)
+// removeGame deletes a game with its invite and drops it from its host's
+// index. Every step tolerates what is already gone, so replicas racing to
+// remove the same game, or a retry after a partial removal, are harmless.
+func removeGame(ctx context.Context, repos *store.Repos, id string) error {
+	gameLobby, _, err := repos.Lobbies.Get(ctx, id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
 	}
 
-	gameBoardsKV, err := js.KeyValue(ctx, "gameBoards")
-	if err != nil {
-		return fmt.Errorf("failed to get game lobbies key value: %w", err)
+	// The lobby goes first so dashboards drop the game before its board.
+	errs := []error{
+		repos.Lobbies.Purge(ctx, id),
+		repos.Boards.Purge(ctx, id),
+	}
+	if gameLobby != nil {
+		if gameLobby.InviteCode != "" {
+			errs = append(errs, repos.Invites.Purge(ctx, gameLobby.InviteCode))
+		}
+		errs = append(errs, unhostGame(ctx, repos, gameLobby.HostId, id))
 	}
 
-	usersKV, err := js.KeyValue(ctx, "users")
-	if err != nil {
-		return fmt.Errorf("failed to get users key value: %w", err)
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to remove game %s: %w", id, err)
 	}
+	return nil
+}
+
+// unhostGame removes id from the games hosted by sessionId.
+func unhostGame(ctx context.Context, repos *store.Repos, sessionId, id string) error {
+	_, err := store.Modify(ctx, repos.Users, sessionId, func(user *components.User) error {
+		user.HostedGames = slices.DeleteFunc(user.HostedGames, func(hosted string) bool {
+			return hosted == id
+		})
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func setupDashboardRoute(router chi.Router, sessionStore sessions.Store, repos *store.Repos, service *gameService) error {
+	ctx := context.Background()
+
+	players := newPlayers(repos)
 
 	handleGetDashboard := func(w http.ResponseWriter, r *http.Request) {
-		sessionId, err := getSessionId(store, r)
+		sessionId, err := getSessionId(sessionStore, r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -49,68 +136,53 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 			return
 		}
 
-		user, _, err := GetObject[components.User](ctx, usersKV, sessionId)
+		user, _, err := repos.Users.Get(ctx, sessionId)
 		if err != nil {
-			deleteSessionId(store, w, r)
+			deleteSessionId(sessionStore, w, r)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		pages.Dashboard(user.Name).Render(r.Context(), w)
+		pages.Dashboard(user.Name, service.admins.has(user), maxChatLength).Render(r.Context(), w)
 	}
 
 	router.Get("/dashboard", handleGetDashboard)
 
 	// API
 
-	generateGameDetails := func() (string, string) {
-		id := toolbelt.NextEncodedID()
-		seed := time.Now().UTC().UnixNano()
-		nameGenerator := namegenerator.NewNameGenerator(seed)
-		name := strings.ToUpper(nameGenerator.Generate())
-		return id, name
-	}
-
-	createGameLobby := func(id, name, sessionId string) components.GameLobby {
-		return components.GameLobby{
-			Id:           id,
-			Name:         name,
-			HostId:       sessionId,
-			ChallengerId: "",
-		}
-	}
-
-	createGameState := func(id string) components.GameState {
-		return components.GameState{
-			Id:      id,
-			Board:   [9]string{},
-			XIsNext: true,
-			Winner:  "",
+	loadGameSettings := func(r *http.Request) (*components.GameSettings, error) {
+		settings := defaultGameSettings()
+		if err := datastar.ReadSignals(r, &settings); err != nil {
+			return nil, err
 		}
+		return &settings, nil
 	}
 
 	handleCreate := func(w http.ResponseWriter, r *http.Request) {
-		sessionId, err := getSessionId(store, r)
+		sessionId, err := getSessionId(sessionStore, r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		id, name := generateGameDetails()
-		gameLobby := createGameLobby(id, name, sessionId)
-		if err := PutData(r.Context(), gameLobbiesKV, id, gameLobby); err != nil {
-			http.Error(w, fmt.Sprintf("failed to store game lobby: %v", err), http.StatusInternalServerError)
+		settings, err := loadGameSettings(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		gameState := createGameState(id)
-		if err := PutData(r.Context(), gameBoardsKV, id, gameState); err != nil {
-			http.Error(w, fmt.Sprintf("failed to store game state: %v", err), http.StatusInternalServerError)
+		if _, err := service.create(r.Context(), sessionId, *settings); err != nil {
+			if msg, ok := createErrorMessage(err); ok {
+				sse := datastar.NewSSE(w, r)
+				sse.ExecuteScript(fmt.Sprintf("alert('%s');", msg))
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
 	handleLogout := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		sessionId, err := getSessionId(store, r)
+		sessionId, err := getSessionId(sessionStore, r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -120,58 +192,34 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 			return
 		}
 
-		keys, err := gameLobbiesKV.Keys(ctx)
-		if err != nil {
-			log.Printf("%v", err)
-		}
-
-		for _, key := range keys {
-			entry, err := gameLobbiesKV.Get(ctx, key)
-			if err != nil {
-				log.Printf("Failed to get value for key %s: %v", key, err)
-				continue
-			}
-
-			var gameLobby components.GameLobby
-			if err := json.Unmarshal(entry.Value(), &gameLobby); err != nil {
-				log.Printf("Error unmarshalling update value: %v", err)
-				return
-			}
-
-			if gameLobby.HostId == sessionId {
-				gameLobbiesKV.Delete(ctx, key)
-				gameBoardsKV.Delete(ctx, key)
-			}
-		}
-
-		if err := usersKV.Delete(ctx, sessionId); err != nil {
-			http.Error(w, fmt.Sprintf("failed to delete key '%s': %v", sessionId, err), http.StatusInternalServerError)
+		if err := service.logout(ctx, sessionId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		deleteSessionId(store, w, r)
+		deleteSessionId(sessionStore, w, r)
 		sse := datastar.NewSSE(w, r)
 		sse.Redirect("/")
 	}
 
-	handleHistoricalUpdates := func(dashboardItems []components.GameLobby, sessionId string, sse *datastar.ServerSentEventGenerator) {
+	handleHistoricalUpdates := func(dashboardItems []components.GameLobby, sessionId string, online components.Online, sse *datastar.ServerSentEventGenerator) {
 		if len(dashboardItems) == 0 {
 			return
 		}
 
-		c := components.DashboardList(dashboardItems, sessionId)
+		c := components.DashboardList(dashboardItems, sessionId, online)
 		if err := sse.MergeFragmentTempl(c); err != nil {
 			sse.ConsoleError(err)
 		}
 		dashboardItems = nil
 	}
 
-	handleKeyValueDelete := func(historicalMode bool, update jetstream.KeyValueEntry, sse *datastar.ServerSentEventGenerator) {
+	handleKeyValueDelete := func(historicalMode bool, key string, sse *datastar.ServerSentEventGenerator) {
 		if historicalMode {
-			log.Printf("Ignoring historical delete for key: %s", update.Key())
+			log.Printf("Ignoring historical delete for key: %s", key)
 			return
 		}
 
-		if err := sse.RemoveFragments("#game-"+update.Key(),
+		if err := sse.RemoveFragments("#game-"+key,
 			datastar.WithRemoveSettleDuration(1*time.Millisecond),
 			datastar.WithRemoveUseViewTransitions(false)); err != nil {
 			sse.ConsoleError(err)
@@ -179,33 +227,37 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 
 	}
 
+	// handleKeyValuePut appends lobbies the dashboard has not listed yet and
+	// morphs the ones it has; listed tracks the lobbies on the dashboard.
 	handleKeyValuePut := func(
-		ctx context.Context,
 		historicalMode bool,
 		dashboardItems *[]components.GameLobby,
-		entry jetstream.KeyValueEntry,
+		listed map[string]components.GameLobby,
+		entry *store.Entry[components.GameLobby],
 		sessionId string,
+		online components.Online,
 		sse *datastar.ServerSentEventGenerator,
 	) {
-		var gameLobby components.GameLobby
-		if err := json.Unmarshal(entry.Value(), &gameLobby); err != nil {
-			log.Printf("Error unmarshalling update value for key %s: %v", entry.Key(), err)
+		gameLobby := entry.Value
+
+		if !visibleTo(&gameLobby, sessionId) {
+			if _, isListed := listed[entry.Key]; isListed {
+				delete(listed, entry.Key)
+				handleKeyValueDelete(historicalMode, entry.Key, sse)
+			}
 			return
 		}
 
+		_, isListed := listed[entry.Key]
+		listed[entry.Key] = gameLobby
+
 		if historicalMode {
 			*dashboardItems = append(*dashboardItems, gameLobby)
 			return
 		}
 
-		history, err := gameLobbiesKV.History(ctx, entry.Key())
-		if err != nil {
-			log.Printf("Error getting history for key %s: %v", entry.Key(), err)
-			return
-		}
-
-		c := components.DashboardListItem(&gameLobby, sessionId)
-		if len(history) == 1 {
+		c := components.DashboardListItem(&gameLobby, sessionId, online)
+		if !isListed {
 			if err := sse.MergeFragmentTempl(c,
 				datastar.WithSelectorID("list-container"),
 				datastar.WithMergeAppend()); err != nil {
@@ -213,38 +265,196 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 			}
 		} else {
 			if err := sse.MergeFragmentTempl(c,
-				datastar.WithSelectorID("game-"+entry.Key()),
+				datastar.WithSelectorID("game-"+entry.Key),
 				datastar.WithMergeMorph()); err != nil {
 				sse.ConsoleError(err)
 			}
 		}
 	}
 
+	// handlePresence morphs the listed lobbies whose players came online or
+	// went offline, and the list of online players when it changed.
+	handlePresence := func(
+		historicalMode bool,
+		listed map[string]components.GameLobby,
+		sessionId string,
+		before, after components.Online,
+		players []components.OnlinePlayer,
+		sse *datastar.ServerSentEventGenerator,
+	) {
+		if err := sse.MergeFragmentTempl(components.OnlinePlayers(players)); err != nil {
+			sse.ConsoleError(err)
+		}
+
+		if historicalMode {
+			return
+		}
+
+		changed := func(id string) bool {
+			return before.IsOnline(id) != after.IsOnline(id)
+		}
+		for key, gameLobby := range listed {
+			if gameLobby.ChallengerId == "" || !(changed(gameLobby.HostId) || changed(gameLobby.ChallengerId)) {
+				continue
+			}
+			if err := sse.MergeFragmentTempl(components.DashboardListItem(&gameLobby, sessionId, after),
+				datastar.WithSelectorID("game-"+key),
+				datastar.WithMergeMorph()); err != nil {
+				sse.ConsoleError(err)
+			}
+		}
+	}
+
+	leaveQueue := func(ctx context.Context, sessionId string) {
+		if err := repos.MatchQueue.Delete(ctx, sessionId); err != nil {
+			log.Printf("Error leaving match queue for %s: %v", sessionId, err)
+		}
+	}
+
+	handleMatch := func(ctx context.Context, entry *store.Entry[components.QueueEntry], sse *datastar.ServerSentEventGenerator) {
+		if entry == nil || entry.Op != store.OpPut || entry.Value.GameId == "" {
+			return
+		}
+
+		leaveQueue(ctx, entry.Key)
+		sse.Redirect("/game/" + entry.Value.GameId)
+	}
+
+	// lobbyChatView renders the dashboard chat. Admins get the delete
+	// buttons.
+	lobbyChatView := func(sse *datastar.ServerSentEventGenerator, isAdmin bool) lobbyChatView {
+		return lobbyChatView{
+			replay: func(messages []components.ChatMessage) error {
+				if err := sse.MergeFragmentTempl(components.LobbyChatMessages(messages, isAdmin)); err != nil {
+					sse.ConsoleError(err)
+				}
+				return nil
+			},
+			message: func(message components.ChatMessage) error {
+				if err := sse.MergeFragmentTempl(components.LobbyChatLine(&message, isAdmin),
+					datastar.WithSelectorID("lobby-chat-messages"),
+					datastar.WithMergeAppend()); err != nil {
+					sse.ConsoleError(err)
+				}
+				return nil
+			},
+			deleted: func(sequence uint64) error {
+				if err := sse.RemoveFragments(fmt.Sprintf("#lobby-chat-%d", sequence)); err != nil {
+					sse.ConsoleError(err)
+				}
+				return nil
+			},
+		}
+	}
+
 	handleUpdates := func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
 		sse := datastar.NewSSE(w, r)
 
-		sessionId, err := getSessionId(store, r)
+		sessionId, err := getSessionId(sessionStore, r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		watcher, err := gameLobbiesKV.WatchAll(ctx)
+		isAdmin := false
+		if user, _, err := repos.Users.Get(ctx, sessionId); err == nil {
+			isAdmin = service.admins.has(user)
+		}
+
+		// The chat shares the connection with the game list; its writes have
+		// to end before the handler does.
+		var wg sync.WaitGroup
+		defer func() {
+			cancel()
+			wg.Wait()
+		}()
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := service.lobbyChat.watch(ctx, lobbyChatView(sse, isAdmin)); err != nil {
+				log.Printf("Lobby chat watcher error: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			beOnline(ctx, repos, sessionId, "")
+		}()
+
+		watcher, err := repos.Lobbies.WatchAll(ctx)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to start watcher: %v", err), http.StatusInternalServerError)
 			return
 		}
 		defer watcher.Stop()
 
+		matchWatcher, err := repos.MatchQueue.Watch(ctx, sessionId)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to start match watcher: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer matchWatcher.Stop()
+		// Closing the dashboard leaves the quick match queue.
+		defer leaveQueue(context.Background(), sessionId)
+
+		presenceWatcher, err := repos.Presence.WatchAll(ctx)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to start presence watcher: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer presenceWatcher.Stop()
+		// Catches connections that stopped sending heartbeats.
+		presenceTicker := time.NewTicker(presenceHeartbeat)
+		defer presenceTicker.Stop()
+
 		historicalMode := true
 		dashboardItems := &[]components.GameLobby{}
+		listed := map[string]components.GameLobby{}
+
+		historicalPresence := true
+		presence := presenceSet{}
+		online := components.Online{}
+		var onlinePlayers []components.OnlinePlayer
+		everyone := func(components.Presence) bool { return true }
+
+		refreshPresence := func() {
+			now := time.Now()
+			next, players := presence.online(now), presence.players(now)
+			if slices.Equal(players, onlinePlayers) && maps.EqualFunc(next, online, maps.Equal) {
+				return
+			}
+			handlePresence(historicalMode, listed, sessionId, online, next, players, sse)
+			online, onlinePlayers = next, players
+		}
 
 		for {
 			select {
 			case <-ctx.Done():
 				log.Println("Context canceled, stopping watcher updates")
 				return
+			case entry, ok := <-matchWatcher.Updates():
+				if !ok {
+					log.Println("Match watcher updates channel closed")
+					return
+				}
+				handleMatch(ctx, entry, sse)
+			case <-presenceTicker.C:
+				if !historicalPresence {
+					refreshPresence()
+				}
+			case entry, ok := <-presenceWatcher.Updates():
+				if !ok {
+					log.Println("Presence watcher updates channel closed")
+					return
+				}
+				if entry == nil {
+					historicalPresence = false
+				} else if !presence.apply(entry, everyone) || historicalPresence {
+					continue
+				}
+				refreshPresence()
 			case entry, ok := <-watcher.Updates():
 				if !ok {
 					log.Println("Watcher updates channel closed")
@@ -252,16 +462,17 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 				}
 
 				if entry == nil {
-					handleHistoricalUpdates(*dashboardItems, sessionId, sse)
+					handleHistoricalUpdates(*dashboardItems, sessionId, online, sse)
 					historicalMode = false
 					continue
 				}
 
-				switch entry.Operation() {
-				case jetstream.KeyValuePut:
-					handleKeyValuePut(ctx, historicalMode, dashboardItems, entry, sessionId, sse)
-				case jetstream.KeyValuePurge:
-					handleKeyValueDelete(historicalMode, entry, sse)
+				switch entry.Op {
+				case store.OpPut:
+					handleKeyValuePut(historicalMode, dashboardItems, listed, entry, sessionId, online, sse)
+				case store.OpDelete:
+					delete(listed, entry.Key)
+					handleKeyValueDelete(historicalMode, entry.Key, sse)
 				}
 			}
 		}
@@ -270,20 +481,30 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 	handlePurge := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		keys, err := gameLobbiesKV.Keys(ctx)
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil || sessionId == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if user, _, err := repos.Users.Get(ctx, sessionId); err != nil || !service.admins.has(user) {
+			http.Error(w, errNotAdmin.Error(), http.StatusForbidden)
+			return
+		}
+
+		keys, err := repos.Lobbies.Keys(ctx)
 		if err != nil {
 			log.Printf("Error listing keys: %v", err)
 			return
 		}
 
 		for _, key := range keys {
-			err = gameLobbiesKV.Purge(ctx, key)
+			err = repos.Lobbies.Purge(ctx, key)
 			if err != nil {
 				log.Printf("Error deleting key '%s': %v", key, err)
 				continue
 			}
 
-			err = gameBoardsKV.Purge(ctx, key)
+			err = repos.Boards.Purge(ctx, key)
 			if err != nil {
 				log.Printf("Error deleting key '%s': %v", key, err)
 				continue
@@ -292,9 +513,119 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 			log.Printf("Deleted key: %s", key)
 		}
 
+		inviteKeys, err := repos.Invites.Keys(ctx)
+		if err != nil {
+			log.Printf("Error listing invite keys: %v", err)
+		}
+		for _, key := range inviteKeys {
+			if err := repos.Invites.Purge(ctx, key); err != nil {
+				log.Printf("Error deleting invite '%s': %v", key, err)
+			}
+		}
+
 		fmt.Fprintln(w, "All games have been purged.")
 	}
 
+	handleChat := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil || sessionId == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		signals := &components.ChatSignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		if err := service.lobbyChat.send(r.Context(), sessionId, signals.Chat); err != nil {
+			if msg, ok := chatErrorMessage(err); ok {
+				sse.ExecuteScript(fmt.Sprintf("alert('%s')", msg))
+				return
+			}
+			log.Printf("Error sending lobby chat message of %s: %v", sessionId, err)
+			sse.ExecuteScript("alert('Failed to send the message')")
+			return
+		}
+
+		if err := sse.MarshalAndMergeSignals(components.ChatSignals{}); err != nil {
+			sse.ConsoleError(err)
+		}
+	}
+
+	handleDeleteChat := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil || sessionId == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		sequence, err := strconv.ParseUint(chi.URLParam(r, "sequence"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid message", http.StatusBadRequest)
+			return
+		}
+
+		err = service.lobbyChat.remove(r.Context(), sessionId, sequence)
+		switch {
+		case err == nil, errors.Is(err, store.ErrNotFound):
+			// Someone else deleted it first.
+		case errors.Is(err, errNotAdmin):
+			sse := datastar.NewSSE(w, r)
+			sse.ExecuteScript("alert('Only admins can delete messages.')")
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	handleQueue := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil || sessionId == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		rating, err := players.ratingOf(ctx, sessionId)
+		if err != nil {
+			log.Printf("Error getting rating of %s: %v", sessionId, err)
+		}
+
+		// Queueing twice keeps the first entry, which the matchmaker may
+		// already be claiming.
+		if _, err := repos.MatchQueue.Create(ctx, sessionId, components.QueueEntry{
+			SessionId: sessionId,
+			Rating:    rating,
+			JoinedAt:  time.Now().UTC(),
+		}); err != nil && !errors.Is(err, store.ErrConflict) {
+			http.Error(w, fmt.Sprintf("failed to join queue: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+		if err := sse.MarshalAndMergeSignals(components.MatchSignals{Queued: true}); err != nil {
+			sse.ConsoleError(err)
+		}
+	}
+
+	handleLeaveQueue := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil || sessionId == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		leaveQueue(r.Context(), sessionId)
+
+		sse := datastar.NewSSE(w, r)
+		if err := sse.MarshalAndMergeSignals(components.MatchSignals{Queued: false}); err != nil {
+			sse.ConsoleError(err)
+		}
+	}
+
 	handleJoin := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		sse := datastar.NewSSE(w, r)
@@ -305,7 +636,7 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 			return
 		}
 
-		sessionID, err := getSessionId(store, r)
+		sessionID, err := getSessionId(sessionStore, r)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("failed to get session: %v", err), http.StatusInternalServerError)
 			return
@@ -315,27 +646,22 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 			return
 		}
 
-		gameLobby, entry, err := GetObject[components.GameLobby](ctx, gameLobbiesKV, id)
-		if err != nil {
+		switch err := service.join(ctx, sessionID, id); {
+		case err == nil:
+		case errors.Is(err, errGamePrivate):
+			sse.ExecuteScript("alert('This game is private. Ask the host for an invite link.');")
+			return
+		case errors.Is(err, errGameFull):
+			sse.ExecuteScript("alert('Another player has already joined. Game is full.');")
+			return
+		case errors.Is(err, errSeatTaken):
+			sse.ExecuteScript("alert('Someone else joined first. This lobby is now full.');")
+			return
+		default:
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		if sessionID != gameLobby.HostId {
-
-			if gameLobby.ChallengerId != "" && gameLobby.ChallengerId != sessionID {
-				sse.ExecuteScript("alert('Another player has already joined. Game is full.');")
-				return
-			}
-
-			gameLobby.ChallengerId = sessionID
-
-			if err := UpdateData(ctx, gameLobbiesKV, id, gameLobby, entry); err != nil {
-				sse.ExecuteScript("alert('Someone else joined first. This lobby is now full.');")
-				return
-			}
-		}
-
 		sse.Redirect("/game/" + id)
 	}
 
@@ -348,12 +674,23 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 			return
 		}
 
-		if err := gameLobbiesKV.Purge(ctx, id); err != nil {
-			http.Error(w, fmt.Sprintf("failed to delete key '%s': %v", id, err), http.StatusInternalServerError)
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil || sessionId == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-		if err := gameBoardsKV.Purge(ctx, id); err != nil {
-			http.Error(w, fmt.Sprintf("failed to delete key '%s': %v", id, err), http.StatusInternalServerError)
+
+		if err := service.remove(ctx, sessionId, id); err != nil {
+			// Another tab or replica removed it already.
+			if errors.Is(err, store.ErrNotFound) {
+				return
+			}
+			if errors.Is(err, errNotHost) {
+				sse := datastar.NewSSE(w, r)
+				sse.ExecuteScript("alert('Only the host can delete the game.');")
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
@@ -368,6 +705,14 @@ func setupDashboardRoute(router chi.Router, store sessions.Store, js jetstream.J
 
 		dashboardRouter.Delete("/purge", handlePurge)
 
+		dashboardRouter.Post("/queue", handleQueue)
+
+		dashboardRouter.Delete("/queue", handleLeaveQueue)
+
+		dashboardRouter.Post("/chat", handleChat)
+
+		dashboardRouter.Delete("/chat/{sequence}", handleDeleteChat)
+
 		dashboardRouter.Route("/{id}", func(gameIdRouter chi.Router) {
 
 			gameIdRouter.Post("/join", handleJoin)
@@ -2,38 +2,29 @@ package routes
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/sessions"
-	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
 	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
 	"github.com/rphumulock/datastar_nats_tictactoe/web/pages"
 	datastar "github.com/starfederation/datastar/sdk/go"
 )
 
-func setupGameRoute(router chi.Router, store sessions.Store, js jetstream.JetStream) error {
-	ctx := context.Background()
-
-	usersKV, err := js.KeyValue(ctx, "users")
-	if err != nil {
-		return fmt.Errorf("failed to get game boards key value: %w", err)
-	}
-
-	gameLobbiesKV, err := js.KeyValue(ctx, "gameLobbies")
-	if err != nil {
-		return fmt.Errorf("failed to get game boards key value: %w", err)
-	}
+const (
+	spectatorHeartbeat = 30 * time.Second
+	spectatorTTL       = 2 * time.Minute
+)
 
-	gameBoardsKV, err := js.KeyValue(ctx, "gameBoards")
-	if err != nil {
-		return fmt.Errorf("failed to get game boards key value: %w", err)
-	}
+func setupGameRoute(router chi.Router, sessionStore sessions.Store, repos *store.Repos, service *gameService) error {
+	ctx := context.Background()
 
 	handleGamePage := func(w http.ResponseWriter, r *http.Request) {
 		id := chi.URLParam(r, "id")
@@ -42,25 +33,26 @@ func setupGameRoute(router chi.Router, store sessions.Store, js jetstream.JetStr
 			return
 		}
 
-		sessionId, err := getSessionId(store, r)
+		sessionId, err := getSessionId(sessionStore, r)
 		if err != nil {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		currentUser, _, err := GetObject[components.User](ctx, usersKV, sessionId)
+		currentUser, _, err := repos.Users.Get(ctx, sessionId)
 		if err != nil {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		gameLobby, _, err := GetObject[components.GameLobby](ctx, gameLobbiesKV, id)
-		if err != nil {
+		// Private games are only shown to their players.
+		gameLobby, _, err := repos.Lobbies.Get(ctx, id)
+		if err != nil || !visibleTo(gameLobby, sessionId) {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		host, _, err := GetObject[components.User](ctx, usersKV, gameLobby.HostId)
+		host, _, err := repos.Users.Get(ctx, gameLobby.HostId)
 		if err != nil {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
@@ -68,7 +60,7 @@ func setupGameRoute(router chi.Router, store sessions.Store, js jetstream.JetStr
 
 		var challenger *components.User
 		if gameLobby.ChallengerId != "" {
-			challenger, _, err = GetObject[components.User](ctx, usersKV, gameLobby.ChallengerId)
+			challenger, _, err = repos.Users.Get(ctx, gameLobby.ChallengerId)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
 				return
@@ -78,13 +70,18 @@ func setupGameRoute(router chi.Router, store sessions.Store, js jetstream.JetStr
 			challenger.Name = ""
 		}
 
-		gameState, _, err := GetObject[components.GameState](ctx, gameBoardsKV, id)
+		gameState, _, err := repos.Boards.Get(ctx, id)
 		if err != nil {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		pages.Game(currentUser, host, challenger, gameLobby, gameState).Render(r.Context(), w)
+		presence, err := loadGamePresence(ctx, repos, gameLobby)
+		if err != nil {
+			log.Printf("Error loading presence of game %s: %v", id, err)
+		}
+
+		pages.Game(currentUser, host, challenger, gameLobby, gameState, 0, clockView(gameState, time.Now()), presence, maxChatLength).Render(r.Context(), w)
 	}
 
 	router.Get("/game/{id}", handleGamePage)
@@ -93,151 +90,121 @@ func setupGameRoute(router chi.Router, store sessions.Store, js jetstream.JetStr
 
 	router.Route("/api/game/{id}", func(gameRouter chi.Router) {
 
-		checkWinner := func(board []string) string {
-			winningCombinations := [][]int{
-				{0, 1, 2}, // Top row
-				{3, 4, 5}, // Middle row
-				{6, 7, 8}, // Bottom row
-				{0, 3, 6}, // Left column
-				{1, 4, 7}, // Middle column
-				{2, 5, 8}, // Right column
-				{0, 4, 8}, // Top-left to bottom-right diagonal
-				{2, 4, 6}, // Top-right to bottom-left diagonal
-			}
-
-			boardFull := true // Assume the board is full initially
-
-			// Check for a winner and simultaneously check if the board is full
-			for _, combination := range winningCombinations {
-				if board[combination[0]] != "" &&
-					board[combination[0]] == board[combination[1]] &&
-					board[combination[0]] == board[combination[2]] {
-					return board[combination[0]] // Return the winner ("X" or "O")
-				}
-			}
-
-			// Check if the board is full
-			for _, cell := range board {
-				if cell == "" {
-					boardFull = false
-					break
-				}
-			}
-
-			if boardFull {
-				return "TIE" // Board is full and no winner
-			}
-
-			return "" // No winner yet and moves still possible
-		}
-
-		watchGameBoard := func(ctx context.Context, sse *datastar.ServerSentEventGenerator, gameId string) error {
-			gameWatcher, err := gameBoardsKV.Watch(ctx, gameId)
-			if err != nil {
-				return fmt.Errorf("failed to start game watcher: %w", err)
-			}
-			defer gameWatcher.Stop()
-
-			for {
-				select {
-				case <-ctx.Done():
-					return nil // Exit if context is canceled
-				case update, ok := <-gameWatcher.Updates():
-					if !ok {
-						return nil // Exit if the channel is closed
+		// datastarView renders the changes of a game as the fragments of
+		// the game page.
+		datastarView := func(sse *datastar.ServerSentEventGenerator, gameId, sessionId string, playable bool) gameView {
+			var spectators atomic.Int64
+			var presence atomic.Pointer[components.GamePresence]
+			// The challenger badge is only on the page while the seat is taken.
+			var challengerSeated atomic.Bool
+
+			return gameView{
+				board: func(gameState components.GameState) error {
+					c := components.GameBoard(&gameState, playable)
+					if err := sse.MergeFragmentTempl(c,
+						datastar.WithSelectorID("gameboard"),
+						datastar.WithMergeMorph(),
+					); err != nil {
+						sse.ConsoleError(err)
 					}
-					if update == nil {
-						log.Println("End of historical updates. Now receiving live updates...")
-						continue
-					}
-
-					switch update.Operation() {
-					case jetstream.KeyValuePut:
-						var gameState components.GameState
-						if err := json.Unmarshal(update.Value(), &gameState); err != nil {
-							log.Printf("Error unmarshalling game state: %v", err)
-							continue
-						}
-
-						log.Printf("Received update for game %v", gameState)
-
-						c := components.GameBoard(&gameState)
-						if err := sse.MergeFragmentTempl(c,
-							datastar.WithSelectorID("gameboard"),
-							datastar.WithMergeMorph(),
-						); err != nil {
-							sse.ConsoleError(err)
-						}
 
-					case jetstream.KeyValuePurge:
-						sse.Redirect("/")
+					if err := sse.MergeFragmentTempl(components.SeriesScore(&gameState)); err != nil {
+						sse.ConsoleError(err)
 					}
-				}
-			}
-		}
-
-		watchGameLobby := func(ctx context.Context, sse *datastar.ServerSentEventGenerator, gameId, sessionId string) error {
-			gameLobbyWatcher, err := gameLobbiesKV.Watch(ctx, gameId)
-			if err != nil {
-				return fmt.Errorf("failed to start game lobby watcher: %w", err)
-			}
-			defer gameLobbyWatcher.Stop()
-
-			for {
-				select {
-				case <-ctx.Done():
-					return nil // Exit if context is canceled
-				case gameLobbyEntry, ok := <-gameLobbyWatcher.Updates():
-					if !ok {
-						return nil // Exit if the channel is closed
+					if err := sse.MergeFragmentTempl(components.GameClock(clockView(&gameState, time.Now()))); err != nil {
+						sse.ConsoleError(err)
 					}
-					if gameLobbyEntry == nil {
-						log.Println("End of historical updates. Now receiving live updates...")
-						continue
+					return nil
+				},
+				lobby: func(gameLobby components.GameLobby) error {
+					challengerSeated.Store(gameLobby.ChallengerId != "")
+
+					currentUser, _, err := repos.Users.Get(ctx, sessionId)
+					if err != nil {
+						return fmt.Errorf("failed to get current user: %w", err)
 					}
 
-					switch gameLobbyEntry.Operation() {
-					case jetstream.KeyValuePut:
-						var gameLobby components.GameLobby
-						if err := json.Unmarshal(gameLobbyEntry.Value(), &gameLobby); err != nil {
-							log.Printf("Error unmarshalling game lobby: %v", err)
-							continue
-						}
-
-						log.Printf("Received update for game lobby %v", gameLobby)
+					host, _, err := repos.Users.Get(ctx, gameLobby.HostId)
+					if err != nil {
+						return fmt.Errorf("failed to get host user: %w", err)
+					}
 
-						currentUser, _, err := GetObject[components.User](ctx, usersKV, sessionId)
+					var challenger *components.User
+					if gameLobby.ChallengerId != "" {
+						challenger, _, err = repos.Users.Get(ctx, gameLobby.ChallengerId)
 						if err != nil {
-							return fmt.Errorf("failed to get current user: %w", err)
+							return fmt.Errorf("failed to get challenger user: %w", err)
 						}
+					} else {
+						challenger = &components.User{Name: ""}
+					}
 
-						host, _, err := GetObject[components.User](ctx, usersKV, gameLobby.HostId)
-						if err != nil {
-							return fmt.Errorf("failed to get host user: %w", err)
-						}
+					gameState, _, err := repos.Boards.Get(ctx, gameId)
+					if err != nil {
+						return fmt.Errorf("failed to get game state: %w", err)
+					}
 
-						var challenger *components.User
-						if gameLobby.ChallengerId != "" {
-							challenger, _, err = GetObject[components.User](ctx, usersKV, gameLobby.ChallengerId)
-							if err != nil {
-								return fmt.Errorf("failed to get challenger user: %w", err)
-							}
-						} else {
-							challenger = &components.User{Name: ""}
-						}
+					// The presence watcher may not have reported yet.
+					var gamePresence components.GamePresence
+					if p := presence.Load(); p != nil {
+						gamePresence = *p
+					} else if gamePresence, err = loadGamePresence(ctx, repos, &gameLobby); err != nil {
+						log.Printf("Error loading presence of game %s: %v", gameId, err)
+					}
 
-						c := components.GameControls(currentUser, host, challenger, &gameLobby)
-						if err := sse.MergeFragmentTempl(c,
-							datastar.WithSelectorID("gamecontrols"),
-							datastar.WithMergeMorph(),
-						); err != nil {
+					c := components.GameControls(currentUser, host, challenger, &gameLobby, gameState, int(spectators.Load()), clockView(gameState, time.Now()), gamePresence)
+					if err := sse.MergeFragmentTempl(c,
+						datastar.WithSelectorID("gamecontrols"),
+						datastar.WithMergeMorph(),
+					); err != nil {
+						sse.ConsoleError(err)
+					}
+					return nil
+				},
+				spectators: func(count int) error {
+					spectators.Store(int64(count))
+					if err := sse.MergeFragmentTempl(components.SpectatorCount(count)); err != nil {
+						sse.ConsoleError(err)
+					}
+					return nil
+				},
+				presence: func(gamePresence components.GamePresence) error {
+					presence.Store(&gamePresence)
+					if err := sse.MergeFragmentTempl(components.PresenceBadge("presence-host", gamePresence.Host)); err != nil {
+						sse.ConsoleError(err)
+					}
+					if challengerSeated.Load() {
+						if err := sse.MergeFragmentTempl(components.PresenceBadge("presence-challenger", gamePresence.Challenger)); err != nil {
 							sse.ConsoleError(err)
 						}
-
-					case jetstream.KeyValuePurge:
-						sse.Redirect("/")
 					}
-				}
+					return nil
+				},
+				clock: func(gameState components.GameState, now time.Time) error {
+					if err := sse.MergeFragmentTempl(components.GameClock(clockView(&gameState, now))); err != nil {
+						sse.ConsoleError(err)
+					}
+					return nil
+				},
+				deleted: func() error {
+					sse.Redirect("/")
+					return nil
+				},
+				chatReplay: func(messages []components.ChatMessage) error {
+					if err := sse.MergeFragmentTempl(components.ChatMessages(messages)); err != nil {
+						sse.ConsoleError(err)
+					}
+					return nil
+				},
+				chat: func(message components.ChatMessage) error {
+					if err := sse.MergeFragmentTempl(components.ChatLine(&message),
+						datastar.WithSelectorID("chat-messages"),
+						datastar.WithMergeAppend(),
+					); err != nil {
+						sse.ConsoleError(err)
+					}
+					return nil
+				},
 			}
 		}
 
@@ -250,38 +217,20 @@ func setupGameRoute(router chi.Router, store sessions.Store, js jetstream.JetStr
 				return
 			}
 
-			sessionId, err := getSessionId(store, r)
+			sessionId, err := getSessionId(sessionStore, r)
 			if err != nil || sessionId == "" {
 				http.Redirect(w, r, "/", http.StatusSeeOther)
 				return
 			}
 
-			// Create a cancellable context for graceful shutdown
-			ctx, cancel := context.WithCancel(r.Context())
-			defer cancel()
-
-			// Use a WaitGroup to wait for all watchers to finish
-			var wg sync.WaitGroup
-			wg.Add(2) // Two watchers: gameWatcher and gameLobbyWatcher
-
-			// Start gameWatcher
-			go func() {
-				defer wg.Done()
-				if err := watchGameBoard(ctx, sse, id); err != nil {
-					log.Printf("Game board watcher error: %v", err)
-				}
-			}()
-
-			// Start gameLobbyWatcher
-			go func() {
-				defer wg.Done()
-				if err := watchGameLobby(ctx, sse, id, sessionId); err != nil {
-					log.Printf("Game lobby watcher error: %v", err)
-				}
-			}()
+			gameLobby, _, err := repos.Lobbies.Get(r.Context(), id)
+			if err != nil || !visibleTo(gameLobby, sessionId) {
+				sse.Redirect("/dashboard")
+				return
+			}
+			isSpectator := !seated(gameLobby, sessionId)
 
-			// Wait for all watchers to finish
-			wg.Wait()
+			watchGame(r.Context(), repos, service.chat, id, sessionId, isSpectator, datastarView(sse, id, sessionId, !isSpectator))
 		}
 
 		handleToggle := func(w http.ResponseWriter, r *http.Request) {
@@ -293,83 +242,100 @@ func setupGameRoute(router chi.Router, store sessions.Store, js jetstream.JetStr
 				return
 			}
 
-			sessionId, err := getSessionId(store, r)
+			sessionId, err := getSessionId(sessionStore, r)
 			if err != nil || sessionId == "" {
 				sse.ExecuteScript("alert('Error getting session ID')")
 				sse.Redirect("/")
 				return
 			}
 
-			gameLobby, _, err := GetObject[components.GameLobby](r.Context(), gameLobbiesKV, id)
+			cell, err := strconv.Atoi(chi.URLParam(r, "cell"))
 			if err != nil {
-				http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+				sse.ExecuteScript("alert('Invalid cell index')")
 				return
 			}
 
-			gameState, entry, err := GetObject[components.GameState](r.Context(), gameBoardsKV, id)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
-				return
+			// Classic games only pass a cell, ultimate games also pick the board.
+			board := 0
+			if param := chi.URLParam(r, "board"); param != "" {
+				if board, err = strconv.Atoi(param); err != nil {
+					sse.ExecuteScript("alert('Invalid board index')")
+					return
+				}
 			}
 
-			cell := chi.URLParam(r, "cell")
-			i, err := strconv.Atoi(cell)
-			if err != nil || i < 0 || i >= len(gameState.Board) {
-				sse.ExecuteScript("alert('Invalid cell index')")
+			if err := service.move(r.Context(), sessionId, id, board, cell); err != nil {
+				if msg, ok := moveErrorMessage(err); ok {
+					sse.ExecuteScript(fmt.Sprintf("alert('%s')", msg))
+					return
+				}
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+		}
 
-			if gameState.Board[i] != "" {
-				sse.ExecuteScript("alert('Cell already occupied')")
+		handleReset := func(w http.ResponseWriter, r *http.Request) {
+			id := chi.URLParam(r, "id")
+			if id == "" {
+				http.Error(w, "missing 'id' parameter", http.StatusBadRequest)
 				return
 			}
 
-			if gameState.XIsNext && sessionId != gameLobby.HostId || !gameState.XIsNext && sessionId != gameLobby.ChallengerId {
-				sse.ExecuteScript("alert('Not your turn')")
+			sessionId, err := getSessionId(sessionStore, r)
+			if err != nil || sessionId == "" {
+				http.Error(w, "missing session", http.StatusUnauthorized)
 				return
 			}
 
-			if gameState.XIsNext {
-				gameState.Board[i] = "X"
-			} else {
-				gameState.Board[i] = "O"
-			}
-			gameState.XIsNext = !gameState.XIsNext
-
-			winner := checkWinner(gameState.Board[:])
-			if winner == "TIE" {
-				gameState.Winner = "TIE"
-			} else if winner != "" {
-				gameState.Winner = winner
-			}
-
-			if err := UpdateData(ctx, gameBoardsKV, gameState.Id, gameState, entry); err != nil {
+			if err := service.reset(r.Context(), sessionId, id); err != nil {
+				if errors.Is(err, errNotSeated) {
+					sse := datastar.NewSSE(w, r)
+					sse.ExecuteScript("alert('Spectators cannot reset the game')")
+					return
+				}
+				if errors.Is(err, errGameRunning) {
+					sse := datastar.NewSSE(w, r)
+					sse.ExecuteScript("alert('Finish the game before starting the next one')")
+					return
+				}
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		}
 
-		handleReset := func(w http.ResponseWriter, r *http.Request) {
+		handleChat := func(w http.ResponseWriter, r *http.Request) {
 			id := chi.URLParam(r, "id")
 			if id == "" {
 				http.Error(w, "missing 'id' parameter", http.StatusBadRequest)
 				return
 			}
 
-			gameState, entry, err := GetObject[components.GameState](ctx, gameBoardsKV, id)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			sessionId, err := getSessionId(sessionStore, r)
+			if err != nil || sessionId == "" {
+				http.Error(w, "missing session", http.StatusUnauthorized)
 				return
 			}
 
-			gameState.Board = [9]string{"", "", "", "", "", "", "", "", ""}
-			gameState.Winner = ""
-			gameState.XIsNext = true
+			signals := &components.ChatSignals{}
+			if err := datastar.ReadSignals(r, signals); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
-			if err := UpdateData(ctx, gameBoardsKV, gameState.Id, gameState, entry); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			sse := datastar.NewSSE(w, r)
+			if err := service.chat.send(r.Context(), id, sessionId, signals.Chat); err != nil {
+				if msg, ok := chatErrorMessage(err); ok {
+					sse.ExecuteScript(fmt.Sprintf("alert('%s')", msg))
+					return
+				}
+				log.Printf("Error sending chat message to game %s: %v", id, err)
+				sse.ExecuteScript("alert('Failed to send the message')")
 				return
 			}
+
+			if err := sse.MarshalAndMergeSignals(components.ChatSignals{}); err != nil {
+				sse.ConsoleError(err)
+			}
 		}
 
 		handleLeave := func(w http.ResponseWriter, r *http.Request) {
@@ -383,18 +349,22 @@ func setupGameRoute(router chi.Router, store sessions.Store, js jetstream.JetStr
 				return
 			}
 
-			gameLobby, entry, err := GetObject[components.GameLobby](ctx, gameLobbiesKV, id)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			sessionId, err := getSessionId(sessionStore, r)
+			if err != nil || sessionId == "" {
+				sse.Redirect("/")
 				return
 			}
 
-			gameLobby.ChallengerId = ""
-			err = UpdateData(ctx, gameLobbiesKV, gameLobby.Id, gameLobby, entry)
+			// Spectators simply walk away, only the challenger gives up the seat.
+			left, err := service.leave(ctx, sessionId, id)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			if !left {
+				sse.Redirect("/dashboard")
+				return
+			}
 
 			sse.Redirect("/")
 		}
@@ -403,10 +373,14 @@ func setupGameRoute(router chi.Router, store sessions.Store, js jetstream.JetStr
 
 		gameRouter.Post("/toggle/{cell}", handleToggle)
 
+		gameRouter.Post("/toggle/{board}/{cell}", handleToggle)
+
 		gameRouter.Post("/reset", handleReset)
 
 		gameRouter.Post("/leave", handleLeave)
 
+		gameRouter.Post("/chat", handleChat)
+
 	})
 
 	return nil
@@ -0,0 +1,119 @@
+package routes
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+)
+
+// TestPrivateGameHidden checks that only the players of a private game can
+// open it, follow it or replay it.
+func TestPrivateGameHidden(t *testing.T) {
+	service, js := newTestService()
+	sessionStore := sessions.NewCookieStore([]byte("test-secret"))
+	router := chi.NewRouter()
+	if err := setupRestRoute(router, sessionStore, service); err != nil {
+		t.Fatalf("setupRestRoute() error = %v", err)
+	}
+	if err := setupGameRoute(router, sessionStore, service.repos, service); err != nil {
+		t.Fatalf("setupGameRoute() error = %v", err)
+	}
+	if err := setupReplayRoute(router, sessionStore, service.repos, js); err != nil {
+		t.Fatalf("setupReplayRoute() error = %v", err)
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	host := newRestClient(t, server)
+	stranger := newRestClient(t, server)
+	host.login("alice")
+	stranger.login("mallory")
+
+	var private api.GameResponse
+	host.do(http.MethodPost, "/lobbies", map[string]any{"private": true}, &private, http.StatusCreated)
+	id := private.Lobby.Id
+
+	get := func(client *restClient, path string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		// Only the first response counts, not where it redirects to.
+		noRedirect := *client.client
+		noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		resp, err := noRedirect.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := get(stranger, "/game/"+id); status != http.StatusSeeOther {
+		t.Fatalf("game page of a private game for a stranger = %d, want a redirect", status)
+	}
+	if status, _ := get(host, "/game/"+id); status != http.StatusOK {
+		t.Fatalf("game page of a private game for its host = %d, want 200", status)
+	}
+	if _, body := get(stranger, "/api/game/"+id+"/updates"); !strings.Contains(body, "/dashboard") || strings.Contains(body, "gameboard") {
+		t.Fatalf("updates of a private game for a stranger = %q, want a redirect", body)
+	}
+	if status, _ := get(stranger, "/api/game/"+id+"/replay"); status != http.StatusNotFound {
+		t.Fatalf("replay of a private game for a stranger = %d, want 404", status)
+	}
+}
+
+// TestSpectateFollowsSeat checks that a session is counted as a spectator
+// only while it is not seated, however often it joins and leaves.
+func TestSpectateFollowsSeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	service, _ := newTestService()
+	repos := service.repos
+	key := "g1.s1"
+
+	seats := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		spectate(ctx, repos, "g1", "s1", true, seats)
+	}()
+
+	expect := func(step string, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			_, _, err := repos.Spectators.Get(context.Background(), key)
+			if (err == nil) == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: spectator registered = %v, want %v", step, err == nil, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	expect("opened", true)
+	seats <- true
+	expect("joined", false)
+	seats <- false
+	expect("left", true)
+	seats <- true
+	expect("joined again", false)
+	seats <- false
+	cancel()
+	<-done
+	expect("closed", false)
+}
@@ -1,29 +1,21 @@
 package routes
 
 import (
-	"context"
-	"fmt"
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/sessions"
-	"github.com/nats-io/nats.go/jetstream"
 	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
 	"github.com/rphumulock/datastar_nats_tictactoe/web/pages"
 
 	datastar "github.com/starfederation/datastar/sdk/go"
 )
 
-func setupIndexRoute(router chi.Router, store sessions.Store, js jetstream.JetStream) error {
-	ctx := context.Background()
-
-	usersKV, err := js.KeyValue(ctx, "users")
-	if err != nil {
-		return fmt.Errorf("failed to get 'users' KV bucket: %w", err)
-	}
-
+func setupIndexRoute(router chi.Router, sessionStore sessions.Store, service *gameService) error {
 	handleGetIndex := func(w http.ResponseWriter, r *http.Request) {
-		sessionID, err := getSessionId(store, r)
+		sessionID, err := getSessionId(sessionStore, r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -41,7 +33,11 @@ func setupIndexRoute(router chi.Router, store sessions.Store, js jetstream.JetSt
 	// API
 
 	userValidation := func(u *components.InlineValidationUserName) bool {
-		return len(u.Name) >= 2
+		return len(strings.TrimSpace(u.Name)) >= minNameLength
+	}
+
+	passwordValidation := func(u *components.InlineValidationUserName) bool {
+		return len(u.Password) >= minPasswordLength
 	}
 
 	loadInlineUser := func(r *http.Request) (*components.InlineValidationUserName, error) {
@@ -61,53 +57,59 @@ func setupIndexRoute(router chi.Router, store sessions.Store, js jetstream.JetSt
 
 		sse := datastar.NewSSE(w, r)
 		isNameValid := userValidation(inlineUser)
+		isPasswordValid := passwordValidation(inlineUser)
 		sse.MergeFragmentTempl(
-			components.InlineValidationUserNameComponent(inlineUser, isNameValid),
+			components.InlineValidationUserNameComponent(inlineUser, isNameValid, isPasswordValid),
 		)
 	}
 
-	createUser := func(sessionId, name string) *components.User {
-		return &components.User{
-			SessionId: sessionId,
-			Name:      name,
-		}
-	}
-
-	userSession := func(w http.ResponseWriter, r *http.Request, inlineUser *components.InlineValidationUserName) (*components.User, error) {
-		ctx := r.Context()
-
-		SessionId, err := createSessionId(store, r, w)
+	handlePostLogin := func(w http.ResponseWriter, r *http.Request) {
+		inlineUser, err := loadInlineUser(r)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get session id: %w", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		user := createUser(SessionId, inlineUser.Name)
-
-		if err := PutData(ctx, usersKV, user.SessionId, user); err != nil {
-			return nil, fmt.Errorf("failed to put user data: %w", err)
+		if !userValidation(inlineUser) || !passwordValidation(inlineUser) {
+			http.Error(w, "invalid name or password", http.StatusBadRequest)
+			return
 		}
 
-		return user, nil
-	}
-
-	handlePostLogin := func(w http.ResponseWriter, r *http.Request) {
-		inlineUser, err := loadInlineUser(r)
+		user, err := service.login(r.Context(), inlineUser.Name, inlineUser.Password)
+		if errors.Is(err, errBadCredentials) {
+			sse := datastar.NewSSE(w, r)
+			sse.ExecuteScript("alert('Invalid name or password.');")
+			return
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if _, err := userSession(w, r, inlineUser); err != nil {
+		if err := saveSessionId(sessionStore, r, w, user.SessionId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Visitors who arrived through an invite link go on to the game.
+		invite, err := popPendingInvite(sessionStore, r, w)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		sse := datastar.NewSSE(w, r)
+		if invite != "" {
+			sse.Redirect("/join/" + invite)
+			return
+		}
 		sse.Redirect("/dashboard")
 	}
 
 	router.Route("/api/index", func(indexRouter chi.Router) {
 		indexRouter.Get("/", handleGetLoginComponent)
+		// Validation posts the signals so the password never ends up in a URL.
+		indexRouter.Post("/", handleGetLoginComponent)
 		indexRouter.Post("/login", handlePostLogin)
 	})
 
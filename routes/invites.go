@@ -0,0 +1,136 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+var (
+	errGameFull    = errors.New("game is full")
+	errSeatTaken   = errors.New("seat was taken concurrently")
+	errGamePrivate = errors.New("game is private")
+)
+
+// newInviteCode returns a random, unguessable invite code.
+func newInviteCode() string {
+	b := make([]byte, 10)
+	rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// visibleTo reports whether gameLobby is listed on the dashboard of
+// sessionId. Private games are only listed for the players seated in them.
+func visibleTo(gameLobby *components.GameLobby, sessionId string) bool {
+	return !gameLobby.Private || gameLobby.HostId == sessionId || gameLobby.ChallengerId == sessionId
+}
+
+// takeSeat seats sessionId as the challenger of the game stored under id and
+// starts the clock of the player to move. Private games can only be joined
+// through their invite.
+func takeSeat(ctx context.Context, repos *store.Repos, id, sessionId string, invited bool) error {
+	gameLobby, revision, err := repos.Lobbies.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if sessionId == gameLobby.HostId || sessionId == gameLobby.ChallengerId {
+		return nil
+	}
+	if gameLobby.Private && !invited {
+		return errGamePrivate
+	}
+	if gameLobby.ChallengerId != "" {
+		return errGameFull
+	}
+
+	gameLobby.ChallengerId = sessionId
+	if _, err := repos.Lobbies.Update(ctx, id, *gameLobby, revision); err != nil {
+		return fmt.Errorf("%w: %w", errSeatTaken, err)
+	}
+
+	if err := startClock(ctx, repos, id); err != nil {
+		log.Printf("Failed to start the clock of game %s: %v", id, err)
+	}
+	return nil
+}
+
+// startClock starts the clock of the player to move in the game stored under
+// id, now that both seats are taken.
+func startClock(ctx context.Context, repos *store.Repos, id string) error {
+	var engine game.Engine
+
+	now := time.Now().UTC()
+	_, err := store.Modify(ctx, repos.Boards, id, func(gameState *components.GameState) error {
+		*gameState = engine.StartClock(*gameState, now)
+		return nil
+	})
+	return err
+}
+
+func setupInviteRoute(router chi.Router, sessionStore sessions.Store, repos *store.Repos) error {
+	handleJoinInvite := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		code := chi.URLParam(r, "code")
+		if code == "" {
+			http.Error(w, "missing 'code' parameter", http.StatusBadRequest)
+			return
+		}
+
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if sessionId == "" {
+			if err := setPendingInvite(sessionStore, r, w, code); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		invite, _, err := repos.Invites.Get(ctx, code)
+		if err != nil {
+			http.Error(w, "This invite link is not valid.", http.StatusNotFound)
+			return
+		}
+		if !invite.ExpiresAt.IsZero() && time.Now().After(invite.ExpiresAt) {
+			http.Error(w, "This invite link has expired.", http.StatusGone)
+			return
+		}
+
+		switch err := takeSeat(ctx, repos, invite.GameId, sessionId, true); {
+		case err == nil:
+		case errors.Is(err, errGameFull), errors.Is(err, errSeatTaken):
+			http.Error(w, "Another player has already joined. Game is full.", http.StatusConflict)
+			return
+		case errors.Is(err, store.ErrNotFound):
+			http.Error(w, "This game no longer exists.", http.StatusNotFound)
+			return
+		default:
+			log.Printf("Failed to join game %s with invite: %v", invite.GameId, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/game/"+invite.GameId, http.StatusSeeOther)
+	}
+
+	router.Get("/join/{code}", handleJoinInvite)
+
+	return nil
+}
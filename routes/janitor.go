@@ -0,0 +1,254 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/bot"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	// defaultJanitorGrace is how long the players of a lobby may all be
+	// disconnected before it is removed, and how long a challenger may be
+	// gone before the seat is freed.
+	defaultJanitorGrace = 5 * time.Minute
+	// defaultJanitorUserGrace is how long a session may go without any
+	// connection before its user is removed.
+	defaultJanitorUserGrace = 30 * time.Minute
+	janitorInterval         = 30 * time.Second
+)
+
+// errSeatChanged aborts freeing a seat that someone else took meanwhile.
+var errSeatChanged = errors.New("seat changed")
+
+// janitorConfig holds the grace periods of the janitor.
+type janitorConfig struct {
+	Grace     time.Duration
+	UserGrace time.Duration
+}
+
+// startJanitor removes what players left behind by closing their browser
+// instead of logging out: lobbies nobody has open, challenger seats of
+// players who are gone and users whose sessions went quiet. It also removes
+// invites that expired or whose game is gone. Sessions count
+// as connected while they have a page or an event stream open, as recorded
+// in the presence bucket, and when they last made a request to one of the
+// APIs.
+//
+// Every replica runs a janitor. The removals are idempotent and seats are
+// freed at the revision they were read at, so janitors do not get in each
+// other's way.
+func startJanitor(ctx context.Context, repos *store.Repos, config janitorConfig) error {
+	sweep, err := newJanitorSweep(ctx, repos, config, time.Now())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				sweep(now)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// newJanitorSweep returns a sweep of the janitor, which remembers the
+// sessions it saw across sweeps. Nothing is known about sessions from before
+// started, so they get the full grace period from then on.
+func newJanitorSweep(ctx context.Context, repos *store.Repos, config janitorConfig, started time.Time) (func(now time.Time), error) {
+	if config.Grace <= 0 {
+		return nil, fmt.Errorf("janitor grace period must be positive, got %v", config.Grace)
+	}
+	// Users outlive their lobbies, whose cleanup goes through the hosts.
+	config.UserGrace = max(config.UserGrace, config.Grace)
+
+	lastSeen := map[string]time.Time{}
+	seen := func(sessionId string) time.Time {
+		if at, ok := lastSeen[sessionId]; ok {
+			return at
+		}
+		return started
+	}
+
+	freeSeat := func(gameLobby *components.GameLobby) error {
+		challengerId := gameLobby.ChallengerId
+		_, err := store.Modify(ctx, repos.Lobbies, gameLobby.Id, func(gameLobby *components.GameLobby) error {
+			if gameLobby.ChallengerId != challengerId {
+				return errSeatChanged
+			}
+			gameLobby.ChallengerId = ""
+			return nil
+		})
+		return err
+	}
+
+	sweepLobbies := func(now time.Time) {
+		keys, err := repos.Lobbies.Keys(ctx)
+		if err != nil {
+			log.Printf("Janitor failed to list game lobbies: %v", err)
+			return
+		}
+
+		// gone reports whether a seated player vanished: logged out, or
+		// disconnected for the grace period.
+		gone := func(sessionId string) bool {
+			if now.Sub(seen(sessionId)) > config.Grace {
+				return true
+			}
+			_, _, err := repos.Users.Get(ctx, sessionId)
+			return errors.Is(err, store.ErrNotFound)
+		}
+
+		for _, key := range keys {
+			gameLobby, _, err := repos.Lobbies.Get(ctx, key)
+			if err != nil {
+				continue // Removed since the keys were listed.
+			}
+
+			_, isBot := bot.FromId(gameLobby.ChallengerId)
+			hasChallenger := gameLobby.ChallengerId != "" && !isBot
+
+			switch {
+			case gone(gameLobby.HostId) && (!hasChallenger || gone(gameLobby.ChallengerId)):
+				if err := removeGame(ctx, repos, gameLobby.Id); err != nil {
+					log.Printf("Janitor failed to remove abandoned game %s: %v", gameLobby.Id, err)
+					continue
+				}
+				log.Printf("Janitor removed game %s (%s), no player connected for %v", gameLobby.Id, gameLobby.Name, config.Grace)
+
+			case hasChallenger && gone(gameLobby.ChallengerId):
+				err := freeSeat(gameLobby)
+				switch {
+				case err == nil:
+					log.Printf("Janitor freed the challenger seat of game %s held by %s", gameLobby.Id, gameLobby.ChallengerId)
+				case errors.Is(err, errSeatChanged), errors.Is(err, store.ErrNotFound):
+				default:
+					log.Printf("Janitor failed to free the challenger seat of game %s: %v", gameLobby.Id, err)
+				}
+			}
+		}
+	}
+
+	sweepUsers := func(now time.Time) {
+		keys, err := repos.Users.Keys(ctx)
+		if err != nil {
+			log.Printf("Janitor failed to list users: %v", err)
+			return
+		}
+
+		for _, sessionId := range keys {
+			// Bots never connect, but the games they play need their users.
+			if _, isBot := bot.FromId(sessionId); isBot {
+				continue
+			}
+			idle := now.Sub(seen(sessionId))
+			if idle <= config.UserGrace {
+				continue
+			}
+			if err := repos.Users.Delete(ctx, sessionId); err != nil {
+				log.Printf("Janitor failed to remove user %s: %v", sessionId, err)
+				continue
+			}
+			log.Printf("Janitor removed user %s, not connected for %v", sessionId, idle.Round(time.Second))
+		}
+	}
+
+	// orphans are the invites whose game was missing on the last sweep.
+	// Games are stored after their invite, so an invite is only removed for
+	// a missing game on the second sweep in a row.
+	orphans := map[string]bool{}
+
+	sweepInvites := func(now time.Time) {
+		keys, err := repos.Invites.Keys(ctx)
+		if err != nil {
+			log.Printf("Janitor failed to list invites: %v", err)
+			return
+		}
+
+		missing := map[string]bool{}
+		for _, code := range keys {
+			invite, _, err := repos.Invites.Get(ctx, code)
+			if err != nil {
+				continue // Removed since the keys were listed.
+			}
+
+			expired := !invite.ExpiresAt.IsZero() && now.After(invite.ExpiresAt)
+			if !expired {
+				_, _, err := repos.Lobbies.Get(ctx, invite.GameId)
+				if !errors.Is(err, store.ErrNotFound) {
+					continue
+				}
+				missing[code] = true
+				if !orphans[code] {
+					continue
+				}
+			}
+
+			if err := repos.Invites.Purge(ctx, code); err != nil {
+				log.Printf("Janitor failed to remove invite of game %s: %v", invite.GameId, err)
+				continue
+			}
+			delete(missing, code)
+			log.Printf("Janitor removed invite of game %s", invite.GameId)
+		}
+		orphans = missing
+	}
+
+	// seenRequests records when sessions last made a request to one of the
+	// APIs.
+	seenRequests := func() {
+		keys, err := repos.Users.Keys(ctx)
+		if err != nil {
+			log.Printf("Janitor failed to list users: %v", err)
+			return
+		}
+		for _, sessionId := range keys {
+			user, _, err := repos.Users.Get(ctx, sessionId)
+			if err != nil {
+				continue // Removed since the keys were listed.
+			}
+			if user.LastSeenAt.After(seen(sessionId)) {
+				lastSeen[sessionId] = user.LastSeenAt
+			}
+		}
+	}
+
+	sweep := func(now time.Time) {
+		presence, err := loadPresence(ctx, repos, func(string) bool { return true })
+		if err != nil {
+			log.Printf("Janitor failed to load presence: %v", err)
+			return
+		}
+		for sessionId := range presence.online(now) {
+			lastSeen[sessionId] = now
+		}
+		seenRequests()
+
+		sweepLobbies(now)
+		sweepUsers(now)
+		sweepInvites(now)
+
+		// Sessions gone for longer than every grace period were swept.
+		for sessionId, at := range lastSeen {
+			if now.Sub(at) > config.UserGrace {
+				delete(lastSeen, sessionId)
+			}
+		}
+	}
+
+	return sweep, nil
+}
@@ -0,0 +1,136 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// TestJanitorKeepsMicroSessions checks that clients of the NATS API, who
+// never keep a connection open, stay connected as long as they send requests.
+func TestJanitorKeepsMicroSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ns := startNATS(t)
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %v", err)
+	}
+	defer nc.Close()
+
+	service, _ := newTestService()
+	if err := startMicroService(ctx, nc, service); err != nil {
+		t.Fatalf("startMicroService() error = %v", err)
+	}
+
+	request := func(subject string, request, response any) {
+		t.Helper()
+		data, err := json.Marshal(request)
+		if err != nil {
+			t.Fatalf("failed to marshal JSON: %v", err)
+		}
+		msg, err := nc.Request(subject, data, 5*time.Second)
+		if err != nil {
+			t.Fatalf("request to %s failed: %v", subject, err)
+		}
+		if code := msg.Header.Get(micro.ErrorCodeHeader); code != "" {
+			t.Fatalf("request to %s = %s %s", subject, code, msg.Header.Get(micro.ErrorHeader))
+		}
+		if err := json.Unmarshal(msg.Data, response); err != nil {
+			t.Fatalf("failed to unmarshal response of %s: %v", subject, err)
+		}
+	}
+
+	var login api.LoginResponse
+	request(api.LoginSubject, api.LoginRequest{Name: "alice", Password: "secret"}, &login)
+	var created api.GameResponse
+	request(api.CreateSubject, api.CreateRequest{SessionId: login.SessionId}, &created)
+
+	idle := mustLogin(t, service, "bob")
+	idleLobby, err := service.create(ctx, idle, defaultGameSettings())
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+
+	// Nobody has had a connection open since the janitor started, longer
+	// than any grace period ago.
+	config := janitorConfig{Grace: time.Minute, UserGrace: time.Minute}
+	sweep, err := newJanitorSweep(ctx, service.repos, config, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("newJanitorSweep() error = %v", err)
+	}
+	sweep(time.Now())
+
+	if _, _, err := service.repos.Users.Get(ctx, login.SessionId); err != nil {
+		t.Fatalf("user of the NATS client was removed: %v", err)
+	}
+	if _, _, err := service.repos.Lobbies.Get(ctx, created.Lobby.Id); err != nil {
+		t.Fatalf("game of the NATS client was removed: %v", err)
+	}
+
+	if _, _, err := service.repos.Users.Get(ctx, idle); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("idle user error = %v, want ErrNotFound", err)
+	}
+	if _, _, err := service.repos.Lobbies.Get(ctx, idleLobby.Id); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("game of the idle user error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestJanitorRemovesInvites(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestService()
+	host := mustLogin(t, service, "alice")
+
+	settings := defaultGameSettings()
+	settings.Private = true
+	lasting, err := service.create(ctx, host, settings)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	settings.InviteTTL = 1
+	expiring, err := service.create(ctx, host, settings)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	orphan := components.Invite{Code: "ORPHAN", GameId: "gone"}
+	if _, err := service.repos.Invites.Create(ctx, orphan.Code, orphan); err != nil {
+		t.Fatalf("failed to store invite: %v", err)
+	}
+
+	now := time.Now()
+	config := janitorConfig{Grace: time.Hour, UserGrace: time.Hour}
+	sweep, err := newJanitorSweep(ctx, service.repos, config, now)
+	if err != nil {
+		t.Fatalf("newJanitorSweep() error = %v", err)
+	}
+	exists := func(code string) bool {
+		_, _, err := service.repos.Invites.Get(ctx, code)
+		return err == nil
+	}
+
+	// The invite of a game that is being created has no game yet either.
+	sweep(now.Add(2 * time.Minute))
+	if exists(expiring.InviteCode) {
+		t.Fatal("expired invite was kept")
+	}
+	if !exists(orphan.Code) {
+		t.Fatal("invite without a game was removed on the first sweep")
+	}
+
+	sweep(now.Add(3 * time.Minute))
+	if exists(orphan.Code) {
+		t.Fatal("invite without a game was kept")
+	}
+	if !exists(lasting.InviteCode) {
+		t.Fatal("invite without an expiry was removed while its game exists")
+	}
+}
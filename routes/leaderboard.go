@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/pages"
+	datastar "github.com/starfederation/datastar/sdk/go"
+)
+
+// leaderboardSize is how many players the leaderboard shows.
+const leaderboardSize = 50
+
+func setupLeaderboardRoute(router chi.Router, sessionStore sessions.Store, repos *store.Repos) error {
+	currentUser := func(r *http.Request) (*components.User, error) {
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil {
+			return nil, err
+		}
+		if sessionId == "" {
+			return nil, fmt.Errorf("no session")
+		}
+		user, _, err := repos.Users.Get(r.Context(), sessionId)
+		return user, err
+	}
+
+	handleLeaderboardPage := func(w http.ResponseWriter, r *http.Request) {
+		user, err := currentUser(r)
+		if err != nil {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		pages.Leaderboard(user).Render(r.Context(), w)
+	}
+
+	router.Get("/leaderboard", handleLeaderboardPage)
+
+	// API
+
+	ranking := func(players map[string]components.Player) []components.Player {
+		ranked := make([]components.Player, 0, len(players))
+		for _, player := range players {
+			ranked = append(ranked, player)
+		}
+		slices.SortFunc(ranked, func(a, b components.Player) int {
+			if a.Rating != b.Rating {
+				return b.Rating - a.Rating
+			}
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		})
+		if len(ranked) > leaderboardSize {
+			ranked = ranked[:leaderboardSize]
+		}
+		return ranked
+	}
+
+	handleUpdates := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		user, err := currentUser(r)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		watcher, err := repos.Players.WatchAll(ctx)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to start watcher: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer watcher.Stop()
+
+		sse := datastar.NewSSE(w, r)
+
+		// Render once the initial values are in, then again on every change.
+		historicalMode := true
+		players := map[string]components.Player{}
+		render := func() {
+			if err := sse.MergeFragmentTempl(components.Leaderboard(ranking(players), user.PlayerId)); err != nil {
+				sse.ConsoleError(err)
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					log.Println("Leaderboard watcher updates channel closed")
+					return
+				}
+
+				if entry == nil {
+					historicalMode = false
+					render()
+					continue
+				}
+
+				switch entry.Op {
+				case store.OpPut:
+					players[entry.Key] = entry.Value
+				default:
+					delete(players, entry.Key)
+				}
+
+				if !historicalMode {
+					render()
+				}
+			}
+		}
+	}
+
+	router.Get("/api/leaderboard/updates", handleUpdates)
+
+	return nil
+}
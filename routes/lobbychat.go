@@ -0,0 +1,233 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+	"golang.org/x/time/rate"
+)
+
+const (
+	lobbyChatStream = "lobbyChat"
+	// lobbyChatHistory bounds the messages and deletions kept by the
+	// lobbyChat stream, which are replayed to every dashboard.
+	lobbyChatHistory = 200
+
+	lobbyChatMessageSubject = "ttt.lobby.chat.message"
+	lobbyChatDeleteSubject  = "ttt.lobby.chat.delete"
+
+	// A session may send lobbyChatBurst messages at once, then one every
+	// lobbyChatInterval.
+	lobbyChatInterval = 3 * time.Second
+	lobbyChatBurst    = 5
+)
+
+var (
+	errChatRateLimited = errors.New("chat messages are sent too fast")
+	errNotAdmin        = errors.New("only admins can do this")
+)
+
+// lobbyChatDeletion is published when an admin deletes the message with
+// Sequence, so open dashboards drop it as well.
+type lobbyChatDeletion struct {
+	Sequence uint64 `json:"sequence"`
+}
+
+// lobbyChatView receives the dashboard chat from lobbyChat.watch.
+type lobbyChatView struct {
+	// replay gets the stored messages once, without the deleted ones.
+	replay  func(messages []components.ChatMessage) error
+	message func(message components.ChatMessage) error
+	deleted func(sequence uint64) error
+}
+
+// chatLimiter limits the rate of chat messages per session. Limits are kept
+// in memory, so every instance counts the messages it receives.
+type chatLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	limit    rate.Limit
+	burst    int
+	pruned   time.Time
+}
+
+func newChatLimiter(interval time.Duration, burst int) *chatLimiter {
+	return &chatLimiter{
+		limiters: map[string]*rate.Limiter{},
+		limit:    rate.Every(interval),
+		burst:    burst,
+	}
+}
+
+// allow reports whether sessionId may send a message now.
+func (l *chatLimiter) allow(sessionId string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A limiter that filled up again is no different from a new one.
+	now := time.Now()
+	if now.Sub(l.pruned) > time.Minute {
+		for key, limiter := range l.limiters {
+			if limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.limiters, key)
+			}
+		}
+		l.pruned = now
+	}
+
+	limiter, ok := l.limiters[sessionId]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[sessionId] = limiter
+	}
+	return limiter.AllowN(now, 1)
+}
+
+// lobbyChat is the chat room of the dashboard, kept in the lobbyChat
+// stream.
+type lobbyChat struct {
+	js      jetstream.JetStream
+	repos   *store.Repos
+	filter  chatFilter
+	limiter *chatLimiter
+	admins  admins
+}
+
+func newLobbyChat(js jetstream.JetStream, repos *store.Repos, filter chatFilter, admins admins) *lobbyChat {
+	return &lobbyChat{
+		js:      js,
+		repos:   repos,
+		filter:  filter,
+		limiter: newChatLimiter(lobbyChatInterval, lobbyChatBurst),
+		admins:  admins,
+	}
+}
+
+// send publishes text to the dashboard chat on behalf of sessionId.
+func (c *lobbyChat) send(ctx context.Context, sessionId, text string) error {
+	text, err := cleanChatText(text)
+	if err != nil {
+		return err
+	}
+
+	user, _, err := c.repos.Users.Get(ctx, sessionId)
+	if err != nil {
+		return err
+	}
+
+	if !c.limiter.allow(sessionId) {
+		return errChatRateLimited
+	}
+
+	message := components.ChatMessage{
+		Name:      user.Name,
+		Text:      text,
+		Timestamp: time.Now().UTC(),
+	}
+	return publishChat(ctx, c.js, lobbyChatMessageSubject, message, c.filter)
+}
+
+// remove deletes the message with sequence from the dashboard chat. Only
+// admins may remove messages.
+func (c *lobbyChat) remove(ctx context.Context, sessionId string, sequence uint64) error {
+	user, _, err := c.repos.Users.Get(ctx, sessionId)
+	if err != nil {
+		return err
+	}
+	if !c.admins.has(user) {
+		return errNotAdmin
+	}
+
+	stream, err := c.js.Stream(ctx, lobbyChatStream)
+	if err != nil {
+		return fmt.Errorf("failed to get lobby chat stream: %w", err)
+	}
+
+	msg, err := stream.GetMsg(ctx, sequence)
+	if errors.Is(err, jetstream.ErrMsgNotFound) || (err == nil && msg.Subject != lobbyChatMessageSubject) {
+		return store.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get lobby chat message: %w", err)
+	}
+
+	if err := stream.DeleteMsg(ctx, sequence); err != nil {
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return store.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete lobby chat message: %w", err)
+	}
+
+	bytes, err := json.Marshal(lobbyChatDeletion{Sequence: sequence})
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	if _, err := c.js.Publish(ctx, lobbyChatDeleteSubject, bytes); err != nil {
+		return fmt.Errorf("failed to publish lobby chat deletion: %w", err)
+	}
+	return nil
+}
+
+// watch passes the stored dashboard chat to view, then every new message and
+// deletion until ctx is done.
+func (c *lobbyChat) watch(ctx context.Context, view lobbyChatView) error {
+	decodeDeletion := func(msg jetstream.Msg) (uint64, error) {
+		var deletion lobbyChatDeletion
+		if err := json.Unmarshal(msg.Data(), &deletion); err != nil {
+			return 0, fmt.Errorf("failed to unmarshal lobby chat deletion: %w", err)
+		}
+		return deletion.Sequence, nil
+	}
+
+	return followStream(ctx, c.js, lobbyChatStream, "ttt.lobby.chat.>",
+		func(msgs []jetstream.Msg) error {
+			var messages []components.ChatMessage
+			for _, msg := range msgs {
+				switch msg.Subject() {
+				case lobbyChatMessageSubject:
+					message, err := decodeChat(msg)
+					if err != nil {
+						return err
+					}
+					messages = append(messages, message)
+				case lobbyChatDeleteSubject:
+					// Deleted messages are usually gone from the stream
+					// already, unless the deletion raced the replay.
+					sequence, err := decodeDeletion(msg)
+					if err != nil {
+						return err
+					}
+					messages = slices.DeleteFunc(messages, func(message components.ChatMessage) bool {
+						return message.Sequence == sequence
+					})
+				}
+			}
+			return view.replay(messages)
+		},
+		func(msg jetstream.Msg) error {
+			switch msg.Subject() {
+			case lobbyChatMessageSubject:
+				message, err := decodeChat(msg)
+				if err != nil {
+					return err
+				}
+				return view.message(message)
+			case lobbyChatDeleteSubject:
+				sequence, err := decodeDeletion(msg)
+				if err != nil {
+					return err
+				}
+				return view.deleted(sequence)
+			}
+			return nil
+		},
+	)
+}
@@ -0,0 +1,247 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	matchQueueTTL = 10 * time.Minute
+	matchInterval = 2 * time.Second
+	// matchBand is the widest rating gap accepted right away. It grows by
+	// matchBandGrowth for every matchBandInterval both players have waited,
+	// so nobody waits forever for an evenly rated opponent.
+	matchBand         = 100
+	matchBandGrowth   = 100
+	matchBandInterval = 10 * time.Second
+	// A pair that failed to match is retried after matchRetryDelay, doubling
+	// with every failure up to matchRetryMaxDelay.
+	matchRetryDelay    = 10 * time.Second
+	matchRetryMaxDelay = 5 * time.Minute
+)
+
+// errQueueEntryGone reports a queued player whose user no longer exists.
+var errQueueEntryGone = errors.New("queued user is gone")
+
+// matchBackoff holds the failed attempts of a queued player.
+type matchBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// withinBand reports whether two queued players are close enough in rating
+// to be paired at now.
+func withinBand(a, b components.QueueEntry, now time.Time) bool {
+	waited := now.Sub(a.JoinedAt)
+	if w := now.Sub(b.JoinedAt); w < waited {
+		waited = w
+	}
+	band := matchBand + matchBandGrowth*int(waited/matchBandInterval)
+	gap := a.Rating - b.Rating
+	if gap < 0 {
+		gap = -gap
+	}
+	return gap <= band
+}
+
+// startMatchmaker pairs players waiting in the matchQueue bucket. For every
+// pair it creates a game the same way handleCreate does and then marks both
+// queue entries with the game id; the players' dashboards watch their entry
+// and redirect to the game.
+func startMatchmaker(ctx context.Context, repos *store.Repos) error {
+	watcher, err := repos.MatchQueue.WatchAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start matchmaker watcher: %w", err)
+	}
+
+	var engine game.Engine
+	waiting := map[string]*store.Entry[components.QueueEntry]{}
+	backoffs := map[string]*matchBackoff{}
+
+	// forget stops considering a queue entry.
+	forget := func(key string) {
+		delete(waiting, key)
+		delete(backoffs, key)
+	}
+
+	// backOff delays the next attempt of the players in a failed match, so
+	// an error that persists is not retried and logged on every pass.
+	backOff := func(now time.Time, keys ...string) {
+		for _, key := range keys {
+			backoff, ok := backoffs[key]
+			if !ok {
+				backoff = &matchBackoff{}
+				backoffs[key] = backoff
+			}
+			delay := min(matchRetryDelay<<backoff.failures, matchRetryMaxDelay)
+			backoff.failures++
+			backoff.until = now.Add(delay)
+		}
+	}
+
+	// dropGone removes the queue entries of players whose user is gone, who
+	// logged out or were removed by the janitor, since they can never play.
+	dropGone := func(entries ...*store.Entry[components.QueueEntry]) error {
+		var gone error
+		for _, entry := range entries {
+			_, _, err := repos.Users.Get(ctx, entry.Value.SessionId)
+			if !errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			if err := repos.MatchQueue.Delete(ctx, entry.Key); err != nil {
+				log.Printf("Failed to drop %s from the match queue: %v", entry.Value.SessionId, err)
+			} else {
+				log.Printf("Dropped %s from the match queue, the user is gone", entry.Value.SessionId)
+			}
+			forget(entry.Key)
+			gone = errQueueEntryGone
+		}
+		return gone
+	}
+
+	claim := func(key string, queued components.QueueEntry, revision uint64, gameId string) error {
+		queued.GameId = gameId
+		_, err := repos.MatchQueue.Update(ctx, key, queued, revision)
+		return err
+	}
+
+	// match creates a game for host and challenger. The queue entries are
+	// only claimed once the game exists, and the game is removed again if
+	// either player left the queue in the meantime.
+	match := func(hostEntry, challengerEntry *store.Entry[components.QueueEntry]) error {
+		host, challenger := hostEntry.Value, challengerEntry.Value
+
+		if err := dropGone(hostEntry, challengerEntry); err != nil {
+			return err
+		}
+
+		id, name := generateGameDetails()
+		gameState, err := engine.NewGame(id, components.GameSettings{
+			Mode:      components.ModeClassic,
+			BoardSize: game.DefaultSize,
+			WinLength: game.DefaultSize,
+		})
+		if err != nil {
+			return err
+		}
+
+		gameLobby := createGameLobby(name, host.SessionId, gameState, false)
+		gameLobby.ChallengerId = challenger.SessionId
+
+		if err := storeGame(ctx, repos, gameLobby, gameState); err != nil {
+			return err
+		}
+
+		discard := func() {
+			if err := removeGame(ctx, repos, id); err != nil {
+				log.Printf("Failed to discard game %s: %v", id, err)
+			}
+		}
+
+		if err := claim(hostEntry.Key, host, hostEntry.Revision, id); err != nil {
+			discard()
+			return err
+		}
+		if err := claim(challengerEntry.Key, challenger, challengerEntry.Revision, id); err != nil {
+			discard()
+			// Put the host back in the queue, keeping their place.
+			if _, revision, err := repos.MatchQueue.Get(ctx, hostEntry.Key); err == nil {
+				claim(hostEntry.Key, host, revision, "")
+			}
+			return err
+		}
+
+		log.Printf("Matched %s and %s in game %s", host.SessionId, challenger.SessionId, id)
+		return nil
+	}
+
+	pair := func() {
+		now := time.Now()
+
+		candidates := make([]*store.Entry[components.QueueEntry], 0, len(waiting))
+		for _, entry := range waiting {
+			candidates = append(candidates, entry)
+		}
+		slices.SortFunc(candidates, func(a, b *store.Entry[components.QueueEntry]) int {
+			return a.Value.JoinedAt.Compare(b.Value.JoinedAt)
+		})
+
+		matched := map[string]bool{}
+		backingOff := func(entry *store.Entry[components.QueueEntry]) bool {
+			backoff, ok := backoffs[entry.Key]
+			return ok && now.Before(backoff.until)
+		}
+
+		for i, a := range candidates {
+			if matched[a.Key] || backingOff(a) {
+				continue
+			}
+			for _, b := range candidates[i+1:] {
+				if matched[b.Key] || backingOff(b) || !withinBand(a.Value, b.Value, now) {
+					continue
+				}
+				if err := match(a, b); err != nil {
+					switch {
+					case errors.Is(err, errQueueEntryGone):
+						// The entries of the missing users were dropped.
+					case errors.Is(err, store.ErrConflict):
+						// The watcher brings the changed entries.
+					default:
+						log.Printf("Failed to match %s and %s: %v", a.Value.SessionId, b.Value.SessionId, err)
+						backOff(now, a.Key, b.Key)
+					}
+					break
+				}
+				matched[a.Key] = true
+				matched[b.Key] = true
+				break
+			}
+		}
+
+		for key := range matched {
+			forget(key)
+		}
+	}
+
+	go func() {
+		defer watcher.Stop()
+
+		ticker := time.NewTicker(matchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pair()
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					log.Println("Matchmaker watcher updates channel closed")
+					return
+				}
+				if entry == nil {
+					pair()
+					continue
+				}
+
+				if entry.Op != store.OpPut || entry.Value.GameId != "" {
+					forget(entry.Key)
+					continue
+				}
+				waiting[entry.Key] = entry
+				pair()
+			}
+		}
+	}()
+
+	return nil
+}
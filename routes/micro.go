@@ -0,0 +1,239 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// microQueueGroup spreads requests over every replica running the service.
+const microQueueGroup = "tictactoe"
+
+// startMicroService exposes the game service on the subjects of the api
+// package. It runs until ctx is done.
+func startMicroService(ctx context.Context, nc *nats.Conn, service *gameService) error {
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:        api.ServiceName,
+		Version:     api.ServiceVersion,
+		Description: "Tic-tac-toe lobbies and games",
+		QueueGroup:  microQueueGroup,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add micro service: %w", err)
+	}
+
+	// authenticate loads the user behind a session, so requests can only be
+	// made on behalf of sessions that logged in. Clients of the service keep
+	// no connection open, so their requests are what keeps their sessions
+	// and games from being cleaned up.
+	authenticate := func(ctx context.Context, sessionId string) error {
+		user, _, err := service.repos.Users.Get(ctx, sessionId)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				return errUnknownSession
+			}
+			return err
+		}
+		service.seen(ctx, user)
+		return nil
+	}
+
+	respondError := func(req micro.Request, err error) {
+		code, msg := serviceError(err)
+		if code == http.StatusInternalServerError {
+			log.Printf("Error handling %s: %v", req.Subject(), err)
+		}
+		req.Error(strconv.Itoa(code), msg, nil)
+	}
+
+	respondGame := func(ctx context.Context, req micro.Request, sessionId, id string) {
+		game, err := service.game(ctx, sessionId, id)
+		if err != nil {
+			respondError(req, err)
+			return
+		}
+		req.RespondJSON(game)
+	}
+
+	decode := func(req micro.Request, v any) bool {
+		if err := json.Unmarshal(req.Data(), v); err != nil {
+			req.Error(strconv.Itoa(http.StatusBadRequest), fmt.Sprintf("Invalid request: %v", err), nil)
+			return false
+		}
+		return true
+	}
+
+	handleLogin := func(ctx context.Context, req micro.Request) {
+		var request api.LoginRequest
+		if !decode(req, &request) {
+			return
+		}
+
+		user, err := service.login(ctx, request.Name, request.Password)
+		if err != nil {
+			respondError(req, err)
+			return
+		}
+		req.RespondJSON(api.LoginResponse{SessionId: user.SessionId, Name: user.Name})
+	}
+
+	handleCreate := func(ctx context.Context, req micro.Request) {
+		settings := api.GameSettings(defaultGameSettings())
+		request := api.CreateRequest{Settings: &settings}
+		if !decode(req, &request) {
+			return
+		}
+		if request.Settings == nil {
+			request.Settings = &settings
+		}
+
+		if err := authenticate(ctx, request.SessionId); err != nil {
+			respondError(req, err)
+			return
+		}
+
+		gameLobby, err := service.create(ctx, request.SessionId, components.GameSettings(*request.Settings))
+		if err != nil {
+			respondError(req, err)
+			return
+		}
+		respondGame(ctx, req, request.SessionId, gameLobby.Id)
+	}
+
+	handleJoin := func(ctx context.Context, req micro.Request) {
+		var request api.GameRequest
+		if !decode(req, &request) {
+			return
+		}
+		if err := authenticate(ctx, request.SessionId); err != nil {
+			respondError(req, err)
+			return
+		}
+
+		if err := service.join(ctx, request.SessionId, request.GameId); err != nil {
+			respondError(req, err)
+			return
+		}
+		respondGame(ctx, req, request.SessionId, request.GameId)
+	}
+
+	handleMove := func(ctx context.Context, req micro.Request) {
+		var request api.MoveRequest
+		if !decode(req, &request) {
+			return
+		}
+		if err := authenticate(ctx, request.SessionId); err != nil {
+			respondError(req, err)
+			return
+		}
+
+		if err := service.move(ctx, request.SessionId, request.GameId, request.Board, request.Cell); err != nil {
+			respondError(req, err)
+			return
+		}
+		respondGame(ctx, req, request.SessionId, request.GameId)
+	}
+
+	handleReset := func(ctx context.Context, req micro.Request) {
+		var request api.GameRequest
+		if !decode(req, &request) {
+			return
+		}
+		if err := authenticate(ctx, request.SessionId); err != nil {
+			respondError(req, err)
+			return
+		}
+
+		if err := service.reset(ctx, request.SessionId, request.GameId); err != nil {
+			respondError(req, err)
+			return
+		}
+		respondGame(ctx, req, request.SessionId, request.GameId)
+	}
+
+	handleLeave := func(ctx context.Context, req micro.Request) {
+		var request api.GameRequest
+		if !decode(req, &request) {
+			return
+		}
+		if err := authenticate(ctx, request.SessionId); err != nil {
+			respondError(req, err)
+			return
+		}
+
+		left, err := service.leave(ctx, request.SessionId, request.GameId)
+		if err != nil {
+			respondError(req, err)
+			return
+		}
+		req.RespondJSON(api.LeaveResponse{Left: left})
+	}
+
+	handleList := func(ctx context.Context, req micro.Request) {
+		var request api.ListRequest
+		if !decode(req, &request) {
+			return
+		}
+		if err := authenticate(ctx, request.SessionId); err != nil {
+			respondError(req, err)
+			return
+		}
+
+		lobbies, err := service.list(ctx, request.SessionId)
+		if err != nil {
+			respondError(req, err)
+			return
+		}
+		req.RespondJSON(api.ListResponse{Lobbies: lobbies})
+	}
+
+	endpoints := []struct {
+		name     string
+		subject  string
+		handler  func(context.Context, micro.Request)
+		request  string
+		response string
+	}{
+		{"login", api.LoginSubject, handleLogin, "LoginRequest", "LoginResponse"},
+		{"create", api.CreateSubject, handleCreate, "CreateRequest", "GameResponse"},
+		{"join", api.JoinSubject, handleJoin, "GameRequest", "GameResponse"},
+		{"move", api.MoveSubject, handleMove, "MoveRequest", "GameResponse"},
+		{"reset", api.ResetSubject, handleReset, "GameRequest", "GameResponse"},
+		{"leave", api.LeaveSubject, handleLeave, "GameRequest", "LeaveResponse"},
+		{"list", api.ListSubject, handleList, "ListRequest", "ListResponse"},
+	}
+
+	var errs []error
+	for _, endpoint := range endpoints {
+		errs = append(errs, svc.AddEndpoint(endpoint.name, micro.ContextHandler(ctx, endpoint.handler),
+			micro.WithEndpointSubject(endpoint.subject),
+			micro.WithEndpointMetadata(map[string]string{
+				"request":  "api." + endpoint.request,
+				"response": "api." + endpoint.response,
+			}),
+		))
+	}
+	if err := errors.Join(errs...); err != nil {
+		svc.Stop()
+		return fmt.Errorf("failed to add micro service endpoints: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := svc.Stop(); err != nil {
+			log.Printf("Error stopping micro service: %v", err)
+		}
+	}()
+
+	return nil
+}
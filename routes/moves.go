@@ -0,0 +1,444 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const moveStream = "gameMoves"
+
+var (
+	errSpectator = errors.New("spectators cannot play")
+	// errStaleMove is returned for a move that was not made on the current
+	// board, because another move or a reset came first.
+	errStaleMove = errors.New("move does not follow the current board")
+)
+
+// moveSubject is the subject the moves of a game are published on. Every
+// move is an event in the gameMoves stream, which the projector folds into
+// the game's board; anyone may subscribe to follow a game.
+func moveSubject(gameId string) string {
+	return fmt.Sprintf("ttt.game.%s.move", gameId)
+}
+
+// rejectionSubject is the subject the projector records the moves it
+// rejected on, so the history of a game can leave them out.
+func rejectionSubject(gameId string) string {
+	return fmt.Sprintf("ttt.game.%s.rejected", gameId)
+}
+
+// eventSubject is the subject events of a game other than moves are
+// published on, see components.EventForfeit and components.EventReset. They
+// go through the gameMoves stream like moves, so the projector folds every
+// change of a board in the order it happened.
+func eventSubject(gameId, event string) string {
+	return fmt.Sprintf("ttt.game.%s.%s", gameId, event)
+}
+
+// moveRejection records that the move stored under Sequence in the gameMoves
+// stream was not folded into its board.
+type moveRejection struct {
+	Sequence uint64 `json:"sequence"`
+	Reason   string `json:"reason"`
+}
+
+// moves publishes moves to the gameMoves stream and projects them onto the
+// game boards. HTTP handlers and server-side bots both go through it so they
+// share the same rules.
+type moves struct {
+	js      jetstream.JetStream
+	lobbies store.LobbyRepo
+	boards  store.BoardRepo
+	players *players
+}
+
+func newMoves(js jetstream.JetStream, repos *store.Repos) *moves {
+	return &moves{
+		js:      js,
+		lobbies: repos.Lobbies,
+		boards:  repos.Boards,
+		players: newPlayers(repos),
+	}
+}
+
+// play validates a move made by sessionId in the game stored under gameId
+// and publishes it to the game's subject. The board changes once the
+// projector folds the move in; validating here first lets the player hear
+// about an illegal move right away.
+func (m *moves) play(ctx context.Context, gameId, sessionId string, board, cell int) error {
+	gameLobby, _, err := m.lobbies.Get(ctx, gameId)
+	if err != nil {
+		return err
+	}
+
+	gameState, _, err := m.boards.Get(ctx, gameId)
+	if err != nil {
+		return err
+	}
+
+	record := components.MoveRecord{
+		GameId:    gameId,
+		Round:     gameState.Round,
+		Sequence:  gameState.Moves + 1,
+		SessionId: sessionId,
+		Player:    playerFor(gameLobby, gameState, sessionId),
+		Board:     board,
+		Cell:      cell,
+		Mode:      gameState.Mode,
+		Size:      gameState.Size,
+		WinLength: gameState.WinLength,
+		Timestamp: time.Now().UTC(),
+	}
+	if _, err := applyMove(gameLobby, gameState, record); err != nil {
+		return err
+	}
+
+	return m.record(ctx, record)
+}
+
+// applyMove checks that record is the next move of the game and returns the
+// board after it.
+func applyMove(gameLobby *components.GameLobby, gameState *components.GameState, record components.MoveRecord) (components.GameState, error) {
+	var engine game.Engine
+
+	if record.Round != gameState.Round || record.Sequence != gameState.Moves+1 {
+		return *gameState, errStaleMove
+	}
+
+	player := playerFor(gameLobby, gameState, record.SessionId)
+	if player == "" {
+		return *gameState, errSpectator
+	}
+	if record.Player != player {
+		return *gameState, game.ErrNotYourTurn
+	}
+	if deadline, ok := game.Deadline(*gameState); ok && record.Timestamp.After(deadline) {
+		return *gameState, game.ErrOutOfTime
+	}
+
+	next, err := engine.Apply(*gameState, game.Move{
+		Board:  record.Board,
+		Cell:   record.Cell,
+		Player: player,
+	})
+	if err != nil {
+		return *gameState, err
+	}
+	return engine.Stamp(next, player, record.Timestamp), nil
+}
+
+// forfeit publishes that the player to move in the game stored under gameId
+// ran out of time at now. It returns game.ErrClockRunning if they still have
+// time. The projector ends the game, unless a move made in time comes first.
+func (m *moves) forfeit(ctx context.Context, gameId string, now time.Time) error {
+	var engine game.Engine
+
+	gameLobby, _, err := m.lobbies.Get(ctx, gameId)
+	if err != nil {
+		return err
+	}
+
+	gameState, _, err := m.boards.Get(ctx, gameId)
+	if err != nil {
+		return err
+	}
+	if _, err := engine.Forfeit(*gameState, now); err != nil {
+		return err
+	}
+
+	record := eventRecord(gameState, components.EventForfeit, now)
+	record.Player = engine.Next(*gameState)
+	record.SessionId = gameLobby.HostId
+	if game.MarkOf(*gameState, components.SeatChallenger) == record.Player {
+		record.SessionId = gameLobby.ChallengerId
+	}
+	return m.recordEvent(ctx, record)
+}
+
+// eventRecord returns the record of event on the board gameState.
+func eventRecord(gameState *components.GameState, event string, now time.Time) components.MoveRecord {
+	return components.MoveRecord{
+		GameId:    gameState.Id,
+		Round:     gameState.Round,
+		Sequence:  gameState.Moves,
+		Mode:      gameState.Mode,
+		Size:      gameState.Size,
+		WinLength: gameState.WinLength,
+		Event:     event,
+		Timestamp: now,
+	}
+}
+
+// projectEvent folds an event other than a move into the board of its game.
+// Events made on a board that has changed since are stale.
+func (m *moves) projectEvent(ctx context.Context, gameLobby *components.GameLobby, record components.MoveRecord) error {
+	var engine game.Engine
+
+	gameState, revision, err := m.boards.Get(ctx, record.GameId)
+	if err != nil {
+		return err
+	}
+
+	var next components.GameState
+	switch record.Event {
+	case components.EventForfeit:
+		// A redelivered forfeit is already on the board.
+		if record.Round == gameState.Round && record.Sequence == gameState.Moves && record.Player == gameState.Forfeit {
+			return nil
+		}
+		if record.Round != gameState.Round || record.Sequence != gameState.Moves {
+			return errStaleMove
+		}
+		if next, err = engine.Forfeit(*gameState, record.Timestamp); err != nil {
+			return err
+		}
+
+	case components.EventReset:
+		// Every round is reset once, a later round means it already was.
+		if record.Round < gameState.Round {
+			return nil
+		}
+		if record.Round != gameState.Round || record.Sequence != gameState.Moves {
+			return errStaleMove
+		}
+		if gameState.Winner == "" {
+			return errGameRunning
+		}
+		next = engine.Reset(*gameState)
+		if gameLobby.ChallengerId != "" {
+			next = engine.StartClock(next, record.Timestamp)
+		}
+
+	default:
+		return fmt.Errorf("unknown event %q", record.Event)
+	}
+
+	if _, err := m.boards.Update(ctx, record.GameId, next, revision); err != nil {
+		return err
+	}
+
+	if record.Event == components.EventForfeit {
+		log.Printf("Game %s forfeited on time", record.GameId)
+		m.rate(ctx, gameLobby, next)
+	}
+	return nil
+}
+
+func (m *moves) rate(ctx context.Context, gameLobby *components.GameLobby, gameState components.GameState) {
+	if err := m.players.recordResult(ctx, gameLobby, gameState); err != nil {
+		log.Printf("Failed to rate game %s: %v", gameState.Id, err)
+	}
+}
+
+func (m *moves) record(ctx context.Context, record components.MoveRecord) error {
+	// The message id names the turn, so JetStream drops a retried publish
+	// and any second move made for the same turn.
+	msgId := fmt.Sprintf("%s.%d.%d", record.GameId, record.Round, record.Sequence)
+	return m.publish(ctx, moveSubject(record.GameId), msgId, record)
+}
+
+// recordEvent publishes an event other than a move. The message id names the
+// board the event ends, so every replica's clock can publish the same
+// forfeit and only the first one is stored.
+func (m *moves) recordEvent(ctx context.Context, record components.MoveRecord) error {
+	msgId := fmt.Sprintf("%s.%d.%d.%s", record.GameId, record.Round, record.Sequence, record.Event)
+	return m.publish(ctx, eventSubject(record.GameId, record.Event), msgId, record)
+}
+
+// publish adds record to the gameMoves stream.
+func (m *moves) publish(ctx context.Context, subject, msgId string, record components.MoveRecord) error {
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	ack, err := m.js.PublishMsg(ctx, &nats.Msg{
+		Subject: subject,
+		Data:    bytes,
+	}, jetstream.WithMsgID(msgId))
+	if err != nil {
+		return fmt.Errorf("failed to publish %s: %w", subject, err)
+	}
+	if ack.Duplicate {
+		return fmt.Errorf("%s was already published: %w", msgId, store.ErrConflict)
+	}
+	return nil
+}
+
+// reject records that the projector did not fold the move stored under
+// sequence into its board, because of reason.
+func (m *moves) reject(ctx context.Context, gameId string, sequence uint64, reason error) error {
+	bytes, err := json.Marshal(moveRejection{Sequence: sequence, Reason: reason.Error()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	// Redelivered moves are rejected again, but recorded once.
+	msgId := fmt.Sprintf("%s.rejected.%d", gameId, sequence)
+	if _, err := m.js.PublishMsg(ctx, &nats.Msg{
+		Subject: rejectionSubject(gameId),
+		Data:    bytes,
+	}, jetstream.WithMsgID(msgId)); err != nil {
+		return fmt.Errorf("failed to record rejected move: %w", err)
+	}
+	return nil
+}
+
+// history returns the recorded moves and events of a game, oldest first,
+// leaving out the ones the projector rejected.
+func (m *moves) history(ctx context.Context, gameId string) ([]components.MoveRecord, error) {
+	subjects := []string{
+		moveSubject(gameId),
+		eventSubject(gameId, components.EventForfeit),
+		eventSubject(gameId, components.EventReset),
+		rejectionSubject(gameId),
+	}
+
+	stream, err := m.js.Stream(ctx, moveStream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get move stream: %w", err)
+	}
+
+	info, err := stream.Info(ctx, jetstream.WithSubjectFilter(fmt.Sprintf("ttt.game.%s.*", gameId)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get move stream info: %w", err)
+	}
+
+	total := 0
+	for _, subject := range subjects {
+		total += int(info.State.Subjects[subject])
+	}
+	if total == 0 {
+		return nil, nil
+	}
+
+	consumer, err := stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		FilterSubjects: subjects,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create move consumer: %w", err)
+	}
+
+	type storedMove struct {
+		sequence uint64
+		record   components.MoveRecord
+	}
+	stored := make([]storedMove, 0, total)
+	rejected := map[uint64]bool{}
+
+	for read := 0; read < total; {
+		batch, err := consumer.Fetch(total-read, jetstream.FetchMaxWait(time.Second))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch moves: %w", err)
+		}
+
+		fetched := 0
+		for msg := range batch.Messages() {
+			fetched++
+
+			if msg.Subject() == rejectionSubject(gameId) {
+				var rejection moveRejection
+				if err := json.Unmarshal(msg.Data(), &rejection); err != nil {
+					return nil, fmt.Errorf("failed to unmarshal move rejection: %w", err)
+				}
+				rejected[rejection.Sequence] = true
+				continue
+			}
+
+			metadata, err := msg.Metadata()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get move metadata: %w", err)
+			}
+			var record components.MoveRecord
+			if err := json.Unmarshal(msg.Data(), &record); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal move: %w", err)
+			}
+			stored = append(stored, storedMove{sequence: metadata.Sequence.Stream, record: record})
+		}
+		if err := batch.Error(); err != nil {
+			return nil, fmt.Errorf("failed to fetch moves: %w", err)
+		}
+		if fetched == 0 {
+			break
+		}
+		read += fetched
+	}
+
+	records := make([]components.MoveRecord, 0, len(stored))
+	for _, move := range stored {
+		if !rejected[move.sequence] {
+			records = append(records, move.record)
+		}
+	}
+	return records, nil
+}
+
+// playerFor returns the mark played by sessionId in the current game of
+// gameLobby, or "" if the session is not seated in the game.
+func playerFor(gameLobby *components.GameLobby, gameState *components.GameState, sessionId string) string {
+	switch sessionId {
+	case gameLobby.HostId:
+		return game.MarkOf(*gameState, components.SeatHost)
+	case gameLobby.ChallengerId:
+		return game.MarkOf(*gameState, components.SeatChallenger)
+	default:
+		return ""
+	}
+}
+
+// seatOf returns the seat of sessionId in gameLobby, or "" if the session
+// is not seated in the game.
+func seatOf(gameLobby *components.GameLobby, sessionId string) string {
+	switch {
+	case sessionId == "":
+		return ""
+	case sessionId == gameLobby.HostId:
+		return components.SeatHost
+	case sessionId == gameLobby.ChallengerId:
+		return components.SeatChallenger
+	default:
+		return ""
+	}
+}
+
+// seated reports whether sessionId plays in gameLobby.
+func seated(gameLobby *components.GameLobby, sessionId string) bool {
+	return sessionId != "" && (sessionId == gameLobby.HostId || sessionId == gameLobby.ChallengerId)
+}
+
+// moveErrorMessage returns a user facing message for rule violations
+// reported by the game engine.
+func moveErrorMessage(err error) (string, bool) {
+	switch {
+	case errors.Is(err, errSpectator):
+		return "Spectators cannot play", true
+	case errors.Is(err, game.ErrInvalidBoard):
+		return "Invalid board index", true
+	case errors.Is(err, game.ErrInvalidCell):
+		return "Invalid cell index", true
+	case errors.Is(err, game.ErrWrongBoard):
+		return "You must play on the highlighted board", true
+	case errors.Is(err, game.ErrCellOccupied):
+		return "Cell already occupied", true
+	case errors.Is(err, game.ErrNotYourTurn):
+		return "Not your turn", true
+	case errors.Is(err, game.ErrGameOver):
+		return "Game is already over", true
+	case errors.Is(err, game.ErrOutOfTime):
+		return "You ran out of time", true
+	case errors.Is(err, errStaleMove), errors.Is(err, store.ErrConflict):
+		return "Another move was made first", true
+	default:
+		return "", false
+	}
+}
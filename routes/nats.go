@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/delaneyj/toolbelt/embeddednats"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	natsPort        = 1234
+	defaultStoreDir = "data/nats"
+)
+
+// natsConfig selects the NATS deployment the app runs against. Without a URL
+// the app starts its own embedded server.
+type natsConfig struct {
+	// URL of an existing deployment, e.g. "nats://nats-1:4222,nats://nats-2:4222".
+	URL string
+	// CredsFile is a user credentials file for the deployment, if it needs one.
+	CredsFile string
+	// CAFile is a PEM file with the certificate authorities to trust for TLS.
+	CAFile string
+	// StoreDir is where the embedded server keeps its JetStream data.
+	StoreDir string
+}
+
+func (c natsConfig) embedded() bool {
+	return c.URL == ""
+}
+
+func loadNATSConfig() natsConfig {
+	config := natsConfig{
+		URL:       os.Getenv("NATS_URL"),
+		CredsFile: os.Getenv("NATS_CREDS"),
+		CAFile:    os.Getenv("NATS_CA"),
+		StoreDir:  defaultStoreDir,
+	}
+	if dir, ok := os.LookupEnv("NATS_STORE_DIR"); ok {
+		config.StoreDir = dir
+	}
+	return config
+}
+
+// connectNATS connects to the deployment selected by config, starting the
+// embedded server first if there is none. The returned cleanup closes the
+// connection and, if it was started, the embedded server.
+func connectNATS(ctx context.Context, config natsConfig) (*nats.Conn, func() error, error) {
+	if !config.embedded() {
+		opts := []nats.Option{
+			nats.Name("datastar_nats_tictactoe"),
+			nats.MaxReconnects(-1),
+		}
+		if config.CredsFile != "" {
+			opts = append(opts, nats.UserCredentials(config.CredsFile))
+		}
+		if config.CAFile != "" {
+			opts = append(opts, nats.RootCAs(config.CAFile))
+		}
+
+		log.Printf("Connecting to Nats at %s", config.URL)
+		nc, err := nats.Connect(config.URL, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error connecting to nats: %w", err)
+		}
+
+		return nc, nc.Drain, nil
+	}
+
+	// JetStream keeps every bucket and stream in StoreDir, so games survive
+	// restarts and deploys as long as the directory does.
+	log.Printf("Starting on Nats server %d with store %s", natsPort, config.StoreDir)
+	ns, err := embeddednats.New(ctx, embeddednats.WithNATSServerOptions(&server.Options{
+		JetStream: true,
+		Port:      natsPort,
+		StoreDir:  config.StoreDir,
+	}))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating embedded nats server: %w", err)
+	}
+
+	ns.WaitForServer()
+
+	nc, err := ns.Client()
+	if err != nil {
+		ns.Close()
+		return nil, nil, fmt.Errorf("error creating nats client: %w", err)
+	}
+
+	cleanup := func() error {
+		nc.Close()
+		return ns.Close()
+	}
+
+	return nc, cleanup, nil
+}
@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/rating"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minNameLength     = 2
+	minPasswordLength = 4
+)
+
+var errBadCredentials = errors.New("invalid name or password")
+
+// playerKey maps a display name to its key in the players bucket. Names are
+// case insensitive and may contain characters that are not valid in keys.
+func playerKey(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.ToLower(strings.TrimSpace(name))))
+}
+
+// admins holds the keys of the players who administer the server, who may
+// moderate the dashboard chat.
+type admins map[string]bool
+
+// parseAdmins reads a comma separated list of player names.
+func parseAdmins(names string) admins {
+	admins := admins{}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			admins[playerKey(name)] = true
+		}
+	}
+	return admins
+}
+
+// has reports whether user is signed in as one of the admins. Guests and
+// bots have no player, so they never are.
+func (a admins) has(user *components.User) bool {
+	return user.PlayerId != "" && a[user.PlayerId]
+}
+
+// players keeps the durable player accounts and their ratings.
+type players struct {
+	players store.PlayerRepo
+	users   store.UserRepo
+}
+
+func newPlayers(repos *store.Repos) *players {
+	return &players{
+		players: repos.Players,
+		users:   repos.Users,
+	}
+}
+
+// login returns the player registered under name, registering it with
+// password the first time the name is used. The name must be trimmed.
+func (p *players) login(ctx context.Context, name, password string) (*components.Player, error) {
+	key := playerKey(name)
+
+	player, _, err := p.players.Get(ctx, key)
+	switch {
+	case err == nil:
+		if err := bcrypt.CompareHashAndPassword(player.PasswordHash, []byte(password)); err != nil {
+			return nil, errBadCredentials
+		}
+		return player, nil
+	case !errors.Is(err, store.ErrNotFound):
+		return nil, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	player = &components.Player{
+		Id:           key,
+		Name:         name,
+		PasswordHash: hash,
+		Rating:       rating.Initial,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	if _, err := p.players.Create(ctx, key, *player); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			// Someone registered the same name in the meantime.
+			return p.login(ctx, name, password)
+		}
+		return nil, fmt.Errorf("failed to create player: %w", err)
+	}
+
+	return player, nil
+}
+
+// recordResult rates a finished game and records the series result once the
+// game decided its series. Games are only rated when both seats belong to
+// different registered players, so bots never move a rating.
+func (p *players) recordResult(ctx context.Context, gameLobby *components.GameLobby, gameState components.GameState) error {
+	hostId, err := p.playerId(ctx, gameLobby.HostId)
+	if err != nil || hostId == "" {
+		return err
+	}
+	challengerId, err := p.playerId(ctx, gameLobby.ChallengerId)
+	if err != nil || challengerId == "" || challengerId == hostId {
+		return err
+	}
+
+	host, _, err := p.players.Get(ctx, hostId)
+	if err != nil {
+		return err
+	}
+	challenger, _, err := p.players.Get(ctx, challengerId)
+	if err != nil {
+		return err
+	}
+
+	score := resultFor(game.MarkOf(gameState, components.SeatHost), gameState.Winner)
+	hostRating, _ := rating.Elo(host.Rating, challenger.Rating, score)
+	delta := hostRating - host.Rating
+
+	seriesWinner := ""
+	if series := gameState.Series; series != nil && series.BestOf > 1 {
+		seriesWinner = series.Winner
+	}
+
+	return errors.Join(
+		p.adjust(ctx, hostId, func(player *components.Player) {
+			applyResult(player, delta, score, seriesWinner, components.SeatHost)
+		}),
+		p.adjust(ctx, challengerId, func(player *components.Player) {
+			applyResult(player, -delta, rating.Win-score, seriesWinner, components.SeatChallenger)
+		}),
+	)
+}
+
+// applyResult adds a game result to the record of the player in seat.
+func applyResult(player *components.Player, delta int, score rating.Score, seriesWinner, seat string) {
+	player.Rating += delta
+	switch score {
+	case rating.Win:
+		player.Wins++
+	case rating.Loss:
+		player.Losses++
+	default:
+		player.Draws++
+	}
+
+	switch seriesWinner {
+	case "":
+	case seat:
+		player.SeriesWins++
+	default:
+		player.SeriesLosses++
+	}
+}
+
+// playerId returns the player behind a session, or "" for guests and bots.
+func (p *players) playerId(ctx context.Context, sessionId string) (string, error) {
+	if sessionId == "" {
+		return "", nil
+	}
+	user, _, err := p.users.Get(ctx, sessionId)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	return user.PlayerId, nil
+}
+
+// ratingOf returns the rating of the player behind a session. Sessions without
+// a player count as new players.
+func (p *players) ratingOf(ctx context.Context, sessionId string) (int, error) {
+	playerId, err := p.playerId(ctx, sessionId)
+	if err != nil || playerId == "" {
+		return rating.Initial, err
+	}
+	player, _, err := p.players.Get(ctx, playerId)
+	if err != nil {
+		return rating.Initial, err
+	}
+	return player.Rating, nil
+}
+
+// adjust applies update to a player, retrying when the record was changed
+// concurrently.
+func (p *players) adjust(ctx context.Context, playerId string, update func(*components.Player)) error {
+	_, err := store.Modify(ctx, p.players, playerId, func(player *components.Player) error {
+		update(player)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update rating of %s: %w", playerId, err)
+	}
+	return nil
+}
+
+// resultFor returns the score of winner from the point of view of player.
+func resultFor(player, winner string) rating.Score {
+	switch winner {
+	case game.Tie:
+		return rating.Draw
+	case player:
+		return rating.Win
+	default:
+		return rating.Loss
+	}
+}
@@ -0,0 +1,221 @@
+package routes
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	presenceHeartbeat = 10 * time.Second
+	presenceTTL       = 30 * time.Second
+)
+
+// beOnline marks sessionId as connected to gameId, or to the dashboard when
+// gameId is empty, until ctx is done. Every connection has its own entry so
+// closing one tab leaves the others online; entries of a server that died
+// expire with the bucket TTL.
+func beOnline(ctx context.Context, repos *store.Repos, sessionId, gameId string) {
+	if sessionId == "" {
+		return
+	}
+
+	presence := components.Presence{
+		SessionId: sessionId,
+		GameId:    gameId,
+	}
+	if user, _, err := repos.Users.Get(ctx, sessionId); err == nil {
+		presence.Name = user.Name
+	}
+
+	key := sessionId + "." + newSessionId()
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		presence.SeenAt = time.Now().UTC()
+		if _, err := repos.Presence.Put(ctx, key, presence); err != nil {
+			log.Printf("Failed to refresh presence %s: %v", key, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := repos.Presence.Delete(context.Background(), key); err != nil {
+				log.Printf("Failed to remove presence %s: %v", key, err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// presenceSet holds the entries of the presence bucket seen by a watcher.
+// Watchers are not told about expired entries, so entries that missed their
+// heartbeats are left out of the results instead.
+type presenceSet map[string]components.Presence
+
+// apply records entry and reports whether it opened or closed a connection
+// rather than refreshing one. Only entries matching keep are recorded.
+func (p presenceSet) apply(entry *store.Entry[components.Presence], keep func(components.Presence) bool) bool {
+	switch entry.Op {
+	case store.OpPut:
+		if !keep(entry.Value) {
+			return false
+		}
+		_, known := p[entry.Key]
+		p[entry.Key] = entry.Value
+		return !known
+	case store.OpDelete:
+		_, known := p[entry.Key]
+		delete(p, entry.Key)
+		return known
+	}
+	return false
+}
+
+func (p presenceSet) online(now time.Time) components.Online {
+	online := components.Online{}
+	for _, presence := range p {
+		if now.Sub(presence.SeenAt) > presenceTTL {
+			continue
+		}
+		if online[presence.SessionId] == nil {
+			online[presence.SessionId] = map[string]bool{}
+		}
+		online[presence.SessionId][presence.GameId] = true
+	}
+	return online
+}
+
+// players lists the players with a connection open by name. Players logged
+// in more than once are listed once.
+func (p presenceSet) players(now time.Time) []components.OnlinePlayer {
+	byName := map[string]*components.OnlinePlayer{}
+	for _, presence := range p {
+		if presence.Name == "" || now.Sub(presence.SeenAt) > presenceTTL {
+			continue
+		}
+		player, ok := byName[presence.Name]
+		if !ok {
+			player = &components.OnlinePlayer{Name: presence.Name}
+			byName[presence.Name] = player
+		}
+		player.Playing = player.Playing || presence.GameId != ""
+	}
+
+	players := make([]components.OnlinePlayer, 0, len(byName))
+	for _, player := range byName {
+		players = append(players, *player)
+	}
+	slices.SortFunc(players, func(a, b components.OnlinePlayer) int {
+		return cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+	return players
+}
+
+// gamePresence tells which seats of gameLobby have the game open.
+func gamePresence(online components.Online, gameLobby *components.GameLobby) components.GamePresence {
+	return components.GamePresence{
+		Host:       online.InGame(gameLobby.HostId, gameLobby.Id),
+		Challenger: gameLobby.ChallengerId != "" && online.InGame(gameLobby.ChallengerId, gameLobby.Id),
+	}
+}
+
+// loadPresence reads the presence entries of the sessions matching keep.
+func loadPresence(ctx context.Context, repos *store.Repos, keep func(sessionId string) bool) (presenceSet, error) {
+	keys, err := repos.Presence.Keys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list presence: %w", err)
+	}
+
+	presence := presenceSet{}
+	for _, key := range keys {
+		sessionId, _, _ := strings.Cut(key, ".")
+		if sessionId == "" || !keep(sessionId) {
+			continue
+		}
+		entry, _, err := repos.Presence.Get(ctx, key)
+		if err != nil {
+			continue // Closed in the meantime.
+		}
+		presence[key] = *entry
+	}
+	return presence, nil
+}
+
+// loadGamePresence reads the presence of the seated players of gameLobby,
+// for pages that render before their watchers start.
+func loadGamePresence(ctx context.Context, repos *store.Repos, gameLobby *components.GameLobby) (components.GamePresence, error) {
+	presence, err := loadPresence(ctx, repos, func(sessionId string) bool {
+		return seated(gameLobby, sessionId)
+	})
+	if err != nil {
+		return components.GamePresence{}, err
+	}
+	return gamePresence(presence.online(time.Now()), gameLobby), nil
+}
+
+// watchGamePresence reports whether the seated players have gameId open
+// whenever it changes.
+func watchGamePresence(ctx context.Context, repos *store.Repos, gameId string, view gameView) error {
+	presenceWatcher, err := repos.Presence.WatchAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start presence watcher: %w", err)
+	}
+	defer presenceWatcher.Stop()
+
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	presence := presenceSet{}
+	inGame := func(p components.Presence) bool { return p.GameId == gameId }
+	historicalMode := true
+	var reported *components.GamePresence
+
+	report := func() error {
+		gameLobby, _, err := repos.Lobbies.Get(ctx, gameId)
+		if err != nil {
+			return nil // The lobby watcher deals with deleted games.
+		}
+		current := gamePresence(presence.online(time.Now()), gameLobby)
+		if reported != nil && *reported == current {
+			return nil
+		}
+		reported = &current
+		return view.presence(current)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			// Catches connections that stopped sending heartbeats.
+			if historicalMode {
+				continue
+			}
+			if err := report(); err != nil {
+				return err
+			}
+		case entry, ok := <-presenceWatcher.Updates():
+			if !ok {
+				return nil
+			}
+			if entry == nil {
+				historicalMode = false
+			} else if !presence.apply(entry, inGame) || historicalMode {
+				continue
+			}
+			if err := report(); err != nil {
+				return err
+			}
+		}
+	}
+}
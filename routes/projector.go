@@ -0,0 +1,241 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const (
+	projectorConsumer = "boardProjector"
+	projectorRetry    = 250 * time.Millisecond
+	// projectorMaxDeliver bounds the retries of a move that keeps failing,
+	// so it cannot hold up the later moves of its game for long.
+	projectorMaxDeliver = 20
+	projectorInactive   = time.Hour
+)
+
+// project folds a published move or event into the board of its game. The
+// move or forfeit that ends a game also updates the ratings of both players.
+func (m *moves) project(ctx context.Context, record components.MoveRecord) error {
+	gameLobby, _, err := m.lobbies.Get(ctx, record.GameId)
+	if err != nil {
+		return err
+	}
+	if record.Event != "" {
+		return m.projectEvent(ctx, gameLobby, record)
+	}
+
+	gameState, revision, err := m.boards.Get(ctx, record.GameId)
+	if err != nil {
+		return err
+	}
+
+	// A redelivered move is already on the board.
+	if record.Round == gameState.Round && record.Sequence <= gameState.Moves {
+		return nil
+	}
+
+	next, err := applyMove(gameLobby, gameState, record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.boards.Update(ctx, record.GameId, next, revision); err != nil {
+		return err
+	}
+
+	if next.Winner != "" {
+		m.rate(ctx, gameLobby, next)
+	}
+	return nil
+}
+
+// startProjector folds the moves and events of the gameMoves stream into the
+// gameBoards bucket. Every game has its own durable consumer, shared by every
+// replica; with a single message of a game in flight, the changes of a board
+// are projected in the order they were published, so a move made in time is
+// on the board before the forfeit the clocks publish once time is up. A game
+// whose message keeps failing holds up no other game.
+func startProjector(ctx context.Context, js jetstream.JetStream, repos *store.Repos) error {
+	moves := newMoves(js, repos)
+
+	// Earlier versions projected every game through one consumer.
+	if err := js.DeleteConsumer(ctx, moveStream, projectorConsumer); err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return fmt.Errorf("failed to delete projector consumer: %w", err)
+	}
+
+	watcher, err := repos.Lobbies.WatchAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start projector watcher: %w", err)
+	}
+
+	handle := func(msg jetstream.Msg) {
+		var record components.MoveRecord
+		if err := json.Unmarshal(msg.Data(), &record); err != nil {
+			log.Printf("Dropping malformed move on %s: %v", msg.Subject(), err)
+			msg.Term()
+			return
+		}
+
+		kind := "move"
+		if record.Event != "" {
+			kind = record.Event
+		}
+
+		metadata, err := msg.Metadata()
+		if err != nil {
+			log.Printf("Failed to get metadata of %s %d of game %s: %v", kind, record.Sequence, record.GameId, err)
+			msg.NakWithDelay(projectorRetry)
+			return
+		}
+		lastTry := metadata.NumDelivered >= projectorMaxDeliver
+
+		// reject records that the move or event did not make it onto the
+		// board, which leaves it out of the history of the game.
+		reject := func(reason error) bool {
+			if err := moves.reject(ctx, record.GameId, metadata.Sequence.Stream, reason); err != nil {
+				log.Printf("Failed to record rejected %s %d of game %s: %v", kind, record.Sequence, record.GameId, err)
+				if !lastTry {
+					msg.NakWithDelay(projectorRetry)
+					return false
+				}
+			}
+			return true
+		}
+
+		err = moves.project(ctx, record)
+		_, isRuleViolation := moveErrorMessage(err)
+		isRuleViolation = isRuleViolation || errors.Is(err, game.ErrClockRunning) || errors.Is(err, errGameRunning)
+		switch {
+		case err == nil:
+		case errors.Is(err, store.ErrNotFound):
+			// The game is gone.
+		case isRuleViolation && !errors.Is(err, store.ErrConflict):
+			// A forfeit or reset that something else came before is
+			// stale, like a move.
+			if record.Event == "" || !errors.Is(err, errStaleMove) {
+				log.Printf("Rejected %s %d of game %s: %v", kind, record.Sequence, record.GameId, err)
+			}
+			if !reject(err) {
+				return
+			}
+		case !lastTry:
+			// The board changed under us, or the failure is temporary.
+			if !errors.Is(err, store.ErrConflict) {
+				log.Printf("Failed to project %s %d of game %s: %v", kind, record.Sequence, record.GameId, err)
+			}
+			msg.NakWithDelay(projectorRetry)
+			return
+		default:
+			log.Printf("Gave up on %s %d of game %s: %v", kind, record.Sequence, record.GameId, err)
+			if !reject(err) {
+				return
+			}
+		}
+
+		if err := msg.Ack(); err != nil {
+			log.Printf("Failed to ack %s %d of game %s: %v", kind, record.Sequence, record.GameId, err)
+		}
+	}
+
+	consumers := map[string]jetstream.ConsumeContext{}
+
+	// follow starts projecting the game stored under gameId.
+	follow := func(gameId string) error {
+		consumer, err := js.CreateOrUpdateConsumer(ctx, moveStream, jetstream.ConsumerConfig{
+			Durable:       projectorConsumerOf(gameId),
+			Description:   fmt.Sprintf("Projects the moves of game %s onto its board", gameId),
+			DeliverPolicy: jetstream.DeliverAllPolicy,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			MaxAckPending: 1,
+			MaxDeliver:    projectorMaxDeliver,
+			FilterSubjects: []string{
+				moveSubject(gameId),
+				eventSubject(gameId, components.EventForfeit),
+				eventSubject(gameId, components.EventReset),
+			},
+			// Removed if no replica follows the game any more, e.g. because
+			// it was deleted while every replica was down.
+			InactiveThreshold: projectorInactive,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create projector consumer: %w", err)
+		}
+
+		consumeContext, err := consumer.Consume(handle)
+		if err != nil {
+			return fmt.Errorf("failed to start projector: %w", err)
+		}
+		consumers[gameId] = consumeContext
+		return nil
+	}
+
+	// forget stops projecting a deleted game. Every replica sees the delete,
+	// the first one removes the consumer.
+	forget := func(gameId string) {
+		consumeContext, ok := consumers[gameId]
+		if !ok {
+			return
+		}
+		consumeContext.Stop()
+		delete(consumers, gameId)
+
+		if err := js.DeleteConsumer(ctx, moveStream, projectorConsumerOf(gameId)); err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+			log.Printf("Failed to delete projector consumer of game %s: %v", gameId, err)
+		}
+	}
+
+	go func() {
+		defer watcher.Stop()
+		defer func() {
+			for _, consumeContext := range consumers {
+				consumeContext.Stop()
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					log.Println("Projector watcher updates channel closed")
+					return
+				}
+				if entry == nil {
+					continue
+				}
+
+				if entry.Op != store.OpPut {
+					forget(entry.Key)
+					continue
+				}
+				if _, ok := consumers[entry.Key]; ok {
+					continue
+				}
+				// A game that could not be followed is tried again on the
+				// next change of its lobby.
+				if err := follow(entry.Key); err != nil {
+					log.Printf("Failed to project game %s: %v", entry.Key, err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// projectorConsumerOf names the consumer projecting the game stored under
+// gameId.
+func projectorConsumerOf(gameId string) string {
+	return projectorConsumer + "_" + gameId
+}
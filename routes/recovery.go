@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// reconcileGames removes the halves of games that were only partly written
+// or partly deleted when the server went down: a lobby without a board can
+// never be played and a board without a lobby can never be joined. Hosts
+// whose index still names a game that is gone have it dropped too. It runs
+// before the server accepts requests, so no game is being created meanwhile.
+func reconcileGames(ctx context.Context, repos *store.Repos) error {
+	lobbyKeys, err := repos.Lobbies.Keys(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list game lobbies: %w", err)
+	}
+
+	boardKeys, err := repos.Boards.Keys(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list game boards: %w", err)
+	}
+
+	boards := make(map[string]bool, len(boardKeys))
+	for _, key := range boardKeys {
+		boards[key] = true
+	}
+
+	games := make(map[string]bool, len(lobbyKeys))
+	var errs []error
+	for _, key := range lobbyKeys {
+		if boards[key] {
+			delete(boards, key)
+			games[key] = true
+			continue
+		}
+
+		if gameLobby, _, err := repos.Lobbies.Get(ctx, key); err == nil && gameLobby.InviteCode != "" {
+			if err := repos.Invites.Purge(ctx, gameLobby.InviteCode); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := repos.Lobbies.Purge(ctx, key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Removed game lobby %s without a game board", key)
+	}
+
+	// Whatever is left in boards has no lobby.
+	for key := range boards {
+		if err := repos.Boards.Purge(ctx, key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Removed game board %s without a game lobby", key)
+	}
+
+	userKeys, err := repos.Users.Keys(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to list users: %w", err))
+	}
+	for _, key := range userKeys {
+		user, _, err := repos.Users.Get(ctx, key)
+		if err != nil {
+			if !errors.Is(err, store.ErrNotFound) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if !slices.ContainsFunc(user.HostedGames, func(id string) bool { return !games[id] }) {
+			continue
+		}
+
+		_, err = store.Modify(ctx, repos.Users, key, func(user *components.User) error {
+			user.HostedGames = slices.DeleteFunc(user.HostedGames, func(id string) bool {
+				return !games[id]
+			})
+			return nil
+		})
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Removed games that are gone from the games hosted by %s", key)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to reconcile games: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// TestReconcileGames checks that the halves of games left behind by a crash
+// are removed, and that hosts no longer list games that are gone.
+func TestReconcileGames(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestService()
+	repos := service.repos
+	host := mustLogin(t, service, "alice")
+
+	kept, err := service.create(ctx, host, defaultGameSettings())
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	if _, err := repos.Lobbies.Create(ctx, "lobby-only", components.GameLobby{Id: "lobby-only", HostId: host}); err != nil {
+		t.Fatalf("failed to store game lobby: %v", err)
+	}
+	if _, err := repos.Boards.Create(ctx, "board-only", components.GameState{}); err != nil {
+		t.Fatalf("failed to store game board: %v", err)
+	}
+	_, err = store.Modify(ctx, repos.Users, host, func(user *components.User) error {
+		user.HostedGames = append(user.HostedGames, "lobby-only", "gone")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+
+	if err := reconcileGames(ctx, repos); err != nil {
+		t.Fatalf("reconcileGames() error = %v", err)
+	}
+
+	if _, _, err := repos.Lobbies.Get(ctx, "lobby-only"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("lobby without a board error = %v, want ErrNotFound", err)
+	}
+	if _, _, err := repos.Boards.Get(ctx, "board-only"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("board without a lobby error = %v, want ErrNotFound", err)
+	}
+	if _, _, err := repos.Lobbies.Get(ctx, kept.Id); err != nil {
+		t.Fatalf("whole game was removed: %v", err)
+	}
+
+	user, _, err := repos.Users.Get(ctx, host)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if !slices.Equal(user.HostedGames, []string{kept.Id}) {
+		t.Fatalf("HostedGames = %v, want only %s", user.HostedGames, kept.Id)
+	}
+}
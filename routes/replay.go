@@ -0,0 +1,173 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/pages"
+	datastar "github.com/starfederation/datastar/sdk/go"
+)
+
+func setupReplayRoute(router chi.Router, sessionStore sessions.Store, repos *store.Repos, js jetstream.JetStream) error {
+	moves := newMoves(js, repos)
+
+	handleReplayPage := func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		if id == "" {
+			http.Error(w, "missing 'id' parameter", http.StatusBadRequest)
+			return
+		}
+
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil || sessionId == "" {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		currentUser, _, err := repos.Users.Get(r.Context(), sessionId)
+		if err != nil {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if gameLobby, _, err := repos.Lobbies.Get(r.Context(), id); err != nil || !visibleTo(gameLobby, sessionId) {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		pages.Replay(currentUser, id).Render(r.Context(), w)
+	}
+
+	router.Get("/game/{id}/replay", handleReplayPage)
+
+	// API
+
+	var engine game.Engine
+
+	newReplayBoard := func(record components.MoveRecord) (components.GameState, error) {
+		return engine.NewGame(record.GameId, components.GameSettings{
+			Mode:      record.Mode,
+			BoardSize: record.Size,
+			WinLength: record.WinLength,
+		})
+	}
+
+	// replayState folds the first step moves and events back into a game
+	// state, starting a new board whenever the round changes.
+	replayState := func(records []components.MoveRecord, step int) (*components.GameState, error) {
+		state, err := newReplayBoard(records[0])
+		if err != nil {
+			return nil, err
+		}
+		round := records[0].Round
+
+		for _, record := range records[:step] {
+			if record.Round != round {
+				if state, err = newReplayBoard(record); err != nil {
+					return nil, err
+				}
+				round = record.Round
+			}
+
+			switch record.Event {
+			case components.EventForfeit:
+				state.Winner = game.Opponent(record.Player)
+				state.Forfeit = record.Player
+				continue
+			case components.EventReset:
+				if state, err = newReplayBoard(record); err != nil {
+					return nil, err
+				}
+				round = record.Round + 1
+				continue
+			}
+
+			state, err = engine.Apply(state, game.Move{
+				Board:  record.Board,
+				Cell:   record.Cell,
+				Player: record.Player,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to replay move %d: %w", record.Sequence, err)
+			}
+		}
+
+		return &state, nil
+	}
+
+	handleReplay := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id := chi.URLParam(r, "id")
+		if id == "" {
+			http.Error(w, "missing 'id' parameter", http.StatusBadRequest)
+			return
+		}
+
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil || sessionId == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// The moves of private games are only shown to their players.
+		if gameLobby, _, err := repos.Lobbies.Get(ctx, id); err != nil || !visibleTo(gameLobby, sessionId) {
+			http.Error(w, "game not found", http.StatusNotFound)
+			return
+		}
+
+		signals := &components.ReplaySignals{}
+		if err := datastar.ReadSignals(r, signals); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		records, err := moves.history(ctx, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sse := datastar.NewSSE(w, r)
+
+		total := len(records)
+		step := signals.Step
+		if step < 0 || step > total {
+			step = total
+		}
+
+		var gameState *components.GameState
+		if total > 0 {
+			if gameState, err = replayState(records, step); err != nil {
+				sse.ConsoleError(err)
+				return
+			}
+		}
+
+		var move *components.MoveRecord
+		playerName := ""
+		if step > 0 {
+			move = &records[step-1]
+			playerName = move.Player
+			if user, _, err := repos.Users.Get(ctx, move.SessionId); err == nil {
+				playerName = user.Name
+			}
+		}
+
+		if err := sse.MarshalAndMergeSignals(components.ReplaySignals{Step: step}); err != nil {
+			sse.ConsoleError(err)
+		}
+		if err := sse.MergeFragmentTempl(components.ReplayView(gameState, step, total, move, playerName)); err != nil {
+			sse.ConsoleError(err)
+		}
+	}
+
+	router.Get("/api/game/{id}/replay", handleReplay)
+
+	return nil
+}
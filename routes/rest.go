@@ -0,0 +1,500 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const restPrefix = "/api/v1"
+
+// setupRestRoute serves the JSON API for clients that are not browsers. It
+// makes the same calls to the game service as the Datastar handlers, but
+// answers with JSON and status codes instead of fragments and alerts.
+// Requests are authenticated with the session cookie set by the login.
+func setupRestRoute(router chi.Router, sessionStore sessions.Store, service *gameService) error {
+	writeJSON := func(w http.ResponseWriter, status int, v any) {
+		if v == nil {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	}
+
+	writeError := func(w http.ResponseWriter, r *http.Request, err error) {
+		status, msg := serviceError(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Error handling %s %s: %v", r.Method, r.URL.Path, err)
+		}
+		writeJSON(w, status, api.Error{Status: status, Message: msg})
+	}
+
+	readJSON := func(w http.ResponseWriter, r *http.Request, v any) bool {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			msg := fmt.Sprintf("Invalid request body: %v", err)
+			writeJSON(w, http.StatusBadRequest, api.Error{Status: http.StatusBadRequest, Message: msg})
+			return false
+		}
+		return true
+	}
+
+	// session returns the session of a request, answering 401 if there is
+	// none or its user is gone. The request counts as the session being
+	// connected.
+	session := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil {
+			writeError(w, r, err)
+			return "", false
+		}
+		if sessionId == "" {
+			writeError(w, r, errUnknownSession)
+			return "", false
+		}
+		user, _, err := service.repos.Users.Get(r.Context(), sessionId)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				err = errUnknownSession
+			}
+			writeError(w, r, err)
+			return "", false
+		}
+		service.seen(r.Context(), user)
+		return sessionId, true
+	}
+
+	writeGame := func(w http.ResponseWriter, r *http.Request, status int, sessionId, id string) {
+		game, err := service.game(r.Context(), sessionId, id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, status, game)
+	}
+
+	writeUser := func(w http.ResponseWriter, r *http.Request, status int, sessionId string) {
+		user, rating, err := service.user(r.Context(), sessionId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, status, api.UserResponse{SessionId: user.SessionId, Name: user.Name, PlayerId: user.PlayerId, Rating: rating})
+	}
+
+	handleLogin := func(w http.ResponseWriter, r *http.Request) {
+		var request api.LoginRequest
+		if !readJSON(w, r, &request) {
+			return
+		}
+
+		user, err := service.login(r.Context(), request.Name, request.Password)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := saveSessionId(sessionStore, r, w, user.SessionId); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeUser(w, r, http.StatusCreated, user.SessionId)
+	}
+
+	handleGetUser := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		writeUser(w, r, http.StatusOK, sessionId)
+	}
+
+	handleLogout := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		if err := service.logout(r.Context(), sessionId); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		deleteSessionId(sessionStore, w, r)
+		writeJSON(w, http.StatusNoContent, nil)
+	}
+
+	handleListLobbies := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		lobbies, err := service.list(r.Context(), sessionId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, api.ListResponse{Lobbies: lobbies})
+	}
+
+	handleCreateLobby := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		// Settings left out keep their defaults.
+		settings := api.GameSettings(defaultGameSettings())
+		if !readJSON(w, r, &settings) {
+			return
+		}
+		gameLobby, err := service.create(r.Context(), sessionId, components.GameSettings(settings))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeGame(w, r, http.StatusCreated, sessionId, gameLobby.Id)
+	}
+
+	handleGetLobby := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		gameLobby, err := service.lobby(r.Context(), sessionId, chi.URLParam(r, "id"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, service.apiLobby(r.Context(), sessionId, gameLobby))
+	}
+
+	handleDeleteLobby := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		if err := service.remove(r.Context(), sessionId, chi.URLParam(r, "id")); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusNoContent, nil)
+	}
+
+	handleJoin := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		id := chi.URLParam(r, "id")
+		if err := service.join(r.Context(), sessionId, id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeGame(w, r, http.StatusOK, sessionId, id)
+	}
+
+	handleLeave := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		left, err := service.leave(r.Context(), sessionId, chi.URLParam(r, "id"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, api.LeaveResponse{Left: left})
+	}
+
+	handleGetGame := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		writeGame(w, r, http.StatusOK, sessionId, chi.URLParam(r, "id"))
+	}
+
+	handleReset := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		id := chi.URLParam(r, "id")
+		if err := service.reset(r.Context(), sessionId, id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		// Like moves, the reset reaches the board asynchronously.
+		writeGame(w, r, http.StatusAccepted, sessionId, id)
+	}
+
+	handleListMoves := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		moves, err := service.history(r.Context(), sessionId, chi.URLParam(r, "id"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, api.MovesResponse{Moves: moves})
+	}
+
+	handleMove := func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		var move api.Move
+		if !readJSON(w, r, &move) {
+			return
+		}
+		id := chi.URLParam(r, "id")
+		if err := service.move(r.Context(), sessionId, id, move.Board, move.Cell); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		// Moves reach the board asynchronously, the game may not show it yet.
+		writeGame(w, r, http.StatusAccepted, sessionId, id)
+	}
+
+	// events starts a stream of server sent events whose data is JSON. Every
+	// event is written as soon as it is sent.
+	events := func(w http.ResponseWriter) func(event string, v any) error {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+
+		return func(event string, v any) error {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+	}
+
+	handleLobbyEvents := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+
+		watcher, err := service.repos.Lobbies.WatchAll(ctx)
+		if err != nil {
+			writeError(w, r, fmt.Errorf("failed to start watcher: %w", err))
+			return
+		}
+		defer watcher.Stop()
+
+		// Clients following the lobbies are online like the dashboard.
+		go beOnline(ctx, service.repos, sessionId, "")
+
+		send := events(w)
+
+		// Every event lists the visible lobbies once the initial values
+		// are in, so clients never apply changes themselves.
+		lobbies := map[string]api.Lobby{}
+		live := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					return
+				}
+				if entry != nil {
+					if entry.Op == store.OpPut && visibleTo(&entry.Value, sessionId) {
+						lobbies[entry.Key] = service.apiLobby(ctx, sessionId, &entry.Value)
+					} else {
+						delete(lobbies, entry.Key)
+					}
+					if !live {
+						continue
+					}
+				}
+				live = true
+
+				list := api.ListResponse{Lobbies: make([]api.Lobby, 0, len(lobbies))}
+				for _, gameLobby := range lobbies {
+					list.Lobbies = append(list.Lobbies, gameLobby)
+				}
+				slices.SortFunc(list.Lobbies, func(a, b api.Lobby) int {
+					return strings.Compare(a.Id, b.Id)
+				})
+				if err := send("lobbies", list); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	handleGameEvents := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		sessionId, ok := session(w, r)
+		if !ok {
+			return
+		}
+		id := chi.URLParam(r, "id")
+
+		game, err := service.game(ctx, sessionId, id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		lobbyWatcher, err := service.repos.Lobbies.Watch(ctx, id)
+		if err != nil {
+			writeError(w, r, fmt.Errorf("failed to start game lobby watcher: %w", err))
+			return
+		}
+		defer lobbyWatcher.Stop()
+
+		boardWatcher, err := service.repos.Boards.Watch(ctx, id)
+		if err != nil {
+			writeError(w, r, fmt.Errorf("failed to start game watcher: %w", err))
+			return
+		}
+		defer boardWatcher.Stop()
+
+		// Clients following a game have it open like the game page.
+		go beOnline(ctx, service.repos, sessionId, id)
+
+		send := events(w)
+
+		// Every change of the lobby or the board sends the whole game, a
+		// removed game ends the stream.
+		if err := send("game", game); err != nil {
+			return
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-lobbyWatcher.Updates():
+				if !ok {
+					return
+				}
+				if entry == nil {
+					continue
+				}
+				if entry.Op == store.OpDelete {
+					send("deleted", api.GameRequest{GameId: id})
+					return
+				}
+				game.Lobby = service.apiLobby(ctx, sessionId, &entry.Value)
+			case entry, ok := <-boardWatcher.Updates():
+				if !ok {
+					return
+				}
+				if entry == nil {
+					continue
+				}
+				if entry.Op == store.OpDelete {
+					send("deleted", api.GameRequest{GameId: id})
+					return
+				}
+				game.State = entry.Value
+			}
+			if err := send("game", game); err != nil {
+				return
+			}
+		}
+	}
+
+	operations := []struct {
+		api.Operation
+		handler http.HandlerFunc
+	}{
+		{api.Operation{Method: http.MethodPost, Path: "/users", Id: "login", Tag: "users", Public: true,
+			Summary: "Log in, registering the name on first use, and set the session cookie",
+			Request: api.LoginRequest{}, Response: api.UserResponse{}, Status: http.StatusCreated}, handleLogin},
+		{api.Operation{Method: http.MethodGet, Path: "/users/me", Id: "getUser", Tag: "users",
+			Summary:  "Get the user of the session",
+			Response: api.UserResponse{}, Status: http.StatusOK}, handleGetUser},
+		{api.Operation{Method: http.MethodDelete, Path: "/users/me", Id: "logout", Tag: "users",
+			Summary: "Log out, removing the games the user hosts",
+			Status:  http.StatusNoContent}, handleLogout},
+		{api.Operation{Method: http.MethodGet, Path: "/lobbies", Id: "listLobbies", Tag: "lobbies",
+			Summary:  "List the lobbies visible to the session",
+			Response: api.ListResponse{}, Status: http.StatusOK}, handleListLobbies},
+		{api.Operation{Method: http.MethodPost, Path: "/lobbies", Id: "createLobby", Tag: "lobbies",
+			Summary: "Create a game hosted by the session",
+			Request: api.GameSettings{}, Response: api.GameResponse{}, Status: http.StatusCreated}, handleCreateLobby},
+		{api.Operation{Method: http.MethodGet, Path: "/lobbies/events", Id: "lobbyEvents", Tag: "lobbies", Stream: true,
+			Summary:  "Stream the lobbies visible to the session, as \"lobbies\" events sent on every change",
+			Response: api.ListResponse{}, Status: http.StatusOK}, handleLobbyEvents},
+		{api.Operation{Method: http.MethodGet, Path: "/lobbies/{id}", Id: "getLobby", Tag: "lobbies",
+			Summary:  "Get a lobby",
+			Response: api.Lobby{}, Status: http.StatusOK}, handleGetLobby},
+		{api.Operation{Method: http.MethodDelete, Path: "/lobbies/{id}", Id: "deleteLobby", Tag: "lobbies",
+			Summary: "Delete a game hosted by the session",
+			Status:  http.StatusNoContent}, handleDeleteLobby},
+		{api.Operation{Method: http.MethodPost, Path: "/lobbies/{id}/join", Id: "joinLobby", Tag: "lobbies",
+			Summary:  "Take the challenger's seat of a public game",
+			Response: api.GameResponse{}, Status: http.StatusOK}, handleJoin},
+		{api.Operation{Method: http.MethodPost, Path: "/lobbies/{id}/leave", Id: "leaveLobby", Tag: "lobbies",
+			Summary:  "Give up the challenger's seat",
+			Response: api.LeaveResponse{}, Status: http.StatusOK}, handleLeave},
+		{api.Operation{Method: http.MethodGet, Path: "/games/{id}", Id: "getGame", Tag: "games",
+			Summary:  "Get a game with its board",
+			Response: api.GameResponse{}, Status: http.StatusOK}, handleGetGame},
+		{api.Operation{Method: http.MethodGet, Path: "/games/{id}/events", Id: "gameEvents", Tag: "games", Stream: true,
+			Summary:  "Stream a game, as \"game\" events sent on every change until a \"deleted\" event",
+			Response: api.GameResponse{}, Status: http.StatusOK}, handleGameEvents},
+		{api.Operation{Method: http.MethodPost, Path: "/games/{id}/reset", Id: "resetGame", Tag: "games",
+			Summary:  "Start the next game of the lobby once the current one is decided, the board shows it once it was applied",
+			Response: api.GameResponse{}, Status: http.StatusAccepted}, handleReset},
+		{api.Operation{Method: http.MethodGet, Path: "/games/{id}/moves", Id: "listMoves", Tag: "moves",
+			Summary:  "List the moves played in a game, with the forfeits and resets that ended its boards",
+			Response: api.MovesResponse{}, Status: http.StatusOK}, handleListMoves},
+		{api.Operation{Method: http.MethodPost, Path: "/games/{id}/moves", Id: "playMove", Tag: "moves",
+			Summary: "Play a move, the board shows it once it was applied",
+			Request: api.Move{}, Response: api.GameResponse{}, Status: http.StatusAccepted}, handleMove},
+	}
+
+	specOperations := make([]api.Operation, 0, len(operations))
+	for _, op := range operations {
+		op.Path = restPrefix + op.Path
+		specOperations = append(specOperations, op.Operation)
+	}
+	spec, err := json.Marshal(api.OpenAPI("Tic-tac-toe", api.ServiceVersion, specOperations))
+	if err != nil {
+		return fmt.Errorf("failed to generate openapi document: %w", err)
+	}
+
+	handleSpec := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}
+
+	router.Route(restPrefix, func(restRouter chi.Router) {
+		restRouter.Get("/openapi.json", handleSpec)
+
+		for _, op := range operations {
+			restRouter.Method(op.Method, op.Path, op.handler)
+		}
+	})
+
+	return nil
+}
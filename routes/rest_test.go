@@ -0,0 +1,199 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// restClient makes requests to the JSON API with its own session cookie.
+type restClient struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+}
+
+func newRestClient(t *testing.T, server *httptest.Server) *restClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("failed to create cookie jar: %v", err)
+	}
+	return &restClient{t: t, server: server, client: &http.Client{Jar: jar}}
+}
+
+// do sends body as JSON and decodes the response into v, failing the test
+// unless the response has the wanted status.
+func (c *restClient) do(method, path string, body, v any, want int) {
+	c.t.Helper()
+
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		data, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatalf("failed to marshal JSON: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.server.URL+restPrefix+path, reader)
+	if err != nil {
+		c.t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		var apiErr api.Error
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		c.t.Fatalf("%s %s = %d %q, want %d", method, path, resp.StatusCode, apiErr.Message, want)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			c.t.Fatalf("failed to decode %s %s: %v", method, path, err)
+		}
+	}
+}
+
+func (c *restClient) login(name string) api.UserResponse {
+	c.t.Helper()
+	var user api.UserResponse
+	c.do(http.MethodPost, "/users", api.LoginRequest{Name: name, Password: "secret"}, &user, http.StatusCreated)
+	return user
+}
+
+func TestRestGame(t *testing.T) {
+	service, js := newTestService()
+	router := chi.NewRouter()
+	if err := setupRestRoute(router, sessions.NewCookieStore([]byte("test-secret")), service); err != nil {
+		t.Fatalf("setupRestRoute() error = %v", err)
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	host := newRestClient(t, server)
+	challenger := newRestClient(t, server)
+	spectator := newRestClient(t, server)
+	hostUser := host.login("alice")
+	challengerUser := challenger.login("bob")
+	spectator.login("carol")
+
+	var created api.GameResponse
+	host.do(http.MethodPost, "/lobbies", struct{}{}, &created, http.StatusCreated)
+	id := created.Lobby.Id
+	if created.Lobby.Host != "alice" || created.Lobby.Seat != components.SeatHost {
+		t.Fatalf("created lobby = %+v, want alice in the host seat", created.Lobby)
+	}
+
+	var joined api.GameResponse
+	challenger.do(http.MethodPost, "/lobbies/"+id+"/join", nil, &joined, http.StatusOK)
+	if joined.Lobby.Challenger != "bob" || joined.Lobby.Seat != components.SeatChallenger {
+		t.Fatalf("joined lobby = %+v, want bob in the challenger seat", joined.Lobby)
+	}
+
+	var played api.GameResponse
+	host.do(http.MethodPost, "/games/"+id+"/moves", api.Move{Cell: 4}, &played, http.StatusAccepted)
+	records := js.moves(t, id)
+	if len(records) != 1 || records[0].Cell != 4 || records[0].SessionId != hostUser.SessionId {
+		t.Fatalf("published moves = %+v, want the host on cell 4", records)
+	}
+	if err := service.moves.project(context.Background(), records[0]); err != nil {
+		t.Fatalf("project() error = %v", err)
+	}
+	host.do(http.MethodPost, "/games/"+id+"/moves", api.Move{Cell: 0}, nil, http.StatusUnprocessableEntity)
+	challenger.do(http.MethodPost, "/games/"+id+"/reset", nil, nil, http.StatusConflict)
+
+	// Spectators see the game, but not whose sessions are seated.
+	var watched api.GameResponse
+	spectator.do(http.MethodGet, "/games/"+id, nil, &watched, http.StatusOK)
+	if watched.Lobby.Seat != "" || watched.Lobby.Host != "alice" || watched.Lobby.Challenger != "bob" {
+		t.Fatalf("lobby seen by a spectator = %+v", watched.Lobby)
+	}
+	var list api.ListResponse
+	spectator.do(http.MethodGet, "/lobbies", nil, &list, http.StatusOK)
+	if len(list.Lobbies) != 1 || list.Lobbies[0].Id != id {
+		t.Fatalf("listed lobbies = %+v, want %s", list.Lobbies, id)
+	}
+
+	var private api.GameResponse
+	host.do(http.MethodPost, "/lobbies", map[string]any{"private": true}, &private, http.StatusCreated)
+	if private.Lobby.InviteCode == "" {
+		t.Fatalf("private lobby = %+v, want an invite code for the host", private.Lobby)
+	}
+	spectator.do(http.MethodGet, "/games/"+private.Lobby.Id, nil, nil, http.StatusNotFound)
+	var listed api.ListResponse
+	spectator.do(http.MethodGet, "/lobbies", nil, &listed, http.StatusOK)
+	if len(listed.Lobbies) != 1 {
+		t.Fatalf("listed lobbies = %+v, want the private game hidden", listed.Lobbies)
+	}
+
+	var left api.LeaveResponse
+	challenger.do(http.MethodPost, "/lobbies/"+id+"/leave", nil, &left, http.StatusOK)
+	if !left.Left {
+		t.Fatal("challenger did not leave the game")
+	}
+
+	// Nothing handed to clients names a session other than their own.
+	var raw bytes.Buffer
+	json.NewEncoder(&raw).Encode([]any{created, joined, watched, list})
+	if strings.Contains(raw.String(), hostUser.SessionId) || strings.Contains(raw.String(), challengerUser.SessionId) {
+		t.Fatalf("responses contain session ids: %s", raw.String())
+	}
+
+	anonymous := newRestClient(t, server)
+	anonymous.do(http.MethodGet, "/lobbies", nil, nil, http.StatusUnauthorized)
+}
+
+// TestAPIFieldNames checks that every field of the JSON and NATS APIs is
+// named in snake case, down to the game states they carry.
+func TestAPIFieldNames(t *testing.T) {
+	types := []any{
+		api.LoginRequest{}, api.LoginResponse{}, api.CreateRequest{}, api.GameRequest{},
+		api.MoveRequest{}, api.GameResponse{}, api.LeaveResponse{}, api.ListRequest{},
+		api.ListResponse{}, api.UserResponse{}, api.MovesResponse{}, api.Error{},
+		api.SocketCommand{}, api.SocketEvent{},
+	}
+
+	seen := map[reflect.Type]bool{}
+	var check func(typ reflect.Type)
+	check = func(typ reflect.Type) {
+		for typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Map {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct || typ == reflect.TypeOf(time.Time{}) || seen[typ] {
+			return
+		}
+		seen[typ] = true
+
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			if name != "" && name != strings.ToLower(name) {
+				t.Errorf("%s.%s is named %q, want snake case", typ.Name(), field.Name, name)
+			}
+			check(field.Type)
+		}
+	}
+	for _, v := range types {
+		check(reflect.TypeOf(v))
+	}
+}
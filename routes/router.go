@@ -4,51 +4,33 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"log/slog"
+	"os"
 	"time"
 
-	"github.com/delaneyj/toolbelt/embeddednats"
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/sessions"
-	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/archive"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
 )
 
 func SetupRoutes(ctx context.Context, logger *slog.Logger, router chi.Router) (cleanup func() error, err error) {
-	natsPort := 1234
-
-	log.Printf("Starting on Nats server %d", natsPort)
-	ns, err := embeddednats.New(ctx, embeddednats.WithNATSServerOptions(&server.Options{
-		JetStream: true,
-		Port:      natsPort,
-	}))
+	natsConfig := loadNATSConfig()
 
+	nc, cleanup, err := connectNATS(ctx, natsConfig)
 	if err != nil {
-		return nil, fmt.Errorf("error creating embedded nats server: %w", err)
-	}
-
-	ns.WaitForServer()
-
-	cleanup = func() error {
-		return errors.Join(
-			ns.Close(),
-		)
+		return nil, err
 	}
 
 	sessionStore := sessions.NewCookieStore([]byte("session-secret"))
 	sessionStore.MaxAge(int(24 * time.Hour / time.Second))
 
-	nc, err := ns.Client()
-	if err != nil {
-		err = fmt.Errorf("error creating nats client: %w", err)
-		return nil, err
-	}
-
 	js, err := jetstream.New(nc)
 	if err != nil {
 		err = fmt.Errorf("error creating nats client: %w", err)
-		return nil, err
+		return cleanup, err
 	}
 
 	createKeyValueBuckets := func(ctx context.Context, js jetstream.JetStream) error {
@@ -67,15 +49,59 @@ func SetupRoutes(ctx context.Context, logger *slog.Logger, router chi.Router) (c
 			return nil
 		}
 
-		if err := createBucket("gameLobbies", "Datastar Tic Tac Toe Game"); err != nil {
+		if err := createBucket(store.LobbiesBucket, "Datastar Tic Tac Toe Game"); err != nil {
 			return err
 		}
-		if err := createBucket("gameBoards", "Datastar Tic Tac Toe Game"); err != nil {
+		if err := createBucket(store.BoardsBucket, "Datastar Tic Tac Toe Game"); err != nil {
 			return err
 		}
-		if err := createBucket("users", "Datastar Tic Tac Toe Game"); err != nil {
+		if err := createBucket(store.UsersBucket, "Datastar Tic Tac Toe Game"); err != nil {
 			return err
 		}
+		// Invites live as long as their game, which removes them, or until
+		// their own expiry; the janitor sweeps up the rest.
+		if _, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket:      store.InvitesBucket,
+			Description: "Datastar Tic Tac Toe Invites",
+			Compression: true,
+			MaxBytes:    16 * 1024 * 1024,
+			History:     2,
+		}); err != nil {
+			return fmt.Errorf("error creating bucket %q: %w", store.InvitesBucket, err)
+		}
+		if _, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket:      store.SpectatorsBucket,
+			Description: "Datastar Tic Tac Toe Spectators",
+			TTL:         spectatorTTL,
+			History:     1,
+		}); err != nil {
+			return fmt.Errorf("error creating bucket %q: %w", store.SpectatorsBucket, err)
+		}
+		if _, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket:      store.MatchQueueBucket,
+			Description: "Datastar Tic Tac Toe Quick Match Queue",
+			TTL:         matchQueueTTL,
+			History:     1,
+		}); err != nil {
+			return fmt.Errorf("error creating bucket %q: %w", store.MatchQueueBucket, err)
+		}
+		if _, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket:      store.PresenceBucket,
+			Description: "Datastar Tic Tac Toe Presence",
+			TTL:         presenceTTL,
+			History:     1,
+		}); err != nil {
+			return fmt.Errorf("error creating bucket %q: %w", store.PresenceBucket, err)
+		}
+		// Players outlive sessions, so unlike users they never expire.
+		if _, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket:      store.PlayersBucket,
+			Description: "Datastar Tic Tac Toe Players",
+			Compression: true,
+			History:     1,
+		}); err != nil {
+			return fmt.Errorf("error creating bucket %q: %w", store.PlayersBucket, err)
+		}
 		return nil
 	}
 
@@ -83,10 +109,129 @@ func SetupRoutes(ctx context.Context, logger *slog.Logger, router chi.Router) (c
 		return cleanup, err
 	}
 
+	if _, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:        moveStream,
+		Description: "Datastar Tic Tac Toe Moves",
+		Subjects: []string{
+			moveSubject("*"),
+			eventSubject("*", components.EventForfeit),
+			eventSubject("*", components.EventReset),
+			rejectionSubject("*"),
+		},
+		Compression: jetstream.S2Compression,
+		MaxAge:      7 * 24 * time.Hour,
+		MaxBytes:    64 * 1024 * 1024,
+	}); err != nil {
+		return cleanup, fmt.Errorf("error creating stream %q: %w", moveStream, err)
+	}
+
+	// Only the recent messages of every game are kept, to replay them to
+	// whoever opens it.
+	if _, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:              chatStream,
+		Description:       "Datastar Tic Tac Toe Chat",
+		Subjects:          []string{chatSubject("*")},
+		MaxMsgsPerSubject: chatHistory,
+		MaxAge:            24 * time.Hour,
+		MaxBytes:          16 * 1024 * 1024,
+	}); err != nil {
+		return cleanup, fmt.Errorf("error creating stream %q: %w", chatStream, err)
+	}
+
+	if _, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:        lobbyChatStream,
+		Description: "Datastar Tic Tac Toe Lobby Chat",
+		Subjects:    []string{"ttt.lobby.chat.>"},
+		MaxMsgs:     lobbyChatHistory,
+		MaxAge:      7 * 24 * time.Hour,
+		MaxBytes:    16 * 1024 * 1024,
+	}); err != nil {
+		return cleanup, fmt.Errorf("error creating stream %q: %w", lobbyChatStream, err)
+	}
+
+	repos, err := store.NewNATS(ctx, js)
+	if err != nil {
+		return cleanup, err
+	}
+
+	// Other instances may be creating games on a shared deployment, so only
+	// the sole user of the embedded server can tell orphans from games that
+	// are being written.
+	if natsConfig.embedded() {
+		if err := reconcileGames(ctx, repos); err != nil {
+			return cleanup, err
+		}
+	}
+
+	if err := startProjector(ctx, js, repos); err != nil {
+		return cleanup, err
+	}
+
+	if err := startBots(ctx, js, repos); err != nil {
+		return cleanup, err
+	}
+
+	if err := startMatchmaker(ctx, repos); err != nil {
+		return cleanup, err
+	}
+
+	if err := startClocks(ctx, js, repos); err != nil {
+		return cleanup, err
+	}
+
+	janitor := janitorConfig{
+		Grace:     defaultJanitorGrace,
+		UserGrace: defaultJanitorUserGrace,
+	}
+	if value, ok := os.LookupEnv("JANITOR_GRACE"); ok {
+		if janitor.Grace, err = time.ParseDuration(value); err != nil {
+			return cleanup, fmt.Errorf("invalid JANITOR_GRACE %q: %w", value, err)
+		}
+	}
+	if value, ok := os.LookupEnv("JANITOR_USER_GRACE"); ok {
+		if janitor.UserGrace, err = time.ParseDuration(value); err != nil {
+			return cleanup, fmt.Errorf("invalid JANITOR_USER_GRACE %q: %w", value, err)
+		}
+	}
+	if err := startJanitor(ctx, repos, janitor); err != nil {
+		return cleanup, err
+	}
+
+	archivePath := defaultArchivePath
+	if path, ok := os.LookupEnv("ARCHIVE_PATH"); ok {
+		archivePath = path
+	}
+	games, err := archive.Open(ctx, archivePath)
+	if err != nil {
+		return cleanup, err
+	}
+	closeNATS := cleanup
+	cleanup = func() error {
+		return errors.Join(
+			closeNATS(),
+			games.Close(),
+		)
+	}
+
+	if err := startArchiver(ctx, js, repos, games); err != nil {
+		return cleanup, err
+	}
+
+	service := newGameService(js, repos, parseAdmins(os.Getenv("ADMIN_USERS")))
+
+	if err := startMicroService(ctx, nc, service); err != nil {
+		return cleanup, err
+	}
+
 	if err := errors.Join(
-		setupIndexRoute(router, sessionStore, js),
-		setupDashboardRoute(router, sessionStore, js),
-		setupGameRoute(router, sessionStore, js),
+		setupIndexRoute(router, sessionStore, service),
+		setupDashboardRoute(router, sessionStore, repos, service),
+		setupGameRoute(router, sessionStore, repos, service),
+		setupReplayRoute(router, sessionStore, repos, js),
+		setupLeaderboardRoute(router, sessionStore, repos),
+		setupInviteRoute(router, sessionStore, repos),
+		setupRestRoute(router, sessionStore, service),
+		setupWebSocketRoute(router, sessionStore, service),
 	); err != nil {
 		return cleanup, fmt.Errorf("error setting up routes: %w", err)
 	}
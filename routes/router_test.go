@@ -0,0 +1,339 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// startNATS runs a JetStream server for the test on a free port.
+func startNATS(t *testing.T) *server.Server {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{
+		JetStream: true,
+		Port:      -1,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create nats server: %v", err)
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+// startReplica serves the app against the NATS deployment in NATS_URL, the
+// way every replica of a deployment does.
+func startReplica(t *testing.T, ctx context.Context, name string) *httptest.Server {
+	t.Helper()
+	t.Setenv("ARCHIVE_PATH", filepath.Join(t.TempDir(), name+".db"))
+
+	router := chi.NewRouter()
+	cleanup, err := SetupRoutes(ctx, slog.Default(), router)
+	if cleanup != nil {
+		t.Cleanup(func() {
+			if err := cleanup(); err != nil {
+				t.Logf("failed to clean up %s: %v", name, err)
+			}
+		})
+	}
+	if err != nil {
+		t.Fatalf("SetupRoutes() of %s error = %v", name, err)
+	}
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// gamePage follows the game updates seen by a client and keeps the latest
+// version of every element of the game page, with the elements sent since
+// merged into it.
+type gamePage struct {
+	mu        sync.Mutex
+	fragments map[string]string
+}
+
+// fragmentId matches the tag and id of the element a fragment replaces.
+var fragmentId = regexp.MustCompile(`^<(\w+) id="([^"]+)"`)
+
+// replaceElement replaces the element with id in html by fragment, the way
+// the browser morphs a fragment into the page.
+func replaceElement(html, tag, id, fragment string) string {
+	start := strings.Index(html, "<"+tag+` id="`+id+`"`)
+	if start < 0 {
+		return html
+	}
+
+	open, end := "<"+tag, "</"+tag+">"
+	depth := 0
+	for i := start; i < len(html); {
+		switch {
+		case strings.HasPrefix(html[i:], end):
+			i += len(end)
+			if depth--; depth == 0 {
+				return html[:start] + fragment + html[i:]
+			}
+		case strings.HasPrefix(html[i:], open+" "), strings.HasPrefix(html[i:], open+">"):
+			depth++
+			i += len(open)
+		default:
+			i++
+		}
+	}
+	return html
+}
+
+func watchGamePage(t *testing.T, ctx context.Context, client *restClient, id string) *gamePage {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.server.URL+"/api/game/"+id+"/updates", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := client.client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to follow game updates: %v", err)
+	}
+
+	page := &gamePage{fragments: map[string]string{}}
+	go func() {
+		defer resp.Body.Close()
+
+		// Events end with a blank line, fragments may span several data
+		// lines.
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		var lines []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line != "" {
+				if data, ok := strings.CutPrefix(line, "data: fragments "); ok {
+					lines = append(lines, data)
+				}
+				continue
+			}
+
+			fragment := strings.Join(lines, "\n")
+			lines = nil
+			match := fragmentId.FindStringSubmatch(fragment)
+			if match == nil {
+				continue
+			}
+			tag, id := match[1], match[2]
+			page.mu.Lock()
+			for other, html := range page.fragments {
+				page.fragments[other] = replaceElement(html, tag, id, fragment)
+			}
+			page.fragments[id] = fragment
+			page.mu.Unlock()
+		}
+	}()
+	return page
+}
+
+// snapshot returns the latest fragment of every element.
+func (p *gamePage) snapshot() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return maps.Clone(p.fragments)
+}
+
+// TestReplicasShareGames plays two games of a series between players on two
+// replicas of the app sharing one NATS server. Every move must reach both
+// replicas, which must render the same page for the same player and agree on
+// the series and ratings.
+func TestReplicasShareGames(t *testing.T) {
+	ns := startNATS(t)
+	t.Setenv("NATS_URL", ns.ClientURL())
+	t.Setenv("ADMIN_USERS", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replicaA := startReplica(t, ctx, "a")
+	replicaB := startReplica(t, ctx, "b")
+
+	// Sessions are cookies signed with the same secret on every replica, so
+	// each player can follow the game on both.
+	host := newRestClient(t, replicaA)
+	hostOnB := &restClient{t: t, server: replicaB, client: host.client}
+	challenger := newRestClient(t, replicaB)
+	challengerOnA := &restClient{t: t, server: replicaA, client: challenger.client}
+
+	hostUser := host.login("alice")
+	challengerUser := challenger.login("bob")
+
+	var created api.GameResponse
+	host.do(http.MethodPost, "/lobbies", map[string]any{"best_of": 3}, &created, http.StatusCreated)
+	id := created.Lobby.Id
+	challenger.do(http.MethodPost, "/lobbies/"+id+"/join", nil, nil, http.StatusOK)
+
+	views := []struct {
+		name  string
+		page  *gamePage
+		board string
+	}{
+		{name: "host on A", page: watchGamePage(t, ctx, host, id)},
+		{name: "host on B", page: watchGamePage(t, ctx, hostOnB, id)},
+		{name: "challenger on B", page: watchGamePage(t, ctx, challenger, id)},
+		{name: "challenger on A", page: watchGamePage(t, ctx, challengerOnA, id)},
+	}
+
+	// expectSame waits for a new board on every view and checks that both
+	// replicas render the whole page alike for each player.
+	expectSame := func(step string) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			pages := make([]map[string]string, len(views))
+			same := true
+			for i, view := range views {
+				pages[i] = view.page.snapshot()
+				if board := pages[i]["gameboard"]; board == "" || board == view.board {
+					same = false
+				}
+			}
+			for i := 0; same && i < len(views); i += 2 {
+				same = maps.Equal(pages[i], pages[i+1])
+			}
+			if same {
+				for i := range views {
+					views[i].board = pages[i]["gameboard"]
+				}
+				return
+			}
+
+			if time.Now().After(deadline) {
+				for i := 0; i < len(views); i += 2 {
+					for id, fragment := range pages[i] {
+						if other := pages[i+1][id]; other != fragment {
+							// Show where the fragments start to differ.
+							at := 0
+							for at < min(len(fragment), len(other)) && fragment[at] == other[at] {
+								at++
+							}
+							at = max(at-80, 0)
+							t.Errorf("%s: #%s on %s\n...%s\non %s\n...%s", step, id, views[i].name, fragment[at:], views[i+1].name, other[min(at, len(other)):])
+						}
+					}
+				}
+				t.Fatalf("%s: replicas did not render the same new board", step)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	expectSame("start")
+
+	// waitRating waits until the rating of the host changed from rating and
+	// returns it.
+	waitRating := func(rating int) int {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var user api.UserResponse
+			hostOnB.do(http.MethodGet, "/users/me", nil, &user, http.StatusOK)
+			if user.Rating != rating {
+				return user.Rating
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("rating of the host stayed at %d", rating)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// playRound lets X take the top row while O answers. The marks swap every
+	// round, so the player on either replica may be X.
+	playRound := func(round int) api.GameResponse {
+		t.Helper()
+		x, o := host, challenger
+		var state api.GameResponse
+		host.do(http.MethodGet, "/games/"+id, nil, &state, http.StatusOK)
+		if game.MarkOf(state.State, components.SeatHost) != game.PlayerX {
+			x, o = challenger, host
+		}
+
+		for i, cell := range []int{0, 3, 1, 4, 2} {
+			player := x
+			if i%2 == 1 {
+				player = o
+			}
+			player.do(http.MethodPost, "/games/"+id+"/moves", api.Move{Cell: cell}, nil, http.StatusAccepted)
+			expectSame(fmt.Sprintf("round %d, move %d on cell %d", round, i+1, cell))
+		}
+
+		var played api.GameResponse
+		challenger.do(http.MethodGet, "/games/"+id, nil, &played, http.StatusOK)
+		if played.State.Round != round || played.State.Winner != game.PlayerX || played.State.Moves != 5 {
+			t.Fatalf("game after round %d = %+v, want X to win in 5 moves", round, played.State)
+		}
+		return played
+	}
+
+	playRound(0)
+	// The win is rated once, whichever replica projected the last move.
+	rating := waitRating(hostUser.Rating)
+	if rating <= hostUser.Rating {
+		t.Fatalf("rating of the winner = %d, want more than %d", rating, hostUser.Rating)
+	}
+
+	challenger.do(http.MethodPost, "/games/"+id+"/reset", nil, nil, http.StatusAccepted)
+	expectSame("reset")
+	played := playRound(1)
+	waitRating(rating)
+
+	// Both replicas tell both players the same series and ratings.
+	if series := played.State.Series; series == nil || series.HostWins != 1 || series.ChallengerWins != 1 {
+		t.Fatalf("series after two rounds = %+v, want one win each", series)
+	}
+	for _, player := range []struct {
+		name   string
+		onA    *restClient
+		onB    *restClient
+		before api.UserResponse
+	}{
+		{"host", host, hostOnB, hostUser},
+		{"challenger", challengerOnA, challenger, challengerUser},
+	} {
+		var gameA, gameB api.GameResponse
+		player.onA.do(http.MethodGet, "/games/"+id, nil, &gameA, http.StatusOK)
+		player.onB.do(http.MethodGet, "/games/"+id, nil, &gameB, http.StatusOK)
+		if !reflect.DeepEqual(gameA, gameB) {
+			t.Fatalf("game of the %s on A = %+v, on B = %+v", player.name, gameA, gameB)
+		}
+
+		var userA, userB api.UserResponse
+		player.onA.do(http.MethodGet, "/users/me", nil, &userA, http.StatusOK)
+		player.onB.do(http.MethodGet, "/users/me", nil, &userB, http.StatusOK)
+		if userA != userB || userA.Rating == player.before.Rating {
+			t.Fatalf("%s on A = %+v, on B = %+v, want the same rating other than %d", player.name, userA, userB, player.before.Rating)
+		}
+	}
+
+	// The history of the game holds both rounds and the reset between them.
+	var history api.MovesResponse
+	hostOnB.do(http.MethodGet, "/games/"+id+"/moves", nil, &history, http.StatusOK)
+	if len(history.Moves) != 11 || history.Moves[5].Event != components.EventReset {
+		t.Fatalf("history = %+v, want 5 moves, a reset and 5 moves", history.Moves)
+	}
+}
@@ -0,0 +1,427 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/bot"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// unknownPlayerName names the seats of users that are gone.
+const unknownPlayerName = "Unknown player"
+
+var (
+	errNotSeated      = errors.New("only seated players can do this")
+	errNotHost        = errors.New("only the host can do this")
+	errUnknownSession = errors.New("unknown session")
+	// errGameRunning is returned for a reset of a game that was not decided
+	// yet, which would let the losing player walk away unscored.
+	errGameRunning = errors.New("game is still running")
+)
+
+// gameService holds the operations on games shared by every way of reaching
+// the app, so the Datastar handlers and the NATS and HTTP APIs apply the same
+// rules. Every operation is made on behalf of a session.
+type gameService struct {
+	repos   *store.Repos
+	moves   *moves
+	players *players
+	chat    *chat
+	// lobbyChat is the chat room of the dashboard.
+	lobbyChat *lobbyChat
+	admins    admins
+}
+
+func newGameService(js jetstream.JetStream, repos *store.Repos, admins admins) *gameService {
+	return &gameService{
+		repos:     repos,
+		moves:     newMoves(js, repos),
+		players:   newPlayers(repos),
+		chat:      newChat(js, repos, maskWords(defaultBlockedWords...)),
+		lobbyChat: newLobbyChat(js, repos, maskWords(defaultBlockedWords...), admins),
+		admins:    admins,
+	}
+}
+
+// defaultGameSettings are the settings of a game nobody configured.
+func defaultGameSettings() components.GameSettings {
+	return components.GameSettings{
+		Mode:      components.ModeClassic,
+		BoardSize: game.DefaultSize,
+		WinLength: game.DefaultSize,
+	}
+}
+
+// login signs in the player registered under name, registering it the first
+// time the name is used, and starts a new session for it.
+func (s *gameService) login(ctx context.Context, name, password string) (*components.User, error) {
+	// Names are stored trimmed, so only the trimmed name has to be long enough.
+	name = strings.TrimSpace(name)
+	if len(name) < minNameLength || len(password) < minPasswordLength {
+		return nil, errBadCredentials
+	}
+
+	player, err := s.players.login(ctx, name, password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &components.User{
+		SessionId: newSessionId(),
+		Name:      player.Name,
+		PlayerId:  player.Id,
+	}
+	if _, err := s.repos.Users.Create(ctx, user.SessionId, *user); err != nil {
+		return nil, fmt.Errorf("failed to put user data: %w", err)
+	}
+
+	return user, nil
+}
+
+// logout ends a session along with the games it hosts.
+func (s *gameService) logout(ctx context.Context, sessionId string) error {
+	if user, _, err := s.repos.Users.Get(ctx, sessionId); err == nil {
+		for _, id := range user.HostedGames {
+			if err := removeGame(ctx, s.repos, id); err != nil {
+				log.Printf("Error removing game %s of %s: %v", id, sessionId, err)
+			}
+		}
+	}
+
+	if err := s.repos.Users.Delete(ctx, sessionId); err != nil {
+		return fmt.Errorf("failed to delete key '%s': %w", sessionId, err)
+	}
+	return nil
+}
+
+// seen records that user made a request. Clients of the APIs may send
+// requests without keeping a connection open, so the janitor goes by them
+// too. Requests are recorded at most once per presence heartbeat.
+func (s *gameService) seen(ctx context.Context, user *components.User) {
+	now := time.Now().UTC()
+	if now.Sub(user.LastSeenAt) < presenceHeartbeat {
+		return
+	}
+	if _, err := store.Modify(ctx, s.repos.Users, user.SessionId, func(user *components.User) error {
+		user.LastSeenAt = now
+		return nil
+	}); err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("Failed to record request of %s: %v", user.SessionId, err)
+	}
+}
+
+// user returns the user behind a session and its rating.
+func (s *gameService) user(ctx context.Context, sessionId string) (*components.User, int, error) {
+	user, _, err := s.repos.Users.Get(ctx, sessionId)
+	if err != nil {
+		return nil, 0, err
+	}
+	rating, err := s.players.ratingOf(ctx, sessionId)
+	if err != nil {
+		return nil, 0, err
+	}
+	return user, rating, nil
+}
+
+// create starts a game hosted by sessionId. Games against a bot start with
+// the bot seated; private games get an invite.
+func (s *gameService) create(ctx context.Context, sessionId string, settings components.GameSettings) (*components.GameLobby, error) {
+	var engine game.Engine
+
+	if _, _, err := s.repos.Users.Get(ctx, sessionId); err != nil {
+		return nil, err
+	}
+
+	id, name := generateGameDetails()
+	gameState, err := engine.NewGame(id, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	gameLobby := createGameLobby(name, sessionId, gameState, settings.Private)
+	if settings.Opponent != "" {
+		difficulty, err := bot.ParseDifficulty(settings.Opponent)
+		if err != nil {
+			return nil, err
+		}
+		// Bots are shared by every game, the first game creates their user.
+		if _, err := s.repos.Users.Create(ctx, bot.Id(difficulty), bot.User(difficulty)); err != nil && !errors.Is(err, store.ErrConflict) {
+			return nil, fmt.Errorf("failed to store bot user: %w", err)
+		}
+		gameLobby.ChallengerId = bot.Id(difficulty)
+	}
+
+	if gameLobby.Private && gameLobby.ChallengerId == "" {
+		invite := components.Invite{
+			Code:   newInviteCode(),
+			GameId: id,
+		}
+		if settings.InviteTTL > 0 {
+			invite.ExpiresAt = time.Now().UTC().Add(time.Duration(settings.InviteTTL) * time.Minute)
+		}
+		if _, err := s.repos.Invites.Create(ctx, invite.Code, invite); err != nil {
+			return nil, fmt.Errorf("failed to store invite: %w", err)
+		}
+		gameLobby.InviteCode = invite.Code
+	}
+
+	if err := storeGame(ctx, s.repos, gameLobby, gameState); err != nil {
+		if gameLobby.InviteCode != "" {
+			if err := s.repos.Invites.Purge(ctx, gameLobby.InviteCode); err != nil {
+				log.Printf("Failed to remove invite %s of game %s: %v", gameLobby.InviteCode, gameLobby.Id, err)
+			}
+		}
+		return nil, err
+	}
+
+	return &gameLobby, nil
+}
+
+// remove deletes a game hosted by sessionId.
+func (s *gameService) remove(ctx context.Context, sessionId, id string) error {
+	gameLobby, _, err := s.repos.Lobbies.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if gameLobby.HostId != sessionId {
+		return errNotHost
+	}
+	return removeGame(ctx, s.repos, id)
+}
+
+// join seats sessionId as the challenger of a public game.
+func (s *gameService) join(ctx context.Context, sessionId, id string) error {
+	return takeSeat(ctx, s.repos, id, sessionId, false)
+}
+
+// move plays a cell for sessionId. Classic games ignore board.
+func (s *gameService) move(ctx context.Context, sessionId, id string, board, cell int) error {
+	return s.moves.play(ctx, id, sessionId, board, cell)
+}
+
+// reset starts the next game of a lobby once the current one is decided.
+// Like a move, the reset is published and reaches the board once the
+// projector folds it in.
+func (s *gameService) reset(ctx context.Context, sessionId, id string) error {
+	gameLobby, _, err := s.repos.Lobbies.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !seated(gameLobby, sessionId) {
+		return errNotSeated
+	}
+
+	gameState, _, err := s.repos.Boards.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if gameState.Winner == "" {
+		return errGameRunning
+	}
+
+	record := eventRecord(gameState, components.EventReset, time.Now().UTC())
+	record.SessionId = sessionId
+	record.Player = playerFor(gameLobby, gameState, sessionId)
+	return s.moves.recordEvent(ctx, record)
+}
+
+// leave gives up the challenger's seat. It reports whether sessionId held
+// the seat; hosts and spectators leave without changing the game.
+func (s *gameService) leave(ctx context.Context, sessionId, id string) (bool, error) {
+	gameLobby, revision, err := s.repos.Lobbies.Get(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if sessionId != gameLobby.ChallengerId {
+		return false, nil
+	}
+
+	gameLobby.ChallengerId = ""
+	if _, err := s.repos.Lobbies.Update(ctx, id, *gameLobby, revision); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// history returns the moves and events of a game visible to sessionId,
+// oldest first, leaving out the ones that were rejected.
+func (s *gameService) history(ctx context.Context, sessionId, id string) ([]api.MoveRecord, error) {
+	if _, err := s.lobby(ctx, sessionId, id); err != nil {
+		return nil, err
+	}
+	records, err := s.moves.history(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := make([]api.MoveRecord, len(records))
+	for i, record := range records {
+		moves[i] = api.MoveRecord{
+			Round:     record.Round,
+			Sequence:  record.Sequence,
+			Player:    record.Player,
+			Board:     record.Board,
+			Cell:      record.Cell,
+			Event:     record.Event,
+			Timestamp: record.Timestamp,
+		}
+	}
+	return moves, nil
+}
+
+// list returns the lobbies visible to sessionId.
+func (s *gameService) list(ctx context.Context, sessionId string) ([]api.Lobby, error) {
+	keys, err := s.repos.Lobbies.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lobbies := make([]api.Lobby, 0, len(keys))
+	for _, key := range keys {
+		gameLobby, _, err := s.repos.Lobbies.Get(ctx, key)
+		if err != nil {
+			// Removed since the keys were listed.
+			continue
+		}
+		if visibleTo(gameLobby, sessionId) {
+			lobbies = append(lobbies, s.apiLobby(ctx, sessionId, gameLobby))
+		}
+	}
+	return lobbies, nil
+}
+
+// lobby returns the lobby of a game if it is visible to sessionId. Private
+// games are hidden from everyone not seated in them, like on the dashboard.
+func (s *gameService) lobby(ctx context.Context, sessionId, id string) (*components.GameLobby, error) {
+	gameLobby, _, err := s.repos.Lobbies.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !visibleTo(gameLobby, sessionId) {
+		return nil, store.ErrNotFound
+	}
+	return gameLobby, nil
+}
+
+// game returns a game visible to sessionId with its board.
+func (s *gameService) game(ctx context.Context, sessionId, id string) (*api.GameResponse, error) {
+	gameLobby, err := s.lobby(ctx, sessionId, id)
+	if err != nil {
+		return nil, err
+	}
+	gameState, _, err := s.repos.Boards.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GameResponse{Lobby: s.apiLobby(ctx, sessionId, gameLobby), State: *gameState}, nil
+}
+
+// apiLobby shows gameLobby to sessionId, naming the seats by their players.
+func (s *gameService) apiLobby(ctx context.Context, sessionId string, gameLobby *components.GameLobby) api.Lobby {
+	name := func(seatId string) string {
+		if seatId == "" {
+			return ""
+		}
+		if user, _, err := s.repos.Users.Get(ctx, seatId); err == nil {
+			return user.Name
+		}
+		return unknownPlayerName
+	}
+
+	lobby := api.Lobby{
+		Id:         gameLobby.Id,
+		Name:       gameLobby.Name,
+		Host:       name(gameLobby.HostId),
+		Challenger: name(gameLobby.ChallengerId),
+		Seat:       seatOf(gameLobby, sessionId),
+		Mode:       gameLobby.Mode,
+		Size:       gameLobby.Size,
+		WinLength:  gameLobby.WinLength,
+		Private:    gameLobby.Private,
+		BestOf:     gameLobby.BestOf,
+	}
+	if lobby.Seat == components.SeatHost {
+		lobby.InviteCode = gameLobby.InviteCode
+	}
+	return lobby
+}
+
+// createErrorMessage returns a user facing message for settings the game
+// engine rejected.
+func createErrorMessage(err error) (string, bool) {
+	switch {
+	case errors.Is(err, game.ErrInvalidMode):
+		return "Unknown game mode.", true
+	case errors.Is(err, game.ErrInvalidSeries):
+		return fmt.Sprintf("Series must be an odd number of games up to %d.", game.MaxBestOf), true
+	case errors.Is(err, game.ErrInvalidClock):
+		return fmt.Sprintf("Move time must be 0 or at least %d seconds and game time at most %d minutes.", int(game.MinMoveTime.Seconds()), int(game.MaxGameTime.Minutes())), true
+	case errors.Is(err, game.ErrInvalidSize), errors.Is(err, game.ErrInvalidWinLength):
+		return fmt.Sprintf("Board size must be %d-%d and win length between %d and the board size.", game.MinSize, game.MaxSize, game.MinWinLength), true
+	case errors.Is(err, bot.ErrUnknownDifficulty):
+		return "Unknown bot difficulty.", true
+	default:
+		return "", false
+	}
+}
+
+// serviceError maps an error of the game service to an HTTP status and a
+// message for API clients.
+func serviceError(err error) (int, string) {
+	if msg, ok := createErrorMessage(err); ok {
+		return http.StatusBadRequest, msg
+	}
+	if msg, ok := chatErrorMessage(err); ok {
+		switch {
+		case errors.Is(err, errNotInGame):
+			return http.StatusForbidden, msg
+		case errors.Is(err, errChatRateLimited):
+			return http.StatusTooManyRequests, msg
+		default:
+			return http.StatusBadRequest, msg
+		}
+	}
+	if msg, ok := moveErrorMessage(err); ok {
+		switch {
+		case errors.Is(err, errSpectator):
+			return http.StatusForbidden, msg
+		case errors.Is(err, errStaleMove), errors.Is(err, store.ErrConflict):
+			return http.StatusConflict, msg
+		default:
+			return http.StatusUnprocessableEntity, msg
+		}
+	}
+
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound, "Not found"
+	case errors.Is(err, errBadCredentials):
+		return http.StatusUnauthorized, "Invalid name or password"
+	case errors.Is(err, errUnknownSession):
+		return http.StatusUnauthorized, "Unknown session"
+	case errors.Is(err, errNotSeated):
+		return http.StatusForbidden, "Only seated players can do this"
+	case errors.Is(err, errGameRunning):
+		return http.StatusConflict, "Finish the game before starting the next one"
+	case errors.Is(err, errNotHost):
+		return http.StatusForbidden, "Only the host can do this"
+	case errors.Is(err, errNotAdmin):
+		return http.StatusForbidden, "Only the admin can do this"
+	case errors.Is(err, errGamePrivate):
+		return http.StatusForbidden, "This game is private"
+	case errors.Is(err, errGameFull), errors.Is(err, errSeatTaken):
+		return http.StatusConflict, "Game is full"
+	default:
+		return http.StatusInternalServerError, err.Error()
+	}
+}
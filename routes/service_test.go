@@ -0,0 +1,334 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/bot"
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// fakeJetStream keeps the messages published to it instead of sending them
+// anywhere. Calling any other method panics.
+type fakeJetStream struct {
+	jetstream.JetStream
+
+	mu        sync.Mutex
+	published []*nats.Msg
+}
+
+func (f *fakeJetStream) PublishMsg(ctx context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, msg)
+	return &jetstream.PubAck{Stream: moveStream, Sequence: uint64(len(f.published))}, nil
+}
+
+// moves returns the moves published to the game stored under gameId.
+func (f *fakeJetStream) moves(t *testing.T, gameId string) []components.MoveRecord {
+	return f.records(t, moveSubject(gameId))
+}
+
+// events returns the events of a kind published for the game stored under
+// gameId.
+func (f *fakeJetStream) events(t *testing.T, gameId, event string) []components.MoveRecord {
+	return f.records(t, eventSubject(gameId, event))
+}
+
+// records decodes the records published on subject, oldest first.
+func (f *fakeJetStream) records(t *testing.T, subject string) []components.MoveRecord {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var records []components.MoveRecord
+	for _, msg := range f.published {
+		if msg.Subject != subject {
+			continue
+		}
+		var record components.MoveRecord
+		if err := json.Unmarshal(msg.Data, &record); err != nil {
+			t.Fatalf("failed to unmarshal %s: %v", subject, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// mustProjectLast folds the last record published with a subject into its
+// board like the projector.
+func mustProjectLast(t *testing.T, service *gameService, records []components.MoveRecord) {
+	t.Helper()
+	if len(records) == 0 {
+		t.Fatal("nothing was published")
+	}
+	if err := service.moves.project(context.Background(), records[len(records)-1]); err != nil {
+		t.Fatalf("project() error = %v", err)
+	}
+}
+
+// newTestService returns a game service on an empty memory store.
+func newTestService() (*gameService, *fakeJetStream) {
+	js := &fakeJetStream{}
+	return newGameService(js, store.NewMemory(), admins{}), js
+}
+
+func mustLogin(t *testing.T, service *gameService, name string) string {
+	t.Helper()
+	user, err := service.login(context.Background(), name, "secret")
+	if err != nil {
+		t.Fatalf("login(%q) error = %v", name, err)
+	}
+	return user.SessionId
+}
+
+// mustPlay makes a move and folds it into the board like the projector.
+func mustPlay(t *testing.T, service *gameService, js *fakeJetStream, sessionId, id string, cell int) {
+	t.Helper()
+	ctx := context.Background()
+	if err := service.move(ctx, sessionId, id, 0, cell); err != nil {
+		t.Fatalf("move(%d) error = %v", cell, err)
+	}
+	records := js.moves(t, id)
+	if err := service.moves.project(ctx, records[len(records)-1]); err != nil {
+		t.Fatalf("project(%d) error = %v", cell, err)
+	}
+}
+
+func TestServiceGame(t *testing.T) {
+	ctx := context.Background()
+	service, js := newTestService()
+
+	host := mustLogin(t, service, "alice")
+	challenger := mustLogin(t, service, "bob")
+	spectator := mustLogin(t, service, "carol")
+
+	gameLobby, err := service.create(ctx, host, defaultGameSettings())
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	id := gameLobby.Id
+	if err := service.join(ctx, challenger, id); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+
+	mustPlay(t, service, js, host, id, 4)
+	gameState, _, err := service.repos.Boards.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("failed to get board: %v", err)
+	}
+	if gameState.Board[4] != game.PlayerX || gameState.XIsNext {
+		t.Fatalf("board after the first move = %q, X next %v", gameState.Board, gameState.XIsNext)
+	}
+
+	published := len(js.moves(t, id))
+	if err := service.move(ctx, host, id, 0, 0); !errors.Is(err, game.ErrNotYourTurn) {
+		t.Fatalf("move() out of turn error = %v, want ErrNotYourTurn", err)
+	}
+	if err := service.move(ctx, challenger, id, 0, 4); !errors.Is(err, game.ErrCellOccupied) {
+		t.Fatalf("move() on a taken cell error = %v, want ErrCellOccupied", err)
+	}
+	if err := service.move(ctx, spectator, id, 0, 0); !errors.Is(err, errSpectator) {
+		t.Fatalf("move() by a spectator error = %v, want errSpectator", err)
+	}
+	if got := len(js.moves(t, id)); got != published {
+		t.Fatalf("rejected moves were published, %d moves, want %d", got, published)
+	}
+
+	// Neither player can throw away a game that is still running.
+	for _, player := range []string{host, challenger} {
+		if err := service.reset(ctx, player, id); !errors.Is(err, errGameRunning) {
+			t.Fatalf("reset() of a running game error = %v, want errGameRunning", err)
+		}
+	}
+	if gameState, _, _ = service.repos.Boards.Get(ctx, id); gameState.Round != 0 || gameState.Moves != 1 {
+		t.Fatalf("board after a refused reset = %+v, want round 0 with 1 move", gameState)
+	}
+
+	// O answers every move of X, who takes the top row.
+	for i, cell := range []int{3, 1, 5, 2, 8, 0} {
+		player := challenger
+		if i%2 == 1 {
+			player = host
+		}
+		mustPlay(t, service, js, player, id, cell)
+	}
+	if gameState, _, _ = service.repos.Boards.Get(ctx, id); gameState.Winner != game.PlayerX {
+		t.Fatalf("winner = %q, want X on %q", gameState.Winner, gameState.Board)
+	}
+
+	if err := service.reset(ctx, spectator, id); !errors.Is(err, errNotSeated) {
+		t.Fatalf("reset() by a spectator error = %v, want errNotSeated", err)
+	}
+	if err := service.reset(ctx, host, id); err != nil {
+		t.Fatalf("reset() error = %v", err)
+	}
+	resets := js.events(t, id, components.EventReset)
+	if len(resets) != 1 || resets[0].Round != 0 || resets[0].Sequence != 7 || resets[0].SessionId != host {
+		t.Fatalf("published resets = %+v, want the host resetting round 0 after 7 moves", resets)
+	}
+	mustProjectLast(t, service, resets)
+	// A redelivered reset leaves the new round alone.
+	mustProjectLast(t, service, resets)
+	gameState, _, _ = service.repos.Boards.Get(ctx, id)
+	if gameState.Round != 1 || gameState.Moves != 0 || gameState.Winner != "" {
+		t.Fatalf("board after reset = %+v, want round 1 with no moves", gameState)
+	}
+	for cell, mark := range gameState.Board {
+		if mark != "" {
+			t.Fatalf("cell %d = %q after reset, want empty", cell, mark)
+		}
+	}
+
+	// Moves of the previous round are not replayed into the new one.
+	records := js.moves(t, id)
+	if err := service.moves.project(ctx, records[len(records)-1]); !errors.Is(err, errStaleMove) {
+		t.Fatalf("project() of a move from the previous round error = %v, want errStaleMove", err)
+	}
+}
+
+func TestServiceLeave(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestService()
+
+	host := mustLogin(t, service, "alice")
+	challenger := mustLogin(t, service, "bob")
+
+	gameLobby, err := service.create(ctx, host, defaultGameSettings())
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	id := gameLobby.Id
+	if err := service.join(ctx, challenger, id); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+
+	if left, err := service.leave(ctx, host, id); err != nil || left {
+		t.Fatalf("leave() by the host = %v, %v, want false", left, err)
+	}
+	if left, err := service.leave(ctx, challenger, id); err != nil || !left {
+		t.Fatalf("leave() by the challenger = %v, %v, want true", left, err)
+	}
+
+	gameLobby, _, err = service.repos.Lobbies.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("failed to get lobby: %v", err)
+	}
+	if gameLobby.ChallengerId != "" || gameLobby.HostId != host {
+		t.Fatalf("lobby after leave = %+v, want only the host seated", gameLobby)
+	}
+
+	// The free seat can be taken again.
+	if err := service.join(ctx, challenger, id); err != nil {
+		t.Fatalf("join() after leave error = %v", err)
+	}
+}
+
+func TestServiceClockStartsWhenSeated(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestService()
+
+	host := mustLogin(t, service, "alice")
+	challenger := mustLogin(t, service, "bob")
+
+	settings := defaultGameSettings()
+	settings.MoveSeconds = 30
+	gameLobby, err := service.create(ctx, host, settings)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	id := gameLobby.Id
+
+	// Nobody is timed while waiting for an opponent.
+	gameState, _, _ := service.repos.Boards.Get(ctx, id)
+	if _, running := game.Deadline(*gameState); running {
+		t.Fatal("clock is running without a challenger")
+	}
+
+	if err := service.join(ctx, challenger, id); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+	gameState, _, _ = service.repos.Boards.Get(ctx, id)
+	if _, running := game.Deadline(*gameState); !running {
+		t.Fatal("clock of the first player is not running once the challenger is seated")
+	}
+
+	// Games against a bot have both seats taken from the start.
+	settings.Opponent = string(bot.Easy)
+	botLobby, err := service.create(ctx, host, settings)
+	if err != nil {
+		t.Fatalf("create() against a bot error = %v", err)
+	}
+	gameState, _, _ = service.repos.Boards.Get(ctx, botLobby.Id)
+	if _, running := game.Deadline(*gameState); !running {
+		t.Fatal("clock of a game against a bot is not running")
+	}
+}
+
+func TestServiceForfeitAfterMoveInTime(t *testing.T) {
+	ctx := context.Background()
+	service, js := newTestService()
+
+	host := mustLogin(t, service, "alice")
+	challenger := mustLogin(t, service, "bob")
+
+	settings := defaultGameSettings()
+	settings.MoveSeconds = 30
+	gameLobby, err := service.create(ctx, host, settings)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	id := gameLobby.Id
+	if err := service.join(ctx, challenger, id); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+
+	if err := service.moves.forfeit(ctx, id, time.Now()); !errors.Is(err, game.ErrClockRunning) {
+		t.Fatalf("forfeit() with time left error = %v, want ErrClockRunning", err)
+	}
+
+	// X moves in time, but the clocks publish the forfeit before the move
+	// is on the board.
+	if err := service.move(ctx, host, id, 0, 4); err != nil {
+		t.Fatalf("move() error = %v", err)
+	}
+	late := time.Now().Add(time.Minute)
+	if err := service.moves.forfeit(ctx, id, late); err != nil {
+		t.Fatalf("forfeit() error = %v", err)
+	}
+
+	// The projector sees the move first, which leaves the forfeit stale.
+	mustProjectLast(t, service, js.moves(t, id))
+	forfeits := js.events(t, id, components.EventForfeit)
+	if err := service.moves.project(ctx, forfeits[0]); !errors.Is(err, errStaleMove) {
+		t.Fatalf("project() of a forfeit after a move in time error = %v, want errStaleMove", err)
+	}
+	gameState, _, _ := service.repos.Boards.Get(ctx, id)
+	if gameState.Winner != "" || gameState.Moves != 1 {
+		t.Fatalf("board after the stale forfeit = %+v, want the game running", gameState)
+	}
+
+	// O lets the time run out.
+	if err := service.moves.forfeit(ctx, id, late); err != nil {
+		t.Fatalf("forfeit() error = %v", err)
+	}
+	forfeits = js.events(t, id, components.EventForfeit)
+	if forfeit := forfeits[len(forfeits)-1]; forfeit.Player != game.PlayerO || forfeit.SessionId != challenger {
+		t.Fatalf("published forfeit = %+v, want the challenger playing O", forfeit)
+	}
+	mustProjectLast(t, service, forfeits)
+	// A redelivered forfeit is already on the board.
+	mustProjectLast(t, service, forfeits)
+	gameState, _, _ = service.repos.Boards.Get(ctx, id)
+	if gameState.Winner != game.PlayerX || gameState.Forfeit != game.PlayerO {
+		t.Fatalf("board after the forfeit = %+v, want O to lose on time", gameState)
+	}
+}
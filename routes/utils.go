@@ -1,28 +1,28 @@
 package routes
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 
 	"github.com/delaneyj/toolbelt"
 	"github.com/gorilla/sessions"
-	"github.com/nats-io/nats.go/jetstream"
 )
 
-func createSessionId(store sessions.Store, r *http.Request, w http.ResponseWriter) (string, error) {
+func newSessionId() string {
+	return toolbelt.NextEncodedID()
+}
+
+func saveSessionId(store sessions.Store, r *http.Request, w http.ResponseWriter, id string) error {
 	session, err := store.Get(r, "connections")
 	if err != nil {
-		return "", fmt.Errorf("failed to get session: %w", err)
+		return fmt.Errorf("failed to get session: %w", err)
 	}
-	id := toolbelt.NextEncodedID()
 	session.Values["id"] = id
 	session.Options.MaxAge = 45 * 60
 	if err := session.Save(r, w); err != nil {
-		return "", fmt.Errorf("failed to save session: %w", err)
+		return fmt.Errorf("failed to save session: %w", err)
 	}
-	return id, nil
+	return nil
 }
 
 func getSessionId(store sessions.Store, r *http.Request) (string, error) {
@@ -50,44 +50,34 @@ func deleteSessionId(store sessions.Store, w http.ResponseWriter, r *http.Reques
 	}
 }
 
-func GetObject[T any](ctx context.Context, kv jetstream.KeyValue, key string) (*T, jetstream.KeyValueEntry, error) {
-	entry, err := kv.Get(ctx, key)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get key %s: %w", key, err)
-	}
-
-	var obj T
-	if err := json.Unmarshal(entry.Value(), &obj); err != nil {
-		return nil, nil, fmt.Errorf("failed to unmarshal value for key %s: %w", key, err)
-	}
-
-	return &obj, entry, nil
-}
-
-func PutData(ctx context.Context, kv jetstream.KeyValue, id string, data interface{}) error {
-	bytes, err := json.Marshal(data)
+// setPendingInvite remembers an invite code for a visitor who still has to
+// log in, so the invite can be followed after the login.
+func setPendingInvite(store sessions.Store, r *http.Request, w http.ResponseWriter, code string) error {
+	session, err := store.Get(r, "connections")
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %w", err)
+		return fmt.Errorf("failed to get session: %w", err)
 	}
-
-	_, err = kv.Put(ctx, id, bytes)
-	if err != nil {
-		return fmt.Errorf("failed to put key-value: %w", err)
+	session.Values["invite"] = code
+	if err := session.Save(r, w); err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
 	}
-
 	return nil
 }
 
-func UpdateData(ctx context.Context, kv jetstream.KeyValue, id string, data interface{}, entry jetstream.KeyValueEntry) error {
-	bytes, err := json.Marshal(data)
+// popPendingInvite returns and forgets the invite code saved by
+// setPendingInvite, or "" if there is none.
+func popPendingInvite(store sessions.Store, r *http.Request, w http.ResponseWriter) (string, error) {
+	session, err := store.Get(r, "connections")
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %w", err)
+		return "", fmt.Errorf("failed to get session: %w", err)
 	}
-
-	_, err = kv.Update(ctx, id, bytes, entry.Revision())
-	if err != nil {
-		return fmt.Errorf("failed to update key-value: %w", err)
+	code, ok := session.Values["invite"].(string)
+	if !ok || code == "" {
+		return "", nil
 	}
-
-	return nil
+	delete(session.Values, "invite")
+	if err := session.Save(r, w); err != nil {
+		return "", fmt.Errorf("failed to save session: %w", err)
+	}
+	return code, nil
 }
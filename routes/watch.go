@@ -0,0 +1,300 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/game"
+	"github.com/rphumulock/datastar_nats_tictactoe/store"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// gameView receives the changes of a game from watchGame. The Datastar
+// stream renders them as fragments, the WebSocket sends them as JSON. The
+// callbacks are called from several goroutines at once.
+type gameView struct {
+	board      func(gameState components.GameState) error
+	lobby      func(gameLobby components.GameLobby) error
+	spectators func(count int) error
+	presence   func(presence components.GamePresence) error
+	// clock is called every second while the clock of the game runs.
+	clock   func(gameState components.GameState, now time.Time) error
+	deleted func() error
+	// chatReplay gets the recent chat once, chat every later message.
+	chatReplay func(messages []components.ChatMessage) error
+	chat       func(message components.ChatMessage) error
+}
+
+// watchGame fans the board, lobby, spectators, presence and chat of a game
+// out to view until ctx is done. The session is online in the game while it
+// runs, and counted as watching while it is not seated; spectator tells
+// whether it was seated when it opened the game.
+func watchGame(ctx context.Context, repos *store.Repos, chat *chat, id, sessionId string, spectator bool, view gameView) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var latest atomic.Pointer[components.GameState]
+
+	// Joining or leaving the game moves the session between the players and
+	// the spectators. Only the latest seat matters, so a stale one is dropped
+	// before the next is handed on.
+	seats := make(chan bool, 1)
+	lobby := view.lobby
+	view.lobby = func(gameLobby components.GameLobby) error {
+		select {
+		case <-seats:
+		default:
+		}
+		seats <- seated(&gameLobby, sessionId)
+		return lobby(gameLobby)
+	}
+
+	// Use a WaitGroup to wait for all watchers to finish
+	var wg sync.WaitGroup
+	wg.Add(8) // Eight watchers: gameWatcher, gameLobbyWatcher, spectatorWatcher, the clock, the chat, presenceWatcher, our own presence and our seat
+
+	go func() {
+		defer wg.Done()
+		if err := watchGameBoard(ctx, repos, id, view, &latest); err != nil {
+			log.Printf("Game board watcher error: %v", err)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		watchClock(ctx, view, &latest)
+	}()
+
+	go func() {
+		defer wg.Done()
+		if err := watchGameLobby(ctx, repos, id, view); err != nil {
+			log.Printf("Game lobby watcher error: %v", err)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		if err := watchSpectators(ctx, repos, id, view); err != nil {
+			log.Printf("Spectator watcher error: %v", err)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		if err := chat.watch(ctx, id, view.chatReplay, view.chat); err != nil {
+			log.Printf("Chat watcher error: %v", err)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		if err := watchGamePresence(ctx, repos, id, view); err != nil {
+			log.Printf("Presence watcher error: %v", err)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		beOnline(ctx, repos, sessionId, id)
+	}()
+
+	go func() {
+		defer wg.Done()
+		spectate(ctx, repos, id, sessionId, spectator, seats)
+	}()
+
+	// Wait for all watchers to finish
+	wg.Wait()
+}
+
+func watchGameBoard(ctx context.Context, repos *store.Repos, gameId string, view gameView, latest *atomic.Pointer[components.GameState]) error {
+	gameWatcher, err := repos.Boards.Watch(ctx, gameId)
+	if err != nil {
+		return fmt.Errorf("failed to start game watcher: %w", err)
+	}
+	defer gameWatcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil // Exit if context is canceled
+		case update, ok := <-gameWatcher.Updates():
+			if !ok {
+				return nil // Exit if the channel is closed
+			}
+			if update == nil {
+				log.Println("End of historical updates. Now receiving live updates...")
+				continue
+			}
+
+			switch update.Op {
+			case store.OpPut:
+				gameState := update.Value
+
+				log.Printf("Received update for game %v", gameState)
+				latest.Store(&gameState)
+
+				if err := view.board(gameState); err != nil {
+					return err
+				}
+
+			case store.OpDelete:
+				if err := view.deleted(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func watchGameLobby(ctx context.Context, repos *store.Repos, gameId string, view gameView) error {
+	gameLobbyWatcher, err := repos.Lobbies.Watch(ctx, gameId)
+	if err != nil {
+		return fmt.Errorf("failed to start game lobby watcher: %w", err)
+	}
+	defer gameLobbyWatcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil // Exit if context is canceled
+		case gameLobbyEntry, ok := <-gameLobbyWatcher.Updates():
+			if !ok {
+				return nil // Exit if the channel is closed
+			}
+			if gameLobbyEntry == nil {
+				log.Println("End of historical updates. Now receiving live updates...")
+				continue
+			}
+
+			switch gameLobbyEntry.Op {
+			case store.OpPut:
+				gameLobby := gameLobbyEntry.Value
+
+				log.Printf("Received update for game lobby %v", gameLobby)
+
+				if err := view.lobby(gameLobby); err != nil {
+					return err
+				}
+
+			case store.OpDelete:
+				if err := view.deleted(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// spectate registers sessionId as a spectator of gameId while it is not
+// seated, until ctx is done. seats reports whether the session is seated
+// whenever the lobby changes. The entry is refreshed so it outlives the
+// bucket TTL while the connection is open, and expires on its own if the
+// server dies.
+func spectate(ctx context.Context, repos *store.Repos, gameId, sessionId string, spectating bool, seats <-chan bool) {
+	key := gameId + "." + sessionId
+	ticker := time.NewTicker(spectatorHeartbeat)
+	defer ticker.Stop()
+
+	leave := func() {
+		if err := repos.Spectators.Delete(context.Background(), key); err != nil {
+			log.Printf("Failed to remove spectator %s: %v", key, err)
+		}
+	}
+
+	for {
+		if spectating {
+			if _, err := repos.Spectators.Put(ctx, key, sessionId); err != nil {
+				log.Printf("Failed to register spectator %s: %v", key, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if spectating {
+				leave()
+			}
+			return
+		case isSeated := <-seats:
+			if isSeated && spectating {
+				leave()
+			}
+			spectating = !isSeated
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchSpectators reports the number of spectators whenever it changes.
+func watchSpectators(ctx context.Context, repos *store.Repos, gameId string, view gameView) error {
+	spectatorWatcher, err := repos.Spectators.Watch(ctx, gameId+".*")
+	if err != nil {
+		return fmt.Errorf("failed to start spectator watcher: %w", err)
+	}
+	defer spectatorWatcher.Stop()
+
+	watching := map[string]struct{}{}
+	historicalMode := true
+	count := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case entry, ok := <-spectatorWatcher.Updates():
+			if !ok {
+				return nil
+			}
+
+			if entry != nil {
+				switch entry.Op {
+				case store.OpPut:
+					watching[entry.Key] = struct{}{}
+				case store.OpDelete:
+					delete(watching, entry.Key)
+				}
+			} else {
+				historicalMode = false
+			}
+
+			if historicalMode || len(watching) == count {
+				continue
+			}
+			count = len(watching)
+
+			if err := view.spectators(count); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watchClock ticks the clock of the latest board every second while it
+// runs.
+func watchClock(ctx context.Context, view gameView, latest *atomic.Pointer[components.GameState]) {
+	ticker := time.NewTicker(clockInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			gameState := latest.Load()
+			if gameState == nil {
+				continue
+			}
+			if _, running := game.Deadline(*gameState); !running {
+				continue
+			}
+			if err := view.clock(*gameState, now); err != nil {
+				log.Printf("Game clock error: %v", err)
+				return
+			}
+		}
+	}
+}
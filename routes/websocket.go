@@ -0,0 +1,181 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"github.com/rphumulock/datastar_nats_tictactoe/api"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+const socketWriteTimeout = 10 * time.Second
+
+var errUnknownCommand = errors.New("unknown command")
+
+// setupWebSocketRoute serves the game over a single WebSocket, for clients
+// that cannot keep a Datastar stream open next to their POSTs. Updates come
+// from the same watchers as the game page and commands go through the game
+// service, so both transports behave the same.
+func setupWebSocketRoute(router chi.Router, sessionStore sessions.Store, service *gameService) error {
+	// socketView sends the changes of a game as JSON events, showing the
+	// lobby to sessionId. A deleted game closes the connection.
+	socketView := func(ctx context.Context, conn *websocket.Conn, sessionId string) (gameView, func(api.SocketEvent) error) {
+		send := func(event api.SocketEvent) error {
+			ctx, cancel := context.WithTimeout(ctx, socketWriteTimeout)
+			defer cancel()
+			return wsjson.Write(ctx, conn, event)
+		}
+
+		var deleted sync.Once
+
+		return gameView{
+			board: func(gameState components.GameState) error {
+				return send(api.SocketEvent{Type: api.EventBoard, Board: &gameState})
+			},
+			lobby: func(gameLobby components.GameLobby) error {
+				lobby := service.apiLobby(ctx, sessionId, &gameLobby)
+				return send(api.SocketEvent{Type: api.EventLobby, Lobby: &lobby})
+			},
+			spectators: func(count int) error {
+				return send(api.SocketEvent{Type: api.EventSpectators, Spectators: &count})
+			},
+			presence: func(gamePresence components.GamePresence) error {
+				return send(api.SocketEvent{Type: api.EventPresence, Presence: &gamePresence})
+			},
+			clock: func(gameState components.GameState, now time.Time) error {
+				return send(api.SocketEvent{Type: api.EventClock, Clock: clockView(&gameState, now)})
+			},
+			deleted: func() error {
+				var err error
+				deleted.Do(func() {
+					err = send(api.SocketEvent{Type: api.EventDeleted})
+					conn.Close(websocket.StatusNormalClosure, "game was deleted")
+				})
+				return err
+			},
+			chatReplay: func(messages []components.ChatMessage) error {
+				for i := range messages {
+					if err := send(api.SocketEvent{Type: api.EventChat, Chat: &messages[i]}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			chat: func(message components.ChatMessage) error {
+				return send(api.SocketEvent{Type: api.EventChat, Chat: &message})
+			},
+		}, send
+	}
+
+	runCommand := func(ctx context.Context, sessionId, id string, command api.SocketCommand) error {
+		switch command.Type {
+		case api.CommandMove:
+			return service.move(ctx, sessionId, id, command.Board, command.Cell)
+		case api.CommandReset:
+			return service.reset(ctx, sessionId, id)
+		case api.CommandJoin:
+			return service.join(ctx, sessionId, id)
+		case api.CommandChat:
+			return service.chat.send(ctx, id, sessionId, command.Text)
+		case api.CommandLeave:
+			_, err := service.leave(ctx, sessionId, id)
+			return err
+		default:
+			return fmt.Errorf("%w %q", errUnknownCommand, command.Type)
+		}
+	}
+
+	// readCommands runs the commands of a connection and sends their results
+	// until it is closed.
+	readCommands := func(ctx context.Context, conn *websocket.Conn, sessionId, id string, send func(api.SocketEvent) error) {
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				if websocket.CloseStatus(err) == -1 && ctx.Err() == nil {
+					log.Printf("Error reading game socket of %s: %v", sessionId, err)
+				}
+				return
+			}
+
+			var command api.SocketCommand
+			result := api.SocketEvent{Type: api.EventResult}
+			if err := json.Unmarshal(data, &command); err != nil {
+				msg := fmt.Sprintf("Invalid command: %v", err)
+				result.Error = &api.Error{Status: http.StatusBadRequest, Message: msg}
+			} else {
+				result.Id = command.Id
+				if err := runCommand(ctx, sessionId, id, command); err != nil {
+					status, msg := serviceError(err)
+					if errors.Is(err, errUnknownCommand) {
+						status, msg = http.StatusBadRequest, err.Error()
+					}
+					result.Error = &api.Error{Status: status, Message: msg}
+				}
+			}
+
+			if err := send(result); err != nil {
+				return
+			}
+		}
+	}
+
+	handleGameSocket := func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		sessionId, err := getSessionId(sessionStore, r)
+		if err != nil || sessionId == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		user, _, err := service.repos.Users.Get(r.Context(), sessionId)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		service.seen(r.Context(), user)
+
+		gameLobby, err := service.lobby(r.Context(), sessionId, id)
+		if err != nil {
+			http.Error(w, "game not found", http.StatusNotFound)
+			return
+		}
+		isSpectator := !seated(gameLobby, sessionId)
+
+		// Accept rejects cross origin requests, so other sites cannot open
+		// the socket with the session cookie of a visitor.
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			log.Printf("Error accepting game socket of %s: %v", sessionId, err)
+			return
+		}
+		defer conn.CloseNow()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		view, send := socketView(ctx, conn, sessionId)
+
+		go func() {
+			defer cancel()
+			readCommands(ctx, conn, sessionId, id, send)
+		}()
+
+		watchGame(ctx, service.repos, service.chat, id, sessionId, isSpectator, view)
+		conn.Close(websocket.StatusNormalClosure, "")
+	}
+
+	router.Get("/ws/game/{id}", handleGameSocket)
+
+	return nil
+}
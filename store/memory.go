@@ -0,0 +1,277 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// NewMemory returns repositories that keep everything in memory. Records do
+// not expire, so bucket TTLs of the NATS implementation do not apply.
+func NewMemory() *Repos {
+	return &Repos{
+		Users:      newMemoryRepo[components.User](),
+		Lobbies:    newMemoryRepo[components.GameLobby](),
+		Boards:     newMemoryRepo[components.GameState](),
+		Spectators: newMemoryRepo[string](),
+		Players:    newMemoryRepo[components.Player](),
+		Invites:    newMemoryRepo[components.Invite](),
+		MatchQueue: newMemoryRepo[components.QueueEntry](),
+		Presence:   newMemoryRepo[components.Presence](),
+	}
+}
+
+type memoryRecord struct {
+	value    []byte
+	revision uint64
+}
+
+// memoryRepo stores records as JSON, like the NATS implementation, so
+// callers never share values with the repository.
+type memoryRepo[T any] struct {
+	mu       sync.Mutex
+	records  map[string]memoryRecord
+	revision uint64
+	watchers map[*memoryWatcher[T]]struct{}
+}
+
+func newMemoryRepo[T any]() *memoryRepo[T] {
+	return &memoryRepo[T]{
+		records:  map[string]memoryRecord{},
+		watchers: map[*memoryWatcher[T]]struct{}{},
+	}
+}
+
+func (r *memoryRepo[T]) Get(ctx context.Context, key string) (*T, uint64, error) {
+	r.mu.Lock()
+	record, ok := r.records[key]
+	r.mu.Unlock()
+	if !ok {
+		return nil, 0, fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+	}
+
+	var value T
+	if err := json.Unmarshal(record.value, &value); err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal value for key %s: %w", key, err)
+	}
+	return &value, record.revision, nil
+}
+
+func (r *memoryRepo[T]) Put(ctx context.Context, key string, value T) (uint64, error) {
+	return r.write(key, value, func(memoryRecord, bool) error { return nil })
+}
+
+func (r *memoryRepo[T]) Create(ctx context.Context, key string, value T) (uint64, error) {
+	return r.write(key, value, func(_ memoryRecord, exists bool) error {
+		if exists {
+			return fmt.Errorf("failed to write key %s: %w", key, ErrConflict)
+		}
+		return nil
+	})
+}
+
+func (r *memoryRepo[T]) Update(ctx context.Context, key string, value T, revision uint64) (uint64, error) {
+	return r.write(key, value, func(record memoryRecord, exists bool) error {
+		if !exists || record.revision != revision {
+			return fmt.Errorf("failed to write key %s: %w", key, ErrConflict)
+		}
+		return nil
+	})
+}
+
+// write stores value under key if check accepts the current record.
+func (r *memoryRepo[T]) write(key string, value T, check func(memoryRecord, bool) error) (uint64, error) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, exists := r.records[key]
+	if err := check(record, exists); err != nil {
+		return 0, err
+	}
+
+	r.revision++
+	r.records[key] = memoryRecord{value: bytes, revision: r.revision}
+	r.notify(key, bytes, OpPut)
+	return r.revision, nil
+}
+
+func (r *memoryRepo[T]) Delete(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.records[key]; !ok {
+		return nil
+	}
+	r.revision++
+	delete(r.records, key)
+	r.notify(key, nil, OpDelete)
+	return nil
+}
+
+func (r *memoryRepo[T]) Purge(ctx context.Context, key string) error {
+	return r.Delete(ctx, key)
+}
+
+func (r *memoryRepo[T]) Keys(ctx context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.records))
+	for key := range r.records {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (r *memoryRepo[T]) Watch(ctx context.Context, pattern string) (Watcher[T], error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w := &memoryWatcher[T]{
+		pattern: pattern,
+		updates: make(chan *Entry[T]),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+
+	// Queue the current records oldest first, then the end of the initial
+	// values, before any later write can be queued.
+	keys := make([]string, 0, len(r.records))
+	for key := range r.records {
+		if matchPattern(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Compare(r.records[a].revision, r.records[b].revision)
+	})
+	for _, key := range keys {
+		record := r.records[key]
+		w.push(r.entry(key, record.value, record.revision, OpPut))
+	}
+	w.push(nil)
+
+	r.watchers[w] = struct{}{}
+	go func() {
+		w.run(ctx)
+		r.mu.Lock()
+		delete(r.watchers, w)
+		r.mu.Unlock()
+	}()
+
+	return w, nil
+}
+
+func (r *memoryRepo[T]) WatchAll(ctx context.Context) (Watcher[T], error) {
+	return r.Watch(ctx, ">")
+}
+
+// notify queues a change for every matching watcher. It must be called with
+// r.mu held.
+func (r *memoryRepo[T]) notify(key string, value []byte, op Op) {
+	for w := range r.watchers {
+		if matchPattern(w.pattern, key) {
+			w.push(r.entry(key, value, r.revision, op))
+		}
+	}
+}
+
+func (r *memoryRepo[T]) entry(key string, value []byte, revision uint64, op Op) *Entry[T] {
+	entry := &Entry[T]{Key: key, Revision: revision, Op: op}
+	if op == OpPut {
+		// Values were marshalled from a T, so they always unmarshal.
+		json.Unmarshal(value, &entry.Value)
+	}
+	return entry
+}
+
+// matchPattern reports whether key matches a NATS style subject pattern.
+func matchPattern(pattern, key string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	keyTokens := strings.Split(key, ".")
+	for i, token := range patternTokens {
+		switch {
+		case token == ">":
+			return i < len(keyTokens)
+		case i >= len(keyTokens):
+			return false
+		case token != "*" && token != keyTokens[i]:
+			return false
+		}
+	}
+	return len(patternTokens) == len(keyTokens)
+}
+
+// memoryWatcher queues entries without blocking writers and hands them to
+// the reader in order.
+type memoryWatcher[T any] struct {
+	pattern string
+	updates chan *Entry[T]
+	wake    chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+
+	mu    sync.Mutex
+	queue []*Entry[T]
+}
+
+func (w *memoryWatcher[T]) push(entry *Entry[T]) {
+	w.mu.Lock()
+	w.queue = append(w.queue, entry)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *memoryWatcher[T]) run(ctx context.Context) {
+	defer close(w.updates)
+
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+
+		for _, entry := range queue {
+			select {
+			case w.updates <- entry:
+			case <-ctx.Done():
+				return
+			case <-w.stop:
+				return
+			}
+		}
+
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+			return
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *memoryWatcher[T]) Updates() <-chan *Entry[T] {
+	return w.updates
+}
+
+func (w *memoryWatcher[T]) Stop() error {
+	w.once.Do(func() { close(w.stop) })
+	return nil
+}
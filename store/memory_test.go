@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+func TestMemoryUpdate(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryRepo[components.User]()
+
+	if _, err := repo.Update(ctx, "missing", components.User{}, 1); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Update() of a missing key error = %v, want ErrConflict", err)
+	}
+
+	created, err := repo.Create(ctx, "alice", components.User{Name: "alice"})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := repo.Create(ctx, "alice", components.User{Name: "alice"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Create() of an existing key error = %v, want ErrConflict", err)
+	}
+
+	updated, err := repo.Update(ctx, "alice", components.User{Name: "alice", HostedGames: []string{"g1"}}, created)
+	if err != nil {
+		t.Fatalf("Update() at the current revision error = %v", err)
+	}
+	if updated <= created {
+		t.Fatalf("Update() revision = %d, want more than %d", updated, created)
+	}
+
+	// A writer still holding the first revision lost the race.
+	if _, err := repo.Update(ctx, "alice", components.User{Name: "stale"}, created); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Update() at a stale revision error = %v, want ErrConflict", err)
+	}
+
+	user, revision, err := repo.Get(ctx, "alice")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if revision != updated || len(user.HostedGames) != 1 {
+		t.Fatalf("Get() = %+v at %d, want the update at %d", user, revision, updated)
+	}
+
+	// Values are copies, changing one leaves the record alone.
+	user.HostedGames[0] = "changed"
+	if again, _, _ := repo.Get(ctx, "alice"); again.HostedGames[0] != "g1" {
+		t.Fatalf("Get() returned a value shared with the repository")
+	}
+
+	if err := repo.Delete(ctx, "alice"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, _, err := repo.Get(ctx, "alice"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get() after Delete() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestModifyRetriesConflicts(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryRepo[components.User]()
+	if _, err := repo.Create(ctx, "alice", components.User{Name: "alice"}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	attempts := 0
+	_, err := Modify(ctx, repo, "alice", func(user *components.User) error {
+		attempts++
+		if attempts == 1 {
+			// Someone else writes between the read and the write back.
+			if _, err := repo.Put(ctx, "alice", components.User{Name: "alice", HostedGames: []string{"g1"}}); err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+		}
+		user.HostedGames = append(user.HostedGames, "g2")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Modify() error = %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("Modify() ran update %d times, want 2", attempts)
+	}
+
+	user, _, _ := repo.Get(ctx, "alice")
+	if len(user.HostedGames) != 2 {
+		t.Fatalf("HostedGames = %v, want both games", user.HostedGames)
+	}
+}
+
+// next reads the next entry of w, failing the test if none arrives.
+func next[T any](t *testing.T, w Watcher[T]) *Entry[T] {
+	t.Helper()
+	select {
+	case entry, ok := <-w.Updates():
+		if !ok {
+			t.Fatal("watcher closed")
+		}
+		return entry
+	case <-time.After(time.Second):
+		t.Fatal("no update from watcher")
+		return nil
+	}
+}
+
+func TestMemoryWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repo := newMemoryRepo[string]()
+
+	repo.Put(ctx, "g1.b", "replaced")
+	repo.Put(ctx, "g1.a", "older")
+	repo.Put(ctx, "g2.a", "other game")
+	repo.Update(ctx, "g1.b", "newer", 1)
+
+	w, err := repo.Watch(ctx, "g1.*")
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	defer w.Stop()
+
+	// The initial values come oldest first, then the nil marker.
+	for _, want := range []string{"older", "newer"} {
+		if entry := next(t, w); entry == nil || entry.Op != OpPut || entry.Value != want {
+			t.Fatalf("initial entry = %+v, want %q", entry, want)
+		}
+	}
+	if entry := next(t, w); entry != nil {
+		t.Fatalf("entry after the initial values = %+v, want nil", entry)
+	}
+
+	repo.Put(ctx, "g2.b", "ignored")
+	repo.Put(ctx, "g1.c", "new")
+	if entry := next(t, w); entry == nil || entry.Key != "g1.c" || entry.Value != "new" {
+		t.Fatalf("entry after put = %+v, want g1.c", entry)
+	}
+
+	repo.Delete(ctx, "g1.a")
+	if entry := next(t, w); entry == nil || entry.Key != "g1.a" || entry.Op != OpDelete {
+		t.Fatalf("entry after delete = %+v, want a delete of g1.a", entry)
+	}
+}
+
+func TestMemoryWatchEmpty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	repo := newMemoryRepo[string]()
+
+	w, err := repo.WatchAll(ctx)
+	if err != nil {
+		t.Fatalf("WatchAll() error = %v", err)
+	}
+	if entry := next(t, w); entry != nil {
+		t.Fatalf("first entry of an empty repo = %+v, want nil", entry)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-w.Updates():
+		if ok {
+			t.Fatal("watcher delivered an entry after its context was done")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watcher not closed after its context was done")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"g1", "g1", true},
+		{"g1", "g2", false},
+		{"g1", "g1.s1", false},
+		{"g1.*", "g1.s1", true},
+		{"g1.*", "g1", false},
+		{"g1.*", "g1.s1.x", false},
+		{"*.s1", "g1.s1", true},
+		{"*.s1", "g1.s2", false},
+		{">", "g1", true},
+		{">", "g1.s1", true},
+		{"g1.>", "g1.s1.x", true},
+		{"g1.>", "g1", false},
+		{"g2.>", "g1.s1", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// NewNATS returns repositories backed by the key value buckets of js. The
+// buckets must already exist.
+func NewNATS(ctx context.Context, js jetstream.JetStream) (*Repos, error) {
+	var errs []error
+	bucket := func(name string) jetstream.KeyValue {
+		kv, err := js.KeyValue(ctx, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get %q key value: %w", name, err))
+		}
+		return kv
+	}
+
+	repos := &Repos{
+		Users:      &natsRepo[components.User]{kv: bucket(UsersBucket)},
+		Lobbies:    &natsRepo[components.GameLobby]{kv: bucket(LobbiesBucket)},
+		Boards:     &natsRepo[components.GameState]{kv: bucket(BoardsBucket)},
+		Spectators: &natsRepo[string]{kv: bucket(SpectatorsBucket)},
+		Players:    &natsRepo[components.Player]{kv: bucket(PlayersBucket)},
+		Invites:    &natsRepo[components.Invite]{kv: bucket(InvitesBucket)},
+		MatchQueue: &natsRepo[components.QueueEntry]{kv: bucket(MatchQueueBucket)},
+		Presence:   &natsRepo[components.Presence]{kv: bucket(PresenceBucket)},
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+type natsRepo[T any] struct {
+	kv jetstream.KeyValue
+}
+
+func natsError(key string, err error) error {
+	switch {
+	case errors.Is(err, jetstream.ErrKeyNotFound), errors.Is(err, jetstream.ErrKeyDeleted):
+		return fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+	case errors.Is(err, jetstream.ErrKeyExists):
+		return fmt.Errorf("failed to write key %s: %w", key, ErrConflict)
+	default:
+		return fmt.Errorf("key %s: %w", key, err)
+	}
+}
+
+func (r *natsRepo[T]) Get(ctx context.Context, key string) (*T, uint64, error) {
+	entry, err := r.kv.Get(ctx, key)
+	if err != nil {
+		return nil, 0, natsError(key, err)
+	}
+
+	var value T
+	if err := json.Unmarshal(entry.Value(), &value); err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal value for key %s: %w", key, err)
+	}
+
+	return &value, entry.Revision(), nil
+}
+
+func (r *natsRepo[T]) Put(ctx context.Context, key string, value T) (uint64, error) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	revision, err := r.kv.Put(ctx, key, bytes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to put key-value: %w", err)
+	}
+	return revision, nil
+}
+
+func (r *natsRepo[T]) Create(ctx context.Context, key string, value T) (uint64, error) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	revision, err := r.kv.Create(ctx, key, bytes)
+	if err != nil {
+		return 0, natsError(key, err)
+	}
+	return revision, nil
+}
+
+func (r *natsRepo[T]) Update(ctx context.Context, key string, value T, revision uint64) (uint64, error) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	revision, err = r.kv.Update(ctx, key, bytes, revision)
+	if err != nil {
+		return 0, natsError(key, err)
+	}
+	return revision, nil
+}
+
+func (r *natsRepo[T]) Delete(ctx context.Context, key string) error {
+	if err := r.kv.Delete(ctx, key); err != nil {
+		return fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+	return nil
+}
+
+func (r *natsRepo[T]) Purge(ctx context.Context, key string) error {
+	if err := r.kv.Purge(ctx, key); err != nil {
+		return fmt.Errorf("failed to purge key %s: %w", key, err)
+	}
+	return nil
+}
+
+func (r *natsRepo[T]) Keys(ctx context.Context) ([]string, error) {
+	keys, err := r.kv.Keys(ctx)
+	if errors.Is(err, jetstream.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (r *natsRepo[T]) Watch(ctx context.Context, pattern string) (Watcher[T], error) {
+	watcher, err := r.kv.Watch(ctx, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch %s: %w", pattern, err)
+	}
+	return newNATSWatcher[T](ctx, watcher), nil
+}
+
+func (r *natsRepo[T]) WatchAll(ctx context.Context) (Watcher[T], error) {
+	watcher, err := r.kv.WatchAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch all keys: %w", err)
+	}
+	return newNATSWatcher[T](ctx, watcher), nil
+}
+
+// natsWatcher decodes the entries of a key value watcher.
+type natsWatcher[T any] struct {
+	watcher jetstream.KeyWatcher
+	updates chan *Entry[T]
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func newNATSWatcher[T any](ctx context.Context, watcher jetstream.KeyWatcher) *natsWatcher[T] {
+	w := &natsWatcher[T]{
+		watcher: watcher,
+		updates: make(chan *Entry[T]),
+		stop:    make(chan struct{}),
+	}
+	go w.run(ctx)
+	return w
+}
+
+func (w *natsWatcher[T]) run(ctx context.Context) {
+	defer close(w.updates)
+
+	for {
+		var kvEntry jetstream.KeyValueEntry
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.stop:
+			return
+		case e, ok := <-w.watcher.Updates():
+			if !ok {
+				return
+			}
+			kvEntry = e
+		}
+
+		var entry *Entry[T]
+		if kvEntry != nil {
+			entry = &Entry[T]{
+				Key:      kvEntry.Key(),
+				Revision: kvEntry.Revision(),
+				Op:       OpDelete,
+			}
+			if kvEntry.Operation() == jetstream.KeyValuePut {
+				entry.Op = OpPut
+				if err := json.Unmarshal(kvEntry.Value(), &entry.Value); err != nil {
+					log.Printf("Error unmarshalling value for key %s: %v", kvEntry.Key(), err)
+					continue
+				}
+			}
+		}
+
+		select {
+		case w.updates <- entry:
+		case <-ctx.Done():
+			return
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *natsWatcher[T]) Updates() <-chan *Entry[T] {
+	return w.updates
+}
+
+func (w *natsWatcher[T]) Stop() error {
+	w.once.Do(func() { close(w.stop) })
+	return w.watcher.Stop()
+}
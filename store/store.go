@@ -0,0 +1,128 @@
+// Package store keeps the application's records behind typed repositories.
+// Every record carries a revision; writes that pass the revision they read
+// fail with ErrConflict if someone else wrote in the meantime. Repositories
+// are backed by NATS JetStream key value buckets in production and by memory
+// in tests and tools.
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rphumulock/datastar_nats_tictactoe/web/components"
+)
+
+// Bucket names of the NATS implementation.
+const (
+	UsersBucket      = "users"
+	LobbiesBucket    = "gameLobbies"
+	BoardsBucket     = "gameBoards"
+	SpectatorsBucket = "gameSpectators"
+	PlayersBucket    = "players"
+	InvitesBucket    = "gameInvites"
+	MatchQueueBucket = "matchQueue"
+	PresenceBucket   = "presence"
+)
+
+var (
+	ErrNotFound = errors.New("record not found")
+	// ErrConflict is returned when a record changed since the revision a
+	// write was based on, or already exists on create.
+	ErrConflict = errors.New("record was changed concurrently")
+)
+
+type Op int
+
+const (
+	OpPut Op = iota
+	OpDelete
+)
+
+// Entry is a record as stored at Revision. Value is the zero value for
+// deletes.
+type Entry[T any] struct {
+	Key      string
+	Value    T
+	Revision uint64
+	Op       Op
+}
+
+// Watcher delivers the current entries matching a watch, then a nil entry,
+// then every later change.
+type Watcher[T any] interface {
+	Updates() <-chan *Entry[T]
+	Stop() error
+}
+
+// Repo is a typed key value repository with optimistic concurrency.
+type Repo[T any] interface {
+	Get(ctx context.Context, key string) (*T, uint64, error)
+	Put(ctx context.Context, key string, value T) (uint64, error)
+	// Create stores value only if key does not exist yet.
+	Create(ctx context.Context, key string, value T) (uint64, error)
+	// Update stores value only if key is still at revision.
+	Update(ctx context.Context, key string, value T, revision uint64) (uint64, error)
+	// Delete removes key, Purge also drops its history.
+	Delete(ctx context.Context, key string) error
+	Purge(ctx context.Context, key string) error
+	Keys(ctx context.Context) ([]string, error)
+	// Watch follows the keys matching pattern, where "*" matches a single
+	// dot separated token and ">" the rest of the key.
+	Watch(ctx context.Context, pattern string) (Watcher[T], error)
+	WatchAll(ctx context.Context) (Watcher[T], error)
+}
+
+type (
+	UserRepo      = Repo[components.User]
+	LobbyRepo     = Repo[components.GameLobby]
+	BoardRepo     = Repo[components.GameState]
+	PlayerRepo    = Repo[components.Player]
+	InviteRepo    = Repo[components.Invite]
+	QueueRepo     = Repo[components.QueueEntry]
+	SpectatorRepo = Repo[string]
+	PresenceRepo  = Repo[components.Presence]
+)
+
+// Repos groups the repositories of the application.
+type Repos struct {
+	Users      UserRepo
+	Lobbies    LobbyRepo
+	Boards     BoardRepo
+	Spectators SpectatorRepo
+	Players    PlayerRepo
+	Invites    InviteRepo
+	MatchQueue QueueRepo
+	Presence   PresenceRepo
+}
+
+// maxModifyAttempts bounds the retries of Modify while other writers keep
+// changing the record.
+const maxModifyAttempts = 5
+
+// Modify applies update to the record stored under key and writes it back
+// at the revision it was read at, starting over if the record changed in the
+// meantime. An error returned by update aborts the modification.
+func Modify[T any](ctx context.Context, repo Repo[T], key string, update func(*T) error) (uint64, error) {
+	var err error
+	for range maxModifyAttempts {
+		var value *T
+		var revision uint64
+		value, revision, err = repo.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := update(value); err != nil {
+			return 0, err
+		}
+
+		revision, err = repo.Update(ctx, key, *value, revision)
+		if err == nil {
+			return revision, nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return 0, err
+		}
+	}
+	return 0, err
+}
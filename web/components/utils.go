@@ -1,12 +1,59 @@
 package components
 
+import "time"
+
 type InlineValidationUserName struct {
-	Name string `json:"name"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+const (
+	ModeClassic  = "classic"
+	ModeUltimate = "ultimate"
+)
+
+type GameSettings struct {
+	Mode      string `json:"mode"`
+	BoardSize int    `json:"boardSize"`
+	WinLength int    `json:"winLength"`
+	Opponent  string `json:"opponent"`
+	Private   bool   `json:"private"`
+	// MoveSeconds and GameMinutes are the time controls of the game, 0
+	// disables them.
+	MoveSeconds int `json:"moveSeconds"`
+	GameMinutes int `json:"gameMinutes"`
+	// BestOf is the length of the series, 1 plays single games.
+	BestOf int `json:"bestOf"`
+	// InviteTTL is how many minutes the invite of a private game stays
+	// valid, 0 keeps it valid for as long as the game exists.
+	InviteTTL int `json:"inviteTTL"`
 }
 
 type User struct {
 	Name      string `json:"name"`
 	SessionId string `json:"session_id"`
+	PlayerId  string `json:"player_id,omitempty"`
+	// HostedGames are the ids of the games the session created, so they can
+	// be removed with it. Ids of games removed since may linger.
+	HostedGames []string `json:"hosted_games,omitempty"`
+	// LastSeenAt is when the session last made a request to one of the
+	// APIs, whose clients may not keep a connection open.
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// Player is a durable account in the players bucket. Users come and go with
+// their sessions, a player keeps its rating across logins.
+type Player struct {
+	Id           string    `json:"id"`
+	Name         string    `json:"name"`
+	PasswordHash []byte    `json:"password_hash"`
+	Rating       int       `json:"rating"`
+	Wins         int       `json:"wins"`
+	Losses       int       `json:"losses"`
+	Draws        int       `json:"draws"`
+	SeriesWins   int       `json:"series_wins"`
+	SeriesLosses int       `json:"series_losses"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
 type GameLobby struct {
@@ -14,11 +61,177 @@ type GameLobby struct {
 	Name         string `json:"name"`
 	HostId       string `json:"host_id"`
 	ChallengerId string `json:"challenger_id"`
+	Mode         string `json:"mode"`
+	Size         int    `json:"size"`
+	WinLength    int    `json:"win_length"`
+	Private      bool   `json:"private"`
+	InviteCode   string `json:"invite_code,omitempty"`
+	BestOf       int    `json:"best_of"`
+}
+
+// Invite maps the code of an invite link to a private game. A zero ExpiresAt
+// never expires.
+type Invite struct {
+	Code      string    `json:"code"`
+	GameId    string    `json:"game_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// QueueEntry is a player waiting for a quick match. The matchmaker sets
+// GameId once the player has been paired.
+type QueueEntry struct {
+	SessionId string    `json:"session_id"`
+	Rating    int       `json:"rating"`
+	JoinedAt  time.Time `json:"joined_at"`
+	GameId    string    `json:"game_id,omitempty"`
+}
+
+// Presence is an open connection of a session, refreshed while it lasts.
+// GameId is empty on the dashboard.
+type Presence struct {
+	SessionId string    `json:"session_id"`
+	Name      string    `json:"name"`
+	GameId    string    `json:"game_id,omitempty"`
+	SeenAt    time.Time `json:"seen_at"`
+}
+
+// Online maps the sessions with an open connection to the games they have
+// open, with "" standing for the dashboard.
+type Online map[string]map[string]bool
+
+// IsOnline reports whether sessionId has any connection open.
+func (o Online) IsOnline(sessionId string) bool {
+	return len(o[sessionId]) > 0
+}
+
+// InGame reports whether sessionId has gameId open.
+func (o Online) InGame(sessionId, gameId string) bool {
+	return o[sessionId][gameId]
+}
+
+// OnlinePlayer is an entry of the online list of the dashboard.
+type OnlinePlayer struct {
+	Name    string `json:"name"`
+	Playing bool   `json:"playing"`
+}
+
+// GamePresence tells whether the seated players have the game open.
+type GamePresence struct {
+	Host       bool `json:"host"`
+	Challenger bool `json:"challenger"`
+}
+
+type MatchSignals struct {
+	Queued bool `json:"queued"`
 }
 
 type GameState struct {
-	Id      string    `json:"id"`
-	Board   [9]string `json:"board"`
-	XIsNext bool      `json:"turn"`
-	Winner  string    `json:"winner"`
+	Id        string         `json:"id"`
+	Mode      string         `json:"mode"`
+	Board     []string       `json:"board"`
+	Size      int            `json:"size"`
+	WinLength int            `json:"win_length"`
+	XIsNext   bool           `json:"turn"`
+	Winner    string         `json:"winner"`
+	Round     int            `json:"round"`
+	Moves     int            `json:"moves"`
+	Ultimate  *UltimateState `json:"ultimate,omitempty"`
+	Clock     *Clock         `json:"clock,omitempty"`
+	// HostIsO is set when the host plays O. Sides swap every game so both
+	// seats get to move first.
+	HostIsO bool    `json:"host_is_o"`
+	Series  *Series `json:"series,omitempty"`
+	// Forfeit is the player who lost on time, if any.
+	Forfeit string `json:"forfeit,omitempty"`
+}
+
+// Clock holds the time controls of a game. The remaining times are as of
+// TurnStartedAt, from where the clock of the player to move is running. A
+// zero TurnStartedAt means the clock has not started yet.
+type Clock struct {
+	MoveTime      time.Duration `json:"move_time"`
+	GameTime      time.Duration `json:"game_time"`
+	RemainingX    time.Duration `json:"remaining_x"`
+	RemainingO    time.Duration `json:"remaining_o"`
+	TurnStartedAt time.Time     `json:"turn_started_at"`
+}
+
+const (
+	SeatHost       = "host"
+	SeatChallenger = "challenger"
+)
+
+// Series keeps the score of a best-of-N series by seat, since the seats swap
+// sides between games. Winner is the seat that won the series, if any.
+type Series struct {
+	BestOf         int    `json:"best_of"`
+	HostWins       int    `json:"host_wins"`
+	ChallengerWins int    `json:"challenger_wins"`
+	Draws          int    `json:"draws"`
+	Winner         string `json:"winner,omitempty"`
+}
+
+// ClockView is what the players see of a Clock at a given moment.
+type ClockView struct {
+	X       time.Duration `json:"x"`
+	O       time.Duration `json:"o"`
+	Next    string        `json:"next"`
+	Running bool          `json:"running"`
+}
+
+// UltimateState holds the nine sub-boards of an ultimate game. The outer
+// GameState.Board records the result of each sub-board.
+type UltimateState struct {
+	Boards      [][]string `json:"boards"`
+	ActiveBoard int        `json:"active_board"`
+}
+
+// Events of a game's move history other than moves.
+const (
+	// EventForfeit ends a game in favour of the opponent of Player, who ran
+	// out of time.
+	EventForfeit = "forfeit"
+	// EventReset starts the next game of a lobby once the current one is
+	// decided.
+	EventReset = "reset"
+)
+
+// MoveRecord is one entry of a game's move history. Mode, Size and WinLength
+// are copied from the game so a replay does not depend on the lobby or board
+// still existing. Event is empty for a move; events keep the Sequence of the
+// last move of the board they end.
+type MoveRecord struct {
+	GameId    string    `json:"game_id"`
+	Round     int       `json:"round"`
+	Sequence  int       `json:"sequence"`
+	SessionId string    `json:"session_id"`
+	Player    string    `json:"player"`
+	Board     int       `json:"board"`
+	Cell      int       `json:"cell"`
+	Mode      string    `json:"mode"`
+	Size      int       `json:"size"`
+	WinLength int       `json:"win_length"`
+	Event     string    `json:"event,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type ReplaySignals struct {
+	Step int `json:"step"`
+}
+
+// ChatMessage is a line of the chat of a game or of the dashboard. Seat is
+// empty for spectators and on the dashboard.
+type ChatMessage struct {
+	// Sequence numbers the message in its stream. It is set when the
+	// message is read back.
+	Sequence  uint64    `json:"sequence,omitempty"`
+	GameId    string    `json:"game_id,omitempty"`
+	Name      string    `json:"name"`
+	Seat      string    `json:"seat,omitempty"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type ChatSignals struct {
+	Chat string `json:"chat"`
 }